@@ -57,6 +57,10 @@ type Config struct {
 	// NoPrefetch disables prefetching. Default is false.
 	NoPrefetch bool `toml:"noprefetch"`
 
+	// PrefetchTOC makes the read of the footer of the layer also fetch the TOC, which is read next
+	// when mounting the layer. Default is false.
+	PrefetchTOC bool `toml:"prefetch_toc"`
+
 	// NoBackgroundFetch disables the behaviour of fetching the entire layer contents in background. Default is false.
 	NoBackgroundFetch bool `toml:"no_background_fetch"`
 
@@ -112,6 +116,7 @@ type BlobConfig struct {
 	// during prefetch. It is recommended to have PrefetchChunkSize > ChunkSize.
 	// If PrefetchChunkSize < ChunkSize prefetch bytes will be fetched as a single http GET,
 	// else total GET requests for prefetch = ceil(PrefetchSize / PrefetchChunkSize).
+	// PrefetchChunkSize > ChunkSize is rounded down to a multiple of ChunkSize. Negative values are invalid.
 	// Default is 0.
 	PrefetchChunkSize int64 `toml:"prefetch_chunk_size"`
 
@@ -123,6 +128,52 @@ type BlobConfig struct {
 
 	// MinWaitMSec is maximum delay (in seconds) for the next retrying after a request failure. Default is 30.
 	MaxWaitMSec int `toml:"max_wait_msec"`
+
+	// FetchMaxAttempts is the max number of attempts to fetch chunks from the registry when the
+	// fetch fails with a server error (5xx) or a network error. Default is 0 (no retry).
+	// If this is larger than 1, the fetches of chunks aren't retried by the transport (MaxRetries), so
+	// a failed fetch is attempted FetchMaxAttempts times in total.
+	FetchMaxAttempts int `toml:"fetch_max_attempts"`
+
+	// FetchRetryBaseMSec is the base delay (in milliseconds) of the exponential backoff between the attempts
+	// to fetch chunks. The actual delay is randomized ("full jitter"). Default is 100.
+	FetchRetryBaseMSec int `toml:"fetch_retry_base_msec"`
+
+	// MinThroughput is the minimum throughput (in bytes/sec) of fetching contents from the registry.
+	// A fetch is aborted if the throughput stays below it for StallWindowSec. Only the time spent in
+	// receiving the contents counts, so a slow consumer (e.g. throttled by a rate limit) isn't a stall.
+	// Default is 0 (disabled).
+	MinThroughput int64 `toml:"min_throughput"`
+
+	// StallWindowSec is the duration (in seconds) to measure the throughput of a fetch to detect stalls.
+	// Default is 10 if MinThroughput is specified.
+	StallWindowSec int64 `toml:"stall_window_sec"`
+
+	// PlainGetThreshold is the size (in bytes) of blobs below which requests to the blob don't specify Range,
+	// for registries rejecting Range on small blobs. Such blob is fetched and cached at once. Default is 0 (disabled).
+	PlainGetThreshold int64 `toml:"plain_get_threshold"`
+
+	// CoalesceGap is the max size (in bytes) of the gap between regions fetched together, which is fetched
+	// and cached too so that the regions are fetched as one contiguous range. Default is 0 (disabled).
+	CoalesceGap int64 `toml:"coalesce_gap"`
+
+	// HedgeDelayMSec is the delay (in milliseconds) after which a request to the registry is also sent to
+	// another mirror if the first one doesn't respond. The first response is used. Default is 0 (disabled).
+	HedgeDelayMSec int64 `toml:"hedge_delay_msec"`
+
+	// MirrorFailover makes the blob resolved on all of the mirrors of the registry, and a failed request to
+	// one of them retried on the next one. The one which last succeeded is used first. This takes precedence
+	// over HedgeDelayMSec. Default is false (only the first available mirror is used).
+	MirrorFailover bool `toml:"mirror_failover"`
+
+	// LenientContentRange makes a 200 response with a valid Content-Range of a part of the blob treated as
+	// the contents of that range, for registries responding so to range requests. Otherwise, such response
+	// is rejected. Default is false.
+	LenientContentRange bool `toml:"lenient_content_range"`
+
+	// PreferredNetwork is the network ("tcp4" or "tcp6") tried first when connecting to the registry.
+	// If it fails, the connection falls back to any of the available networks. Default is no preference.
+	PreferredNetwork string `toml:"preferred_network"`
 }
 
 // DirectoryCacheConfig is configuration for the disk-based cache.
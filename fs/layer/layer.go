@@ -358,7 +358,15 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 	}()
 
 	// Resolve the blob and cache the result.
-	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, httpCache)
+	var blobOpts []remote.BlobOption
+	if r.config.PrefetchTOC {
+		blobOpts = append(blobOpts, remote.WithTOCPrefetch(tocLocator(
+			new(estargz.GzipDecompressor),
+			new(estargz.LegacyGzipDecompressor),
+			new(zstdchunked.Decompressor),
+		)))
+	}
+	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, httpCache, blobOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve the source: %w", err)
 	}
@@ -371,6 +379,29 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 	return &blobRef{cachedB.(remote.Blob), done}, nil
 }
 
+// tocLocator returns the maximum footer size among the decompressors and the
+// TOCLocator which parses the footer using any of the decompressors.
+func tocLocator(decompressors ...estargz.Decompressor) (int64, remote.TOCLocator) {
+	var maxSize int64
+	for _, d := range decompressors {
+		if s := d.FooterSize(); s > maxSize {
+			maxSize = s
+		}
+	}
+	return maxSize, func(footer []byte) (int64, error) {
+		for _, d := range decompressors {
+			fSize := d.FooterSize()
+			if int64(len(footer)) < fSize {
+				continue
+			}
+			if _, tocOffset, _, err := d.ParseFooter(footer[int64(len(footer))-fSize:]); err == nil && tocOffset >= 0 {
+				return tocOffset, nil
+			}
+		}
+		return 0, fmt.Errorf("TOC not found in the footer")
+	}
+}
+
 func newLayer(
 	resolver *Resolver,
 	desc ocispec.Descriptor,
@@ -364,15 +364,63 @@ func (sb *sampleBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int
 	sb.readCalled = true
 	return sb.r.ReadAt(p, offset)
 }
+func (sb *sampleBlob) ReadFull(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	n, err := sb.ReadAt(p, offset, opts...)
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+func (sb *sampleBlob) FetchRegionAtomic(reg remote.Region, opts ...remote.Option) error {
+	return nil
+}
+func (sb *sampleBlob) ReleaseRegion(reg remote.Region) {}
+func (sb *sampleBlob) CachePlan(offset int64, size int64) ([]remote.Region, []remote.Region, error) {
+	return nil, []remote.Region{{Offset: offset, Size: size}}, nil
+}
+func (sb *sampleBlob) ReadTail(n int64, opts ...remote.Option) ([]byte, error) {
+	size := sb.r.Size()
+	if n > size {
+		n = size
+	}
+	p := make([]byte, n)
+	m, err := sb.ReadFull(p, size-n, opts...)
+	return p[:m], err
+}
+func (sb *sampleBlob) ReadAtWithDigest(p []byte, offset int64, alg digest.Algorithm, opts ...remote.Option) (int, digest.Digest, error) {
+	n, err := sb.ReadAt(p, offset, opts...)
+	return n, alg.FromBytes(p[:n]), err
+}
+func (sb *sampleBlob) Reader(offset int64, opts ...remote.Option) io.ReadCloser {
+	return io.NopCloser(io.NewSectionReader(sb.r, offset, sb.r.Size()-offset))
+}
+func (sb *sampleBlob) Prefetch(regions []remote.Region, opts ...remote.Option) <-chan error {
+	done := make(chan error)
+	close(done)
+	return done
+}
 func (sb *sampleBlob) Cache(offset int64, size int64, option ...remote.Option) error {
 	sb.calledPrefetchOffset = offset
 	sb.calledPrefetchSize = size
 	return nil
 }
+func (sb *sampleBlob) FetchedRegions() []remote.Region {
+	return []remote.Region{{Offset: 0, Size: sb.r.Size()}}
+}
+func (sb *sampleBlob) CachedRanges() []remote.Region {
+	return []remote.Region{{Offset: 0, Size: sb.r.Size()}}
+}
+func (sb *sampleBlob) SnapshotState() ([]byte, error)  { return nil, nil }
+func (sb *sampleBlob) RestoreState(state []byte) error { return nil }
 func (sb *sampleBlob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
-func (sb *sampleBlob) Close() error { return nil }
+func (sb *sampleBlob) BlobStats() remote.BlobStats                            { return remote.BlobStats{} }
+func (sb *sampleBlob) ResetStats()                                            {}
+func (sb *sampleBlob) InFlightFetches() []remote.FetchInfo                    { return nil }
+func (sb *sampleBlob) Verify(dgst digest.Digest, opts ...remote.Option) error { return nil }
+func (sb *sampleBlob) WarmConnections(ctx context.Context, n int) error       { return nil }
+func (sb *sampleBlob) Close() error                                           { return nil }
 
 const (
 	sampleMiddleOffset = sampleChunkSize / 2
@@ -761,11 +809,44 @@ func (tb *testBlobState) FetchedSize() int64 { return tb.fetchedSize }
 func (tb *testBlobState) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return 0, nil
 }
+func (tb *testBlobState) ReadFull(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	return 0, io.EOF
+}
+func (tb *testBlobState) FetchRegionAtomic(reg remote.Region, opts ...remote.Option) error {
+	return nil
+}
+func (tb *testBlobState) ReleaseRegion(reg remote.Region) {}
+func (tb *testBlobState) CachePlan(offset int64, size int64) ([]remote.Region, []remote.Region, error) {
+	return nil, nil, nil
+}
+func (tb *testBlobState) ReadTail(n int64, opts ...remote.Option) ([]byte, error) {
+	return nil, nil
+}
+func (tb *testBlobState) ReadAtWithDigest(p []byte, offset int64, alg digest.Algorithm, opts ...remote.Option) (int, digest.Digest, error) {
+	return 0, alg.FromBytes(nil), nil
+}
 func (tb *testBlobState) Cache(offset int64, size int64, opts ...remote.Option) error { return nil }
+func (tb *testBlobState) Reader(offset int64, opts ...remote.Option) io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(nil))
+}
+func (tb *testBlobState) Prefetch(regions []remote.Region, opts ...remote.Option) <-chan error {
+	done := make(chan error)
+	close(done)
+	return done
+}
+func (tb *testBlobState) FetchedRegions() []remote.Region { return nil }
+func (tb *testBlobState) CachedRanges() []remote.Region   { return nil }
+func (tb *testBlobState) SnapshotState() ([]byte, error)  { return nil, nil }
+func (tb *testBlobState) RestoreState(state []byte) error { return nil }
 func (tb *testBlobState) Refresh(ctx context.Context, host source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
-func (tb *testBlobState) Close() error { return nil }
+func (tb *testBlobState) BlobStats() remote.BlobStats                            { return remote.BlobStats{} }
+func (tb *testBlobState) ResetStats()                                            {}
+func (tb *testBlobState) InFlightFetches() []remote.FetchInfo                    { return nil }
+func (tb *testBlobState) Verify(dgst digest.Digest, opts ...remote.Option) error { return nil }
+func (tb *testBlobState) WarmConnections(ctx context.Context, n int) error       { return nil }
+func (tb *testBlobState) Close() error                                           { return nil }
 
 type check func(*testing.T, *node, cache.BlobCache, *calledReaderAt)
 
@@ -23,383 +23,3633 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/golang/groupcache/lru"
+	rhttp "github.com/hashicorp/go-retryablehttp"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 )
 
 var contentRangeRegexp = regexp.MustCompile(`bytes ([0-9]+)-([0-9]+)/([0-9]+|\\*)`)
 
+// defaultVerifyConcurrency is the default number of chunks read in parallel by Verify.
+const defaultVerifyConcurrency = 4
+
+// defaultPrefetchConcurrency is the default number of requests issued in parallel
+// by Prefetch.
+const defaultPrefetchConcurrency = 2
+
+// defaultMaxExtraParts is the default number of the parts of a multipart response
+// allowed beyond the number of the requested chunks (see WithMaxExtraParts).
+const defaultMaxExtraParts = 4
+
 type Blob interface {
 	Check() error
 	Size() int64
 	FetchedSize() int64
+	FetchedRegions() []Region
 	ReadAt(p []byte, offset int64, opts ...Option) (int, error)
+	ReadFull(p []byte, offset int64, opts ...Option) (int, error)
+	ReadTail(n int64, opts ...Option) ([]byte, error)
+	ReadAtWithDigest(p []byte, offset int64, alg digest.Algorithm, opts ...Option) (int, digest.Digest, error)
+	Reader(offset int64, opts ...Option) io.ReadCloser
+	Prefetch(regions []Region, opts ...Option) <-chan error
 	Cache(offset int64, size int64, opts ...Option) error
+	FetchRegionAtomic(reg Region, opts ...Option) error
+	ReleaseRegion(reg Region)
+	CachedRanges() []Region
+	CachePlan(offset int64, size int64) (toFetch []Region, cached []Region, err error)
+	SnapshotState() ([]byte, error)
+	RestoreState(state []byte) error
 	Refresh(ctx context.Context, host source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
+	BlobStats() BlobStats
+	ResetStats()
+	InFlightFetches() []FetchInfo
+	Verify(dgst digest.Digest, opts ...Option) error
+	WarmConnections(ctx context.Context, n int) error
 	Close() error
 }
 
-type blob struct {
-	fetcher   fetcher
-	fetcherMu sync.Mutex
+// BlobStats is statistics of a blob.
+type BlobStats struct {
+	// Prefetch is the statistics of the latest prefetch (Cache) operation.
+	Prefetch PrefetchStats
 
-	size              int64
-	chunkSize         int64
-	prefetchChunkSize int64
-	cache             cache.BlobCache
-	lastCheck         time.Time
-	lastCheckMu       sync.Mutex
-	checkInterval     time.Duration
-	fetchTimeout      time.Duration
+	// Created is the time when the blob was created.
+	Created time.Time
 
-	fetchedRegionSet    regionSet
-	fetchedRegionSetMu  sync.Mutex
-	fetchedRegionGroup  singleflight.Group
-	fetchedRegionCopyMu sync.Mutex
+	// FirstRead is the time when the first ReadAt succeeded. This is zero until
+	// then.
+	FirstRead time.Time
 
-	resolver *Resolver
+	// CacheBytes is the number of bytes served from the cache.
+	CacheBytes int64
 
-	closed   bool
-	closedMu sync.Mutex
-}
+	// FetchedBytes is the number of bytes fetched from the registry.
+	FetchedBytes int64
 
-func makeBlob(fetcher fetcher, size int64, chunkSize int64, prefetchChunkSize int64,
-	blobCache cache.BlobCache, lastCheck time.Time, checkInterval time.Duration,
-	r *Resolver, fetchTimeout time.Duration) *blob {
-	return &blob{
-		fetcher:           fetcher,
-		size:              size,
-		chunkSize:         chunkSize,
-		prefetchChunkSize: prefetchChunkSize,
-		cache:             blobCache,
-		lastCheck:         lastCheck,
-		checkInterval:     checkInterval,
-		resolver:          r,
-		fetchTimeout:      fetchTimeout,
-	}
+	// OverFetchedBytes is the number of bytes of the chunks fetched for ReadAt
+	// beyond the requested ranges. They are cached but not read (yet). This is
+	// useful for tuning the chunk size.
+	OverFetchedBytes int64
+
+	// RoundTrips is the number of fetches from the registry.
+	RoundTrips int64
+
+	// CacheHits is the number of chunks read from the cache.
+	CacheHits int64
+
+	// CacheMisses is the number of chunks missed in the cache.
+	CacheMisses int64
+
+	// CacheEntries is the number of entries the blob added to the cache. This
+	// isn't reset by ResetStats.
+	CacheEntries int64
+
+	// CommitFailures is the number of fetched chunks failed to be committed to
+	// the cache.
+	CommitFailures int64
+
+	// LeaderFetches is the number of fetches of the regions issued to the
+	// registry, which identical concurrent fetches can share.
+	LeaderFetches int64
+
+	// SharedFetches is the number of fetches of the regions which shared the
+	// identical fetch issued by another read instead of issuing their own.
+	SharedFetches int64
 }
 
-func (b *blob) Close() error {
-	b.closedMu.Lock()
-	defer b.closedMu.Unlock()
-	if b.closed {
-		return nil
-	}
-	b.closed = true
-	return b.cache.Close()
+// ReadTiming is the breakdown of the time taken by a ReadAt (see
+// WithReadTimingFunc). The time not covered by the components is spent on other
+// work, e.g. waiting for the fetch shared with another read.
+type ReadTiming struct {
+	// CacheLookup is the time spent reading the chunks from the cache.
+	CacheLookup time.Duration
+
+	// Fetch is the time spent waiting for the responses of the registry.
+	Fetch time.Duration
+
+	// Copy is the time spent copying the fetched contents to the buffer,
+	// including reading the response bodies.
+	Copy time.Duration
+
+	// Commit is the time spent adding the fetched chunks to the cache.
+	Commit time.Duration
+
+	// Total is the time taken by the whole ReadAt.
+	Total time.Duration
 }
 
-func (b *blob) isClosed() bool {
-	b.closedMu.Lock()
-	closed := b.closed
-	b.closedMu.Unlock()
-	return closed
+type readPhase int
+
+const (
+	phaseCacheLookup readPhase = iota
+	phaseFetch
+	phaseCopy
+	phaseCommit
+	numReadPhases
+)
+
+// readTimer accumulates the time of each phase of a ReadAt. A nil readTimer
+// records nothing.
+type readTimer struct {
+	start time.Time
+	d     [numReadPhases]int64 // nanoseconds; accessed atomically
 }
 
-func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
-	if b.isClosed() {
-		return fmt.Errorf("blob is already closed")
+func (t *readTimer) add(p readPhase, d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.d[p], int64(d))
 	}
+}
 
-	// refresh the fetcher
-	f, newSize, err := b.resolver.resolveFetcher(ctx, hosts, refspec, desc)
-	if err != nil {
-		return err
+func (t *readTimer) timing() ReadTiming {
+	return ReadTiming{
+		CacheLookup: time.Duration(atomic.LoadInt64(&t.d[phaseCacheLookup])),
+		Fetch:       time.Duration(atomic.LoadInt64(&t.d[phaseFetch])),
+		Copy:        time.Duration(atomic.LoadInt64(&t.d[phaseCopy])),
+		Commit:      time.Duration(atomic.LoadInt64(&t.d[phaseCommit])),
+		Total:       time.Since(t.start),
 	}
-	if newSize != b.size {
-		return fmt.Errorf("Invalid size of new blob %d; want %d", newSize, b.size)
+}
+
+// TimeToFirstRead returns how long it took from the creation of the blob to the
+// first successful ReadAt. This is zero until the first read succeeds.
+func (s BlobStats) TimeToFirstRead() time.Duration {
+	if s.FirstRead.IsZero() {
+		return 0
 	}
+	return s.FirstRead.Sub(s.Created)
+}
 
-	// update the blob's fetcher with new one
-	b.fetcherMu.Lock()
-	b.fetcher = f
-	b.fetcherMu.Unlock()
-	b.lastCheckMu.Lock()
-	b.lastCheck = time.Now()
-	b.lastCheckMu.Unlock()
+// FetchInfo is information of a region being fetched from the registry.
+type FetchInfo struct {
+	// Offset is the offset of the region in the blob.
+	Offset int64
 
-	return nil
+	// Size is the size of the region.
+	Size int64
+
+	// Start is the time when the fetch started.
+	Start time.Time
 }
 
-func (b *blob) Check() error {
-	if b.isClosed() {
-		return fmt.Errorf("blob is already closed")
-	}
+// PrefetchStats is statistics of a prefetch (Cache) operation. Overlapping Cache
+// calls are counted as one prefetch, which starts with the first call and ends
+// with the last one; the sizes and the chunks of the calls are summed.
+type PrefetchStats struct {
+	// Start is the time when the prefetch started.
+	Start time.Time
 
-	now := time.Now()
-	b.lastCheckMu.Lock()
-	lastCheck := b.lastCheck
-	b.lastCheckMu.Unlock()
-	if now.Sub(lastCheck) < b.checkInterval {
-		// do nothing if not expired
-		return nil
+	// End is the time when the prefetch finished. This is zero while the
+	// prefetch is in progress.
+	End time.Time
+
+	// Bytes is the size of the range requested to be prefetched.
+	Bytes int64
+
+	// RegionsCompleted is the number of chunks available in the cache.
+	RegionsCompleted int
+
+	// RegionsTotal is the number of chunks requested to be prefetched.
+	RegionsTotal int
+}
+
+// Duration returns how long the prefetch took. This is zero while the prefetch
+// is in progress.
+func (s PrefetchStats) Duration() time.Duration {
+	if s.End.IsZero() {
+		return 0
 	}
-	b.fetcherMu.Lock()
-	fr := b.fetcher
-	b.fetcherMu.Unlock()
-	err := fr.check()
-	if err == nil {
-		// update lastCheck only if check succeeded.
-		// on failure, we should check this layer next time again.
-		b.lastCheckMu.Lock()
-		b.lastCheck = now
-		b.lastCheckMu.Unlock()
+	return s.End.Sub(s.Start)
+}
+
+// Coverage returns the fraction of the chunks completed.
+func (s PrefetchStats) Coverage() float64 {
+	if s.RegionsTotal == 0 {
+		return 0
 	}
+	return float64(s.RegionsCompleted) / float64(s.RegionsTotal)
+}
 
-	return err
+// ChunkBoundaryProvider provides the layout of chunks in a blob. This allows
+// caching the blob aligned to the actual chunk boundaries (e.g. chunks recorded
+// in the eStargz TOC) instead of the uniform chunkSize.
+type ChunkBoundaryProvider interface {
+	// ChunkBoundary returns the beginning and the end (inclusive) offsets of
+	// the chunk which contains the specified offset.
+	ChunkBoundary(offset int64) (begin, end int64)
 }
 
-func (b *blob) Size() int64 {
-	return b.size
+// ChunkDigestProvider provides the digests of the contents of chunks. Chunks with
+// the same digest have identical contents (e.g. shared chunks in deduplicated
+// layers).
+type ChunkDigestProvider interface {
+	// ChunkDigest returns the digest of the contents of the chunk which begins
+	// at the specified offset. ok is false if the digest is unknown.
+	ChunkDigest(offset int64) (dgst digest.Digest, ok bool)
 }
 
-func (b *blob) FetchedSize() int64 {
-	b.fetchedRegionSetMu.Lock()
-	sz := b.fetchedRegionSet.totalSize()
-	b.fetchedRegionSetMu.Unlock()
-	return sz
+// CacheIDRewriter returns the ID which the chunk identified by id was cached with
+// in the legacy cache scheme. ok is false if no legacy ID is available.
+type CacheIDRewriter func(id string) (legacyID string, ok bool)
+
+// EvictionNotifier is implemented by caches which can report evicted contents.
+// If the cache of the blob implements this, prefetch (Cache) backs off when the
+// contents it added are evicted as fast as it adds them.
+type EvictionNotifier interface {
+	// NotifyEvicted registers the callback invoked with the key of every
+	// content evicted from the cache.
+	NotifyEvicted(func(key string))
 }
 
-func makeSyncKey(allData map[region]io.Writer) string {
-	keys := make([]string, len(allData))
-	keysIndex := 0
-	for key := range allData {
-		keys[keysIndex] = fmt.Sprintf("[%d,%d]", key.b, key.e)
-		keysIndex++
-	}
-	sort.Strings(keys)
-	return strings.Join(keys, ",")
+// ResumableCache is implemented by caches which keep the uncommitted contents of
+// the entries across the restart of the process (e.g. on disk). If the cache of
+// the blob implements this and doesn't pack the entries (see WithMaxCacheEntries),
+// prefetch (Cache) fetches only the missing tails of the chunks written
+// partially before the restart.
+type ResumableCache interface {
+	// PartialSize returns the number of bytes written to the uncommitted
+	// contents of the key. Zero means no uncommitted contents.
+	PartialSize(key string) int64
+
+	// Resume returns the writer appending to the uncommitted contents of the
+	// key. Closing the writer without Commit or Abort keeps the contents for
+	// the following Resume.
+	Resume(key string, opts ...cache.Option) (cache.Writer, error)
 }
 
-func (b *blob) cacheAt(offset int64, size int64, fr fetcher, cacheOpts *options) error {
-	fetchReg := region{floor(offset, b.chunkSize), ceil(offset+size-1, b.chunkSize) - 1}
-	discard := make(map[region]io.Writer)
+// ErrEvictionPressure is returned by Cache when it stops prefetching because the
+// cache evicts the prefetched contents as fast as they are added.
+var ErrEvictionPressure = errors.New("prefetched contents are being evicted")
 
-	err := b.walkChunks(fetchReg, func(reg region) error {
-		if r, err := b.cache.Get(fr.genID(reg), cacheOpts.cacheOpts...); err == nil {
-			return r.Close() // nop if the cache hits
-		}
-		discard[reg] = io.Discard
-		return nil
-	})
-	if err != nil {
-		return err
-	}
+// ErrBlobClosed is returned when the blob is already closed.
+var ErrBlobClosed = errors.New("blob is already closed")
 
-	return b.fetchRange(discard, cacheOpts)
+// IncompleteCacheReadError is returned when the cache returns fewer bytes of a
+// chunk than its size, which indicates the corruption of the cache.
+type IncompleteCacheReadError struct {
+	// ID is the key of the chunk in the cache.
+	ID string
+
+	// Region is the region of the blob read from the chunk.
+	Region Region
+
+	// Read is the number of bytes read from the cache.
+	Read int64
 }
 
-func (b *blob) Cache(offset int64, size int64, opts ...Option) error {
-	if b.isClosed() {
-		return fmt.Errorf("blob is already closed")
-	}
+func (e *IncompleteCacheReadError) Error() string {
+	return fmt.Sprintf("incomplete read of %d-%d from the cache %q: %d bytes; want %d",
+		e.Region.Offset, e.Region.Offset+e.Region.Size-1, e.ID, e.Read, e.Region.Size)
+}
 
-	var cacheOpts options
-	for _, o := range opts {
-		o(&cacheOpts)
+func (e *IncompleteCacheReadError) Unwrap() error { return io.ErrUnexpectedEOF }
+
+// ChunkDigestMismatchError is returned when the contents of a chunk fetched from
+// the registry don't match the digest expected by WithChunkVerification. The
+// chunk isn't added to the cache.
+type ChunkDigestMismatchError struct {
+	// Region is the region of the chunk in the blob.
+	Region Region
+
+	// Expected is the digest of the chunk provided by the ChunkDigestProvider.
+	Expected digest.Digest
+
+	// Actual is the digest of the fetched contents.
+	Actual digest.Digest
+}
+
+func (e *ChunkDigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch of chunk %d-%d: %s; want %s",
+		e.Region.Offset, e.Region.Offset+e.Region.Size-1, e.Actual, e.Expected)
+}
+
+// TooManyPartsError is returned when the registry returns a multipart response
+// with more parts than allowed for the requested regions (see WithMaxExtraParts).
+type TooManyPartsError struct {
+	// Requested is the number of the requested chunks.
+	Requested int
+
+	// Limit is the max number of the parts allowed.
+	Limit int
+}
+
+func (e *TooManyPartsError) Error() string {
+	return fmt.Sprintf("too many parts in the response: more than %d for %d requested chunks", e.Limit, e.Requested)
+}
+
+// ErrNoFetcher is returned when the blob doesn't have the fetcher, e.g. when the
+// blob is misconstructed.
+var ErrNoFetcher = errors.New("blob has no fetcher")
+
+// evictionPressureMinChunks is the minimum number of evicted prefetched chunks
+// to detect the eviction pressure.
+const evictionPressureMinChunks = 2
+
+// BlobOption is an option to configure a blob.
+type BlobOption func(*blob)
+
+// WithDigestCoalescing makes reads of chunks with identical contents, identified
+// by the digests from the specified provider, share one fetch even if the chunks
+// are at different offsets. Only the chunks whose digests are already being
+// fetched wait for the fetch; others are fetched together as usual.
+func WithDigestCoalescing(p ChunkDigestProvider) BlobOption {
+	return func(b *blob) {
+		b.chunkDigests = p
 	}
+}
 
-	b.fetcherMu.Lock()
-	fr := b.fetcher
-	b.fetcherMu.Unlock()
+// WithChunkVerification makes the blob verify the chunks fetched from the
+// registry against the digests from the specified provider (e.g. the chunk
+// digests in the TOC of eStargz) before adding them to the cache. Chunks whose
+// digests are unknown to the provider aren't verified. A mismatched chunk fails
+// the read with ChunkDigestMismatchError.
+func WithChunkVerification(p ChunkDigestProvider) BlobOption {
+	return func(b *blob) {
+		b.chunkVerifier = p
+	}
+}
 
-	if b.prefetchChunkSize <= b.chunkSize {
-		return b.cacheAt(offset, size, fr, &cacheOpts)
+// WithChunkBoundaryProvider makes the blob split its contents into chunks based
+// on the specified provider. The uniform chunkSize is used for offsets the
+// provider doesn't return valid boundaries.
+func WithChunkBoundaryProvider(p ChunkBoundaryProvider) BlobOption {
+	return func(b *blob) {
+		b.chunkBoundary = p
 	}
+}
 
-	eg, _ := errgroup.WithContext(context.Background())
+// ChunkEntry is a chunk recorded in the TOC.
+type ChunkEntry struct {
+	// Begin and End are the beginning and the end (inclusive) offsets of the
+	// chunk in the blob.
+	Begin, End int64
 
-	fetchSize := b.chunkSize * (b.prefetchChunkSize / b.chunkSize)
+	// Digest is the digest of the chunk, if any.
+	Digest string
+}
 
-	end := offset + size
-	for i := offset; i < end; i += fetchSize {
-		i, l := i, fetchSize
-		if i+l > end {
-			l = end - i
-		}
-		eg.Go(func() error {
-			return b.cacheAt(i, l, fr, &cacheOpts)
-		})
+// ChunkSectionLoader loads the chunks beginning in the specified section of the
+// blob. The section i is the range [i*sectionSize, (i+1)*sectionSize) of the blob.
+// The returned chunks must be sorted by the offset.
+type ChunkSectionLoader func(section int64) ([]ChunkEntry, error)
+
+// LazyChunkBoundaries is a ChunkBoundaryProvider which loads the chunks recorded
+// in the TOC section by section on demand, instead of loading the entire TOC at
+// once. The number of loaded sections kept in memory is bounded.
+type LazyChunkBoundaries struct {
+	sectionSize int64
+	load        ChunkSectionLoader
+
+	sections   *lru.Cache
+	sectionsMu sync.Mutex
+}
+
+// NewLazyChunkBoundaries returns LazyChunkBoundaries loading sections of
+// sectionSize bytes with load. At most maxSections sections are kept in memory
+// (zero means no limit).
+func NewLazyChunkBoundaries(sectionSize int64, maxSections int, load ChunkSectionLoader) *LazyChunkBoundaries {
+	return &LazyChunkBoundaries{
+		sectionSize: sectionSize,
+		load:        load,
+		sections:    lru.New(maxSections),
 	}
+}
 
-	return eg.Wait()
+// ChunkBoundary implements ChunkBoundaryProvider. If the chunk isn't available,
+// this returns an invalid boundary (end < begin).
+func (l *LazyChunkBoundaries) ChunkBoundary(offset int64) (begin, end int64) {
+	e, ok := l.ChunkEntry(offset)
+	if !ok {
+		return 0, -1
+	}
+	return e.Begin, e.End
 }
 
-// ReadAt reads remote chunks from specified offset for the buffer size.
-// It tries to fetch as many chunks as possible from local cache.
-// We can configure this function with options.
-func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
-	if b.isClosed() {
-		return 0, fmt.Errorf("blob is already closed")
+// ChunkEntry returns the chunk which contains the specified offset.
+func (l *LazyChunkBoundaries) ChunkEntry(offset int64) (ChunkEntry, bool) {
+	if offset < 0 || l.sectionSize <= 0 {
+		return ChunkEntry{}, false
 	}
+	// The chunk begins in the section of the offset or in the nearest previous
+	// section having any chunks.
+	for section := offset / l.sectionSize; section >= 0; section-- {
+		entries, err := l.section(section)
+		if err != nil {
+			return ChunkEntry{}, false
+		}
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Begin > offset })
+		if i == 0 {
+			continue // no chunk begins before the offset in this section
+		}
+		if e := entries[i-1]; offset <= e.End {
+			return e, true
+		}
+		return ChunkEntry{}, false
+	}
+	return ChunkEntry{}, false
+}
 
-	if len(p) == 0 || offset > b.size {
-		return 0, nil
+func (l *LazyChunkBoundaries) section(section int64) ([]ChunkEntry, error) {
+	l.sectionsMu.Lock()
+	defer l.sectionsMu.Unlock()
+	if entries, ok := l.sections.Get(section); ok {
+		return entries.([]ChunkEntry), nil
+	}
+	entries, err := l.load(section)
+	if err != nil {
+		return nil, err
 	}
+	l.sections.Add(section, entries)
+	return entries, nil
+}
 
-	// Make the buffer chunk aligned
-	allRegion := region{floor(offset, b.chunkSize), ceil(offset+int64(len(p))-1, b.chunkSize) - 1}
-	allData := make(map[region]io.Writer)
+// WithCacheIDRewriter makes the blob lazily migrate chunks cached with the legacy
+// IDs returned by the specified rewriter, on cache misses with the current IDs.
+func WithCacheIDRewriter(f CacheIDRewriter) BlobOption {
+	return func(b *blob) {
+		b.cacheIDRewriter = f
+	}
+}
 
-	var readAtOpts options
-	for _, o := range opts {
-		o(&readAtOpts)
+// WithOnFullyCached specifies the callback invoked once when all chunks of the
+// blob have been fetched and cached.
+func WithOnFullyCached(f func()) BlobOption {
+	return func(b *blob) {
+		b.onFullyCached = f
 	}
+}
 
-	// Fetcher can be suddenly updated so we take and use the snapshot of it for
-	// consistency.
-	b.fetcherMu.Lock()
-	fr := b.fetcher
-	b.fetcherMu.Unlock()
+// WithTrailingRegion specifies the offset where the trailing region of the blob
+// (e.g. the last gzip member and the footer of eStargz) begins. When any chunk
+// overlapping with the trailing region is fetched, the whole trailing region is
+// fetched together.
+func WithTrailingRegion(offset int64) BlobOption {
+	return func(b *blob) {
+		b.trailingRegionOffset = offset
+	}
+}
 
-	b.walkChunks(allRegion, func(chunk region) error {
-		var (
-			base         = positive(chunk.b - offset)
-			lowerUnread  = positive(offset - chunk.b)
-			upperUnread  = positive(chunk.e + 1 - (offset + int64(len(p))))
-			expectedSize = chunk.size() - upperUnread - lowerUnread
-		)
+// WithFallbackCaches specifies the caches consulted in order when the contents
+// are missed in the primary cache of the blob. These caches are only read; fetched
+// contents are always added to the primary cache. These caches aren't closed by
+// the blob.
+func WithFallbackCaches(caches ...cache.BlobCache) BlobOption {
+	return func(b *blob) {
+		b.fallbackCaches = caches
+	}
+}
 
-		// Check if the content exists in the cache
-		r, err := b.cache.Get(fr.genID(chunk), readAtOpts.cacheOpts...)
-		if err == nil {
-			defer r.Close()
-			n, err := r.ReadAt(p[base:base+expectedSize], lowerUnread)
-			if (err == nil || err == io.EOF) && int64(n) == expectedSize {
-				return nil
-			}
-		}
+// WithAdaptiveCheckInterval makes Check adapt the interval of the checks to the
+// health of the registry. Each successful check doubles the interval up to
+// maxInterval and each failed check halves it down to minInterval.
+func WithAdaptiveCheckInterval(minInterval, maxInterval time.Duration) BlobOption {
+	return func(b *blob) {
+		b.adaptiveCheck = true
+		b.minCheckInterval, b.maxCheckInterval = minInterval, maxInterval
+	}
+}
 
-		// We missed cache. Take it from remote registry.
-		// We get the whole chunk here and add it to the cache so that following
-		// reads against neighboring chunks can take the data without making HTTP requests.
-		allData[chunk] = newBytesWriter(p[base:base+expectedSize], lowerUnread)
-		return nil
-	})
+// WithIgnoreCommitErrors makes reads succeed even if the fetched chunks fail to
+// be committed to the cache after they are written to the caller. The failures
+// are logged and counted in BlobStats.CommitFailures and the chunks are fetched
+// again next time. Cache, which doesn't return the contents, still fails.
+func WithIgnoreCommitErrors() BlobOption {
+	return func(b *blob) {
+		b.ignoreCommitErrors = true
+	}
+}
 
-	// Read required data
-	if err := b.fetchRange(allData, &readAtOpts); err != nil {
-		return 0, err
+// WithFetchPinning makes the chunks fetched by a read stay in memory until all
+// the reads sharing the fetch copy them. Without this, the reads waiting for the
+// fetch of another read copy the chunks from the cache and fetch them again if
+// the cache under pressure has already evicted them.
+func WithFetchPinning() BlobOption {
+	return func(b *blob) {
+		b.fetchPinning = true
 	}
+}
 
-	// Adjust the buffer size according to the blob size
-	if remain := b.size - offset; int64(len(p)) >= remain {
-		if remain < 0 {
-			remain = 0
+// WithAutoComplete makes the blob fetch all the remaining chunks in the background
+// once the reads have fetched more than the specified fraction (0 < threshold <= 1)
+// of the blob. When most of the blob is read on demand, this is cheaper than
+// continuing to fetch the rest piece by piece. The rest is fetched by requests of
+// prefetchChunkSize (or the chunk size if it's smaller) in parallel up to the
+// limit of WithPrefetchConcurrency. Thresholds out of the range are ignored.
+func WithAutoComplete(threshold float64) BlobOption {
+	return func(b *blob) {
+		if threshold > 0 && threshold <= 1 {
+			b.autoCompleteThreshold = threshold
 		}
-		p = p[:remain]
 	}
+}
 
-	return len(p), nil
+// RateLimiter limits the bandwidth of fetching the blob. *rate.Limiter of
+// golang.org/x/time/rate satisfies this.
+type RateLimiter interface {
+	// WaitN blocks until n bytes are allowed or ctx is done.
+	WaitN(ctx context.Context, n int) error
+
+	// Burst returns the maximum number of bytes allowed by a WaitN call.
+	Burst() int
 }
 
-// fetchRegions fetches all specified chunks from remote blob and puts it in the local cache.
-// It must be called from within fetchRange and need to ensure that it is inside the singleflight `Do` operation.
-func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]bool, opts *options) error {
-	if len(allData) == 0 {
-		return nil
+// WithRateLimiters limits the bandwidth of the fetches of the blob. The fetches
+// for ReadAt are limited by foreground and the ones for Cache and Prefetch are
+// limited by background so that the background traffic doesn't starve the
+// reads. nil doesn't limit the fetches. WithReadLimit overrides them per call.
+func WithRateLimiters(foreground, background RateLimiter) BlobOption {
+	return func(b *blob) {
+		b.foregroundLimiter = foreground
+		b.backgroundLimiter = background
 	}
+}
 
-	// Fetcher can be suddenly updated so we take and use the snapshot of it for
-	// consistency.
-	b.fetcherMu.Lock()
-	fr := b.fetcher
-	b.fetcherMu.Unlock()
+// SyncKeyFunc returns the key of the fetch of the regions, which are sorted by
+// the offset. Concurrent fetches with the same key are coalesced into one.
+type SyncKeyFunc func(regions []Region) string
 
-	// request missed regions
-	var req []region
-	for reg := range allData {
-		req = append(req, reg)
-		fetched[reg] = false
+// WithSyncKeyFunc makes the blob coalesce the concurrent fetches by the keys
+// returned by f instead of the set of the regions (e.g. to coalesce by the
+// content digests). The callers joining a fetch of other regions read their
+// regions from the cache and fetch them only if they aren't there, so f doesn't
+// need to return the distinct keys for the distinct sets of the regions. The
+// default key is used if f returns an empty string.
+func WithSyncKeyFunc(f SyncKeyFunc) BlobOption {
+	return func(b *blob) {
+		b.syncKeyFunc = f
 	}
+}
 
-	fetchCtx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
-	defer cancel()
-	if opts.ctx != nil {
-		fetchCtx = opts.ctx
+// WithMaxConcurrentFetches limits the number of fetches from the registry in
+// flight at once on the blob, across ReadAt and Cache. This is useful for
+// registries which rate-limit requests. Fetches waiting for the limit give up
+// when the context specified by WithContext is done.
+func WithMaxConcurrentFetches(n int) BlobOption {
+	return func(b *blob) {
+		if n > 0 {
+			b.fetchSem = semaphore.NewWeighted(int64(n))
+		}
 	}
-	mr, err := fr.fetch(fetchCtx, req, true)
+}
 
-	if err != nil {
-		return err
+// WithMaterializedLayer makes the blob serve reads directly from the file at the
+// specified path, bypassing the cache and the registry, once the whole layer is
+// materialized there (e.g. fully prefetched to a local file). The file must hold
+// the contents of the blob at the same offsets. Until the file has the full size
+// of the blob, reads are served as usual.
+func WithMaterializedLayer(path string) BlobOption {
+	return func(b *blob) {
+		b.materializedPath = path
 	}
-	defer mr.Close()
+}
+
+// TOCLocator parses the footer of the blob and returns the offset of the TOC.
+type TOCLocator func(footer []byte) (tocOffset int64, err error)
+
+// WithTOCPrefetch makes a read of the footer, which is the last footerSize bytes
+// of the blob, also fetch the TOC located by the locator into the cache, because
+// the TOC is read after the footer. The TOC is the region between the TOC
+// offset and the footer.
+func WithTOCPrefetch(footerSize int64, locate TOCLocator) BlobOption {
+	return func(b *blob) {
+		b.tocFooterSize = footerSize
+		b.tocLocator = locate
+	}
+}
+
+// WithRefreshCooldown makes reads forced to refresh the blob by WithForceRefresh
+// skip the refresh if the blob was refreshed within the specified duration.
+func WithRefreshCooldown(d time.Duration) BlobOption {
+	return func(b *blob) {
+		b.refreshCooldown = d
+	}
+}
+
+// withSource records the source of the blob, which is used for re-resolving it.
+func withSource(hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) BlobOption {
+	return func(b *blob) {
+		b.hosts = hosts
+		b.refspec = refspec
+		b.desc = desc
+	}
+}
+
+// WithCoalesceGap makes a fetch fill the gaps of at most the specified number of
+// bytes between the requested regions so that they're fetched as one contiguous
+// range. The chunks in the gaps are cached too. This trades a little extra
+// bandwidth for fewer ranges on sparse reads.
+func WithCoalesceGap(n int64) BlobOption {
+	return func(b *blob) {
+		b.coalesceGap = n
+	}
+}
+
+// WithMaxCacheEntries caps the number of cache entries added by the blob, for
+// caches struggling with many small entries. Once three quarters of the cap are
+// used, the following chunks are packed into larger entries sized so that the
+// rest of the blob fits in the cap. Each pack records the locations of its
+// chunks, so the packs are found again when the blob is recreated on the same
+// cache. A pack being filled is held in memory until it's full or the blob is
+// closed. Zero (the default) disables the cap.
+func WithMaxCacheEntries(n int) BlobOption {
+	return func(b *blob) {
+		b.maxCacheEntries = n
+	}
+}
+
+// WithPrefetchConcurrency limits the number of requests issued in parallel by
+// Prefetch. The default is 2. This pool is separated from ReadAt so prefetches
+// don't take over the reads.
+func WithPrefetchConcurrency(n int) BlobOption {
+	return func(b *blob) {
+		if n > 0 {
+			b.prefetchSem = semaphore.NewWeighted(int64(n))
+		}
+	}
+}
+
+// WithAsyncCacheFill makes the chunks fetched by reads written to the cache in
+// the background so that the reads return as soon as the contents are copied
+// to the caller. Up to n chunks are written at once. Chunks beyond that are
+// written synchronously, which throttles the reads to the speed of the cache.
+// Cache always writes the chunks synchronously.
+func WithAsyncCacheFill(n int) BlobOption {
+	return func(b *blob) {
+		if n > 0 {
+			b.cacheFillSem = semaphore.NewWeighted(int64(n))
+		}
+	}
+}
+
+// WithMaxExtraParts limits the number of the parts of a multipart response to
+// the number of the requested chunks plus n. A response with more parts fails
+// with TooManyPartsError, which protects the reads from a broken registry sending
+// an unbounded number of parts. The default is 4.
+func WithMaxExtraParts(n int) BlobOption {
+	return func(b *blob) {
+		if n >= 0 {
+			b.maxExtraParts = n
+		}
+	}
+}
+
+// withTracer makes the blob emit the spans of its operations with t. nil
+// disables the spans.
+func withTracer(t trace.Tracer) BlobOption {
+	return func(b *blob) {
+		b.tracer = t
+	}
+}
+
+// withFetchRetries makes the fetches failed with a server error or a network
+// error retried up to maxAttempts in total, with the exponential backoff from
+// baseDelay with full jitter.
+func withFetchRetries(maxAttempts int, baseDelay time.Duration) BlobOption {
+	return func(b *blob) {
+		b.fetchMaxAttempts = maxAttempts
+		b.fetchRetryBaseDelay = baseDelay
+	}
+}
+
+type blob struct {
+	fetcher   fetcher
+	fetcherMu sync.Mutex
+
+	size                 int64 // accessed atomically; see currentSize
+	chunkSize            int64
+	chunkBoundary        ChunkBoundaryProvider
+	trailingRegionOffset int64
+	tocFooterSize        int64
+	tocLocator           TOCLocator
+	prefetchChunkSize    int64
+	cache                cache.BlobCache
+	fallbackCaches       []cache.BlobCache
+	materializedPath     string
+	materialized         *os.File
+	materializedMu       sync.Mutex
+	cacheIDRewriter      CacheIDRewriter
+	ignoreCommitErrors   bool
+	fetchPinning         bool
+	lastCheck            time.Time
+	lastCheckMu          sync.Mutex
+	checkInterval        time.Duration // guarded by lastCheckMu
+	adaptiveCheck        bool
+	minCheckInterval     time.Duration
+	maxCheckInterval     time.Duration
+	fetchTimeout         time.Duration
+
+	autoCompleteThreshold float64
+	autoCompleteStarted   int32 // accessed atomically
+
+	maxExtraParts int
+
+	fetchedRegionSet    regionSet
+	fetchedRegionSetMu  sync.Mutex
+	fullyCached         bool  // guarded by fetchedRegionSetMu
+	fetchedTotal        int64 // total size of fetchedRegionSet; accessed atomically
+	onFullyCached       func()
+	fetchedRegionGroup  singleflight.Group
+	syncKeyFunc         SyncKeyFunc // nil uses makeSyncKey
+	foregroundLimiter   RateLimiter // limits the fetches for ReadAt; nil if unlimited
+	backgroundLimiter   RateLimiter // limits the fetches for Cache and Prefetch; nil if unlimited
+	fetchedRegionCopyMu sync.Mutex
+	fetchSem            *semaphore.Weighted // limits the fetches in flight; nil if unlimited
+	fetchMaxAttempts    int                 // attempts of a fetch including retries; <= 1 disables retries
+	cacheFillSem        *semaphore.Weighted // limits the background cache writes; nil if synchronous
+	prefetchSem         *semaphore.Weighted // limits the requests issued by Prefetch
+	maxCacheEntries     int
+	coalesceGap         int64         // max bytes between regions fetched together; zero disables it
+	entries             *packingCache // packs the entries added to cache; nil unless maxCacheEntries > 0
+	cacheEntries        int64         // entries added to the cache unless packed; accessed atomically
+	fetchRetryBaseDelay time.Duration
+	fetchBackoff        rhttp.Backoff // delays between the retries of fetches; backoffStrategy if nil
+	chunkDigests        ChunkDigestProvider
+	chunkVerifier       ChunkDigestProvider
+	cacheAddGroup       singleflight.Group // coalesces concurrent cache writes by the ID
+	bufPool             *sync.Pool         // scratch buffers of copyN unless WithBufferPool is specified
+	tracer              trace.Tracer       // nil if the spans are disabled
+
+	// fetches of chunks in flight, keyed by the content digest (see WithDigestCoalescing)
+	digestFetches   map[digest.Digest]*digestFetch
+	digestFetchesMu sync.Mutex
+
+	// fetches in flight, keyed by the key of fetchedRegionGroup
+	inFlight   map[string]inFlightFetch
+	inFlightMu sync.Mutex
+
+	resolver *Resolver
+
+	// source of the blob used by WithForceRefresh; updated by Refresh
+	hosts           source.RegistryHosts
+	refspec         reference.Spec
+	desc            ocispec.Descriptor
+	lastRefresh     time.Time
+	refreshMu       sync.Mutex
+	refreshCooldown time.Duration
+	forceRefreshMu  sync.Mutex
+
+	prefetchStats    PrefetchStats
+	prefetchInFlight int // Cache calls in progress; guarded by prefetchStatsMu
+	prefetchStatsMu  sync.Mutex
+
+	// cumulative counters of BlobStats; accessed atomically
+	cacheBytes       int64
+	fetchedBytes     int64
+	overFetchedBytes int64
+	roundTrips       int64
+	cacheHits        int64
+	cacheMisses      int64
+	commitFailures   int64
+	leaderFetches    int64
+	sharedFetches    int64
+
+	created     time.Time
+	firstRead   time.Time
+	firstReadMu sync.Mutex
+
+	// trackers of the Cache calls in progress
+	prefetchTrackers map[*prefetchTracker]struct{}
+	prefetchedMu     sync.Mutex
+
+	// chunks pinned by FetchRegionAtomic
+	pinned   map[region]*pinnedChunk
+	pinnedMu sync.Mutex
+
+	// chunks pinned by the in-flight fetches (see WithFetchPinning)
+	fetchPins   map[string]*fetchPin
+	fetchPinsMu sync.Mutex
+
+	activeReads   int
+	activeReadsMu sync.Mutex
+	readsIdle     chan struct{} // closed when activeReads becomes zero
+
+	closed        bool
+	closedMu      sync.Mutex
+	activeFetches sync.WaitGroup // Add is guarded by closedMu
+
+	// context of the fetches started by the blob in the background; canceled by Close
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+}
+
+func makeBlob(fetcher fetcher, size int64, chunkSize int64, prefetchChunkSize int64,
+	blobCache cache.BlobCache, lastCheck time.Time, checkInterval time.Duration,
+	r *Resolver, fetchTimeout time.Duration, opts ...BlobOption) *blob {
+	b := &blob{
+		fetcher:           fetcher,
+		size:              size,
+		chunkSize:         chunkSize,
+		prefetchChunkSize: prefetchChunkSize,
+		cache:             blobCache,
+		lastCheck:         lastCheck,
+		checkInterval:     checkInterval,
+		resolver:          r,
+		fetchTimeout:      fetchTimeout,
+		created:           time.Now(),
+		prefetchSem:       semaphore.NewWeighted(defaultPrefetchConcurrency),
+		maxExtraParts:     defaultMaxExtraParts,
+	}
+	if chunkSize > 0 {
+		b.bufPool = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, chunkSize)
+				return &buf
+			},
+		}
+	}
+	b.bgCtx, b.bgCancel = context.WithCancel(context.Background())
+	for _, o := range opts {
+		o(b)
+	}
+	if n, ok := blobCache.(EvictionNotifier); ok {
+		n.NotifyEvicted(b.onEvicted)
+	}
+	if b.maxCacheEntries > 0 {
+		b.entries = newPackingCache(blobCache, b.maxCacheEntries, b.countChunks(),
+			b.fetcher.genID(region{0, b.currentSize() - 1}))
+		b.cache = b.entries
+	}
+	return b
+}
+
+// countChunks returns the number of chunks of the blob.
+func (b *blob) countChunks() (n int) {
+	size := b.currentSize()
+	if size <= 0 {
+		return 0
+	}
+	b.walkChunks(region{0, size - 1}, func(region) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// prefetchTracker tracks the chunks added to the cache by a Cache call and how
+// many of them are already evicted. The fields are guarded by prefetchedMu of
+// the blob.
+type prefetchTracker struct {
+	added   map[string]struct{}
+	evicted int
+}
+
+// startPrefetchTracking registers the tracker of a Cache call. It must be
+// unregistered with stopPrefetchTracking when the call returns.
+func (b *blob) startPrefetchTracking() *prefetchTracker {
+	t := &prefetchTracker{added: make(map[string]struct{})}
+	b.prefetchedMu.Lock()
+	if b.prefetchTrackers == nil {
+		b.prefetchTrackers = make(map[*prefetchTracker]struct{})
+	}
+	b.prefetchTrackers[t] = struct{}{}
+	b.prefetchedMu.Unlock()
+	return t
+}
+
+func (b *blob) stopPrefetchTracking(t *prefetchTracker) {
+	b.prefetchedMu.Lock()
+	delete(b.prefetchTrackers, t)
+	b.prefetchedMu.Unlock()
+}
+
+// trackPrefetched records that the chunk is added by the Cache call of t.
+func (b *blob) trackPrefetched(t *prefetchTracker, id string) {
+	if t == nil {
+		return
+	}
+	b.prefetchedMu.Lock()
+	t.added[id] = struct{}{}
+	b.prefetchedMu.Unlock()
+}
+
+// onEvicted records the eviction of the chunk added by the Cache calls in progress.
+func (b *blob) onEvicted(id string) {
+	b.prefetchedMu.Lock()
+	defer b.prefetchedMu.Unlock()
+	for t := range b.prefetchTrackers {
+		if _, ok := t.added[id]; ok {
+			delete(t.added, id)
+			t.evicted++
+		}
+	}
+}
+
+// evictionPressure returns true if at least half of the chunks added by the
+// Cache call of t are already evicted.
+func (b *blob) evictionPressure(t *prefetchTracker) bool {
+	if t == nil {
+		return false
+	}
+	b.prefetchedMu.Lock()
+	defer b.prefetchedMu.Unlock()
+	added := len(t.added) + t.evicted
+	return t.evicted >= evictionPressureMinChunks && t.evicted*2 >= added
+}
+
+func (b *blob) Close() error {
+	b.closedMu.Lock()
+	if b.closed {
+		b.closedMu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.closedMu.Unlock()
+
+	// Cancel the background fetches and wait for the fetches writing to the
+	// cache. New fetches are rejected.
+	if b.bgCancel != nil {
+		b.bgCancel()
+	}
+	b.activeFetches.Wait()
+
+	b.materializedMu.Lock()
+	if b.materialized != nil {
+		b.materialized.Close()
+	}
+	b.materializedMu.Unlock()
+	return b.cache.Close()
+}
+
+// acquireFetch registers a fetch writing to the cache so that Close waits for it.
+// This fails if the blob is closed. releaseFetch must be called when the fetch
+// finishes.
+func (b *blob) acquireFetch() error {
+	b.closedMu.Lock()
+	defer b.closedMu.Unlock()
+	if b.closed {
+		return ErrBlobClosed
+	}
+	b.activeFetches.Add(1)
+	return nil
+}
+
+func (b *blob) releaseFetch() {
+	b.activeFetches.Done()
+}
+
+// backgroundOptions returns the options of a fetch started by the blob in the
+// background, independently of the operation which triggered it. The fetch is
+// canceled by Close and times out after fetchTimeout.
+func (b *blob) backgroundOptions() *options {
+	ctx := b.bgCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &options{ctx: ctx, background: true, fetchTimeout: b.fetchTimeout}
+}
+
+// acquireFetchSlot waits for a slot of the fetches limited by
+// WithMaxConcurrentFetches. The returned function releases the slot and can be
+// called multiple times.
+func (b *blob) acquireFetchSlot(opts *options) (release func(), err error) {
+	if b.fetchSem == nil {
+		return func() {}, nil
+	}
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := b.fetchSem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() { once.Do(func() { b.fetchSem.Release(1) }) }, nil
+}
+
+// IsMaterialized returns true if the whole layer is materialized to the file
+// specified by WithMaterializedLayer.
+func (b *blob) IsMaterialized() bool {
+	return b.materializedFile() != nil
+}
+
+// materializedFile returns the file the whole layer is materialized to. This
+// returns nil if the layer isn't materialized.
+func (b *blob) materializedFile() *os.File {
+	if b.materializedPath == "" {
+		return nil
+	}
+	b.materializedMu.Lock()
+	defer b.materializedMu.Unlock()
+	if b.materialized != nil {
+		return b.materialized
+	}
+	if fi, err := os.Stat(b.materializedPath); err != nil || fi.Size() < b.currentSize() {
+		return nil
+	}
+	f, err := os.Open(b.materializedPath)
+	if err != nil {
+		return nil
+	}
+	b.materialized = f
+	return f
+}
+
+// getFetcher returns the snapshot of the fetcher. The fetcher can be suddenly
+// updated by Refresh so callers should use the snapshot for consistency.
+func (b *blob) getFetcher() (fetcher, error) {
+	b.fetcherMu.Lock()
+	defer b.fetcherMu.Unlock()
+	if b.fetcher == nil {
+		return nil, ErrNoFetcher
+	}
+	return b.fetcher, nil
+}
+
+// snapshotFetcher returns the fetcher used by the operation with opts. It's
+// snapshotted on the first call and reused by the following calls with opts so
+// that a Refresh landing in the middle of the operation doesn't change the
+// registry and the cache keys used by it.
+func (b *blob) snapshotFetcher(opts *options) (fetcher, error) {
+	if opts.fetcher != nil {
+		return opts.fetcher, nil
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return nil, err
+	}
+	opts.fetcher = fr
+	return fr, nil
+}
+
+func (b *blob) isClosed() bool {
+	b.closedMu.Lock()
+	closed := b.closed
+	b.closedMu.Unlock()
+	return closed
+}
+
+func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+
+	// refresh the fetcher
+	f, newSize, err := b.resolver.resolveFetcher(ctx, hosts, refspec, desc)
+	if err != nil {
+		return err
+	}
+	if size := b.currentSize(); newSize != size {
+		return fmt.Errorf("Invalid size of new blob %d; want %d", newSize, size)
+	}
+
+	// update the blob's fetcher with new one
+	b.fetcherMu.Lock()
+	b.fetcher = f
+	b.fetcherMu.Unlock()
+	now := time.Now()
+	b.lastCheckMu.Lock()
+	b.lastCheck = now
+	b.lastCheckMu.Unlock()
+	b.refreshMu.Lock()
+	b.hosts, b.refspec, b.desc = hosts, refspec, desc
+	b.lastRefresh = now
+	b.refreshMu.Unlock()
+
+	return nil
+}
+
+// forceRefresh refreshes the blob with the recorded source unless it was
+// refreshed within the cooldown specified by WithRefreshCooldown.
+func (b *blob) forceRefresh(opts *options) error {
+	// Serialize forced refreshes so that concurrent reads don't re-resolve
+	// the blob more than once within the cooldown.
+	b.forceRefreshMu.Lock()
+	defer b.forceRefreshMu.Unlock()
+
+	b.refreshMu.Lock()
+	hosts, refspec, desc := b.hosts, b.refspec, b.desc
+	lastRefresh := b.lastRefresh
+	b.refreshMu.Unlock()
+	if hosts == nil {
+		return fmt.Errorf("cannot refresh blob: source is unknown")
+	}
+	if b.refreshCooldown > 0 && time.Since(lastRefresh) < b.refreshCooldown {
+		return nil
+	}
+	ctx, cancel := b.fetchContext(opts)
+	defer cancel()
+	return b.Refresh(ctx, hosts, refspec, desc)
+}
+
+func (b *blob) Check() error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+
+	now := time.Now()
+	b.lastCheckMu.Lock()
+	lastCheck, checkInterval := b.lastCheck, b.checkInterval
+	b.lastCheckMu.Unlock()
+	if now.Sub(lastCheck) < checkInterval {
+		// do nothing if not expired
+		return nil
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return err
+	}
+	err = fr.check()
+	b.lastCheckMu.Lock()
+	if err == nil {
+		// update lastCheck only if check succeeded.
+		// on failure, we should check this layer next time again.
+		b.lastCheck = now
+	}
+	if b.adaptiveCheck {
+		b.checkInterval = b.nextCheckInterval(b.checkInterval, err == nil)
+	}
+	b.lastCheckMu.Unlock()
+
+	return err
+}
+
+// nextCheckInterval returns the interval following cur in the adaptive mode.
+func (b *blob) nextCheckInterval(cur time.Duration, ok bool) time.Duration {
+	if ok {
+		cur *= 2
+		if cur < b.minCheckInterval {
+			cur = b.minCheckInterval
+		}
+	} else {
+		cur /= 2
+	}
+	if cur > b.maxCheckInterval {
+		cur = b.maxCheckInterval
+	}
+	if cur < b.minCheckInterval {
+		cur = b.minCheckInterval
+	}
+	return cur
+}
+
+// WarmConnections opens n connections to the registry and keeps them idle for
+// the following reads. This is a no-op if the fetcher doesn't support it.
+func (b *blob) WarmConnections(ctx context.Context, n int) error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return err
+	}
+	w, ok := fr.(connWarmer)
+	if !ok {
+		return nil
+	}
+	return w.warmConnections(ctx, n)
+}
+
+func (b *blob) Size() int64 {
+	return b.currentSize()
+}
+
+// currentSize returns the size of the blob. This can be called concurrently with
+// the update of the size.
+func (b *blob) currentSize() int64 {
+	return atomic.LoadInt64(&b.size)
+}
+
+func (b *blob) FetchedSize() int64 {
+	b.fetchedRegionSetMu.Lock()
+	sz := b.fetchedRegionSet.totalSize()
+	b.fetchedRegionSetMu.Unlock()
+	return sz
+}
+
+// FetchedRegions returns the regions of the blob fetched (or restored by
+// RestoreState) by this blob, in ascending order of the offset. The adjacent
+// regions are merged. Unlike CachedRanges, this doesn't probe the cache so the
+// regions may have been evicted since. The returned slice is a copy.
+func (b *blob) FetchedRegions() []Region {
+	b.fetchedRegionSetMu.Lock()
+	defer b.fetchedRegionSetMu.Unlock()
+	return exportRegions(b.fetchedRegionSet.rs)
+}
+
+// CachedRanges returns the ranges of the blob whose chunks are present in the
+// cache, in ascending order of the offset. The ranges are aligned by the chunks
+// and the adjacent ones are merged. This only probes the cache and never fetches
+// the blob so this can be polled to wait until the blob is fully cached.
+func (b *blob) CachedRanges() []Region {
+	if b.isClosed() || b.currentSize() == 0 {
+		return nil
+	}
+	if b.IsMaterialized() {
+		return []Region{{Offset: 0, Size: b.currentSize()}}
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return nil
+	}
+	var res []Region
+	b.walkChunks(region{0, b.currentSize() - 1}, func(chunk region) error {
+		if !b.isCached(chunk, fr) {
+			return nil
+		}
+		if n := len(res); n > 0 && res[n-1].Offset+res[n-1].Size == chunk.b {
+			res[n-1].Size += chunk.size()
+		} else {
+			res = append(res, Region{Offset: chunk.b, Size: chunk.size()})
+		}
+		return nil
+	})
+	return res
+}
+
+// CachePlan returns the regions which Cache of the specified range would fetch
+// from the registry and the ones already cached, without fetching anything. The
+// regions are aligned by the chunks and the adjacent ones are merged. This is
+// useful for estimating the cost of a prefetch. Like Cache, this includes the
+// trailing region and the gaps filled by WithCoalesceGap, and only the rest of
+// the partially written chunks is fetched if the cache supports resuming.
+func (b *blob) CachePlan(offset int64, size int64) (toFetch []Region, cached []Region, err error) {
+	if b.isClosed() {
+		return nil, nil, ErrBlobClosed
+	}
+	if b.currentSize() == 0 || size <= 0 {
+		return nil, nil, nil
+	}
+	if b.IsMaterialized() {
+		reg := b.alignRegion(offset, size)
+		return nil, exportRegions([]region{reg}), nil
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var opts options
+	var fetchSet, cachedSet regionSet
+	missed := make(map[region]io.Writer)
+	rc := b.resumableCache()
+	if err := b.walkChunks(b.alignRegion(offset, size), func(reg region) error {
+		if r, err := b.getCache(fr.genID(reg), &opts); err == nil {
+			cachedSet.add(reg)
+			return r.Close()
+		}
+		if rc != nil {
+			if n := rc.PartialSize(fr.genID(reg)); n > 0 && n < reg.size() {
+				fetchSet.add(region{reg.b + n, reg.e})
+				return nil
+			}
+		}
+		missed[reg] = io.Discard
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	b.includeTrailingRegion(missed, fr, &opts)
+	if b.coalesceGap > 0 {
+		missed = b.fillGaps(missed)
+	}
+	for reg := range missed {
+		fetchSet.add(reg)
+	}
+	if len(fetchSet.rs) > 0 {
+		toFetch = exportRegions(fetchSet.rs)
+	}
+	if len(cachedSet.rs) > 0 {
+		cached = exportRegions(cachedSet.rs)
+	}
+	return toFetch, cached, nil
+}
+
+// blobStateVersion is the version of the format of the state of SnapshotState.
+const blobStateVersion = 1
+
+// blobState is the state of the blob saved by SnapshotState.
+type blobState struct {
+	Version   int           `json:"version"`
+	Digest    digest.Digest `json:"digest,omitempty"`
+	Size      int64         `json:"size"`
+	ChunkSize int64         `json:"chunkSize"`
+	Fetched   []Region      `json:"fetched,omitempty"`
+}
+
+// SnapshotState returns the state of the blob, which is the identity of the blob
+// and the regions cached by the blob. Another blob of the same contents (e.g. on
+// another node sharing the cache) can take over the state by RestoreState.
+func (b *blob) SnapshotState() ([]byte, error) {
+	if b.isClosed() {
+		return nil, ErrBlobClosed
+	}
+	b.refreshMu.Lock()
+	dgst := b.desc.Digest
+	b.refreshMu.Unlock()
+	return json.Marshal(blobState{
+		Version:   blobStateVersion,
+		Digest:    dgst,
+		Size:      b.currentSize(),
+		ChunkSize: b.chunkSize,
+		Fetched:   b.FetchedRegions(),
+	})
+}
+
+// RestoreState restores the state returned by SnapshotState. The state must be
+// of the blob of the same digest, size and chunk size. The regions recorded as
+// cached are assumed to be in the cache of this blob.
+func (b *blob) RestoreState(state []byte) error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+	var st blobState
+	if err := json.Unmarshal(state, &st); err != nil {
+		return fmt.Errorf("failed to parse the state: %w", err)
+	}
+	if st.Version != blobStateVersion {
+		return fmt.Errorf("unsupported version %d of the state", st.Version)
+	}
+	b.refreshMu.Lock()
+	dgst := b.desc.Digest
+	b.refreshMu.Unlock()
+	if st.Digest != "" && dgst != "" && st.Digest != dgst {
+		return fmt.Errorf("state of the blob %q; want %q", st.Digest, dgst)
+	}
+	if size := b.currentSize(); st.Size != size || st.ChunkSize != b.chunkSize {
+		return fmt.Errorf("state of the blob of size %d and chunk size %d; want %d and %d",
+			st.Size, st.ChunkSize, size, b.chunkSize)
+	}
+	for _, r := range st.Fetched {
+		if r.Offset < 0 || r.Size <= 0 || r.Offset+r.Size > st.Size {
+			return fmt.Errorf("invalid region %+v in the state", r)
+		}
+	}
+	for _, r := range st.Fetched {
+		b.markCached(region{r.Offset, r.Offset + r.Size - 1})
+	}
+	return nil
+}
+
+// isCached reports whether the chunk can be read from the caches (including the
+// fallback caches and the legacy ID) or the pinned data.
+func (b *blob) isCached(chunk region, fr fetcher) bool {
+	if b.pinnedData(chunk) != nil {
+		return true
+	}
+	id := fr.genID(chunk)
+	r, err := b.getCache(id, &options{})
+	if err != nil && b.cacheIDRewriter != nil {
+		if legacyID, ok := b.cacheIDRewriter(id); ok && legacyID != id {
+			r, err = b.getCache(legacyID, &options{})
+		}
+	}
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+func (b *blob) BlobStats() BlobStats {
+	b.prefetchStatsMu.Lock()
+	prefetchStats := b.prefetchStats
+	b.prefetchStatsMu.Unlock()
+	b.firstReadMu.Lock()
+	firstRead := b.firstRead
+	b.firstReadMu.Unlock()
+	return BlobStats{
+		Prefetch:         prefetchStats,
+		Created:          b.created,
+		FirstRead:        firstRead,
+		CacheBytes:       atomic.LoadInt64(&b.cacheBytes),
+		FetchedBytes:     atomic.LoadInt64(&b.fetchedBytes),
+		OverFetchedBytes: atomic.LoadInt64(&b.overFetchedBytes),
+		RoundTrips:       atomic.LoadInt64(&b.roundTrips),
+		CacheHits:        atomic.LoadInt64(&b.cacheHits),
+		CacheMisses:      atomic.LoadInt64(&b.cacheMisses),
+		CacheEntries:     b.cacheEntriesCount(),
+		CommitFailures:   atomic.LoadInt64(&b.commitFailures),
+		LeaderFetches:    atomic.LoadInt64(&b.leaderFetches),
+		SharedFetches:    atomic.LoadInt64(&b.sharedFetches),
+	}
+}
+
+// ResetStats resets the cumulative counters of BlobStats.
+func (b *blob) ResetStats() {
+	atomic.StoreInt64(&b.cacheBytes, 0)
+	atomic.StoreInt64(&b.fetchedBytes, 0)
+	atomic.StoreInt64(&b.overFetchedBytes, 0)
+	atomic.StoreInt64(&b.roundTrips, 0)
+	atomic.StoreInt64(&b.cacheHits, 0)
+	atomic.StoreInt64(&b.cacheMisses, 0)
+	atomic.StoreInt64(&b.commitFailures, 0)
+	atomic.StoreInt64(&b.leaderFetches, 0)
+	atomic.StoreInt64(&b.sharedFetches, 0)
+}
+
+// InFlightFetches returns the regions currently being fetched from the registry,
+// sorted by offset. This is useful for debugging hanging reads.
+func (b *blob) InFlightFetches() []FetchInfo {
+	b.inFlightMu.Lock()
+	defer b.inFlightMu.Unlock()
+	var infos []FetchInfo
+	for _, f := range b.inFlight {
+		for _, reg := range f.regions {
+			infos = append(infos, FetchInfo{
+				Offset: reg.b,
+				Size:   reg.size(),
+				Start:  f.start,
+			})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Offset < infos[j].Offset })
+	return infos
+}
+
+type inFlightFetch struct {
+	regions []region
+	start   time.Time
+}
+
+// beginFetch records the fetch of the regions as in flight. The returned
+// function must be called when the fetch finishes.
+func (b *blob) beginFetch(key string, allData map[region]io.Writer) (done func()) {
+	f := inFlightFetch{start: time.Now()}
+	for reg := range allData {
+		f.regions = append(f.regions, reg)
+	}
+	b.inFlightMu.Lock()
+	if b.inFlight == nil {
+		b.inFlight = make(map[string]inFlightFetch)
+	}
+	b.inFlight[key] = f
+	b.inFlightMu.Unlock()
+	return func() {
+		b.inFlightMu.Lock()
+		delete(b.inFlight, key)
+		b.inFlightMu.Unlock()
+	}
+}
+
+// syncKey returns the key of the fetch of allData in fetchedRegionGroup.
+func (b *blob) syncKey(allData map[region]io.Writer) string {
+	if b.syncKeyFunc == nil {
+		return makeSyncKey(allData)
+	}
+	regions := make([]Region, 0, len(allData))
+	for reg := range allData {
+		regions = append(regions, Region{Offset: reg.b, Size: reg.size()})
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].Offset < regions[j].Offset
+	})
+	if key := b.syncKeyFunc(regions); key != "" {
+		return key
+	}
+	return makeSyncKey(allData)
+}
+
+func makeSyncKey(allData map[region]io.Writer) string {
+	keys := make([]string, len(allData))
+	keysIndex := 0
+	for key := range allData {
+		keys[keysIndex] = fmt.Sprintf("[%d,%d]", key.b, key.e)
+		keysIndex++
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (b *blob) cacheAt(offset int64, size int64, fr fetcher, cacheOpts *options) error {
+	if cacheOpts.ctx != nil {
+		// Don't issue requests once the operation is canceled.
+		if err := cacheOpts.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if cacheOpts.prefetch && b.evictionPressure(cacheOpts.prefetchTracker) {
+		return ErrEvictionPressure
+	}
+	fetchReg := b.alignRegion(offset, size)
+	discard := make(map[region]io.Writer)
+
+	rc := b.resumableCache()
+	err := b.walkChunks(fetchReg, func(reg region) error {
+		if r, err := b.getCache(fr.genID(reg), cacheOpts); err == nil {
+			return r.Close() // nop if the cache hits
+		}
+		if rc != nil {
+			if n := rc.PartialSize(fr.genID(reg)); n > 0 && n < reg.size() {
+				err := b.resumeChunk(rc, reg, n, fr, cacheOpts)
+				if err == nil {
+					return nil
+				}
+				log.L.WithError(err).Debugf("failed to resume chunk %+v; fetching whole", reg)
+			}
+		}
+		discard[reg] = io.Discard
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.includeTrailingRegion(discard, fr, cacheOpts)
+
+	if err := b.fetchRange(discard, cacheOpts); err != nil {
+		return err
+	}
+
+	var completed int
+	b.walkChunks(fetchReg, func(reg region) error {
+		completed++
+		return nil
+	})
+	b.prefetchStatsMu.Lock()
+	b.prefetchStats.RegionsCompleted += completed
+	if b.prefetchStats.RegionsCompleted > b.prefetchStats.RegionsTotal {
+		b.prefetchStats.RegionsCompleted = b.prefetchStats.RegionsTotal
+	}
+	b.prefetchStatsMu.Unlock()
+	return nil
+}
+
+// resumableCache returns the cache as ResumableCache if it supports resuming.
+func (b *blob) resumableCache() ResumableCache {
+	if _, ok := b.cache.(*packingCache); ok {
+		return nil // resumed chunks would bypass the packs
+	}
+	rc, _ := b.cache.(ResumableCache)
+	return rc
+}
+
+// cacheEntriesCount returns the number of the entries the blob added to the cache.
+func (b *blob) cacheEntriesCount() int64 {
+	if b.entries != nil {
+		return b.entries.count()
+	}
+	return atomic.LoadInt64(&b.cacheEntries)
+}
+
+// resumeChunk fetches the tail of the chunk following the written bytes of the
+// uncommitted contents in the cache and commits the chunk.
+func (b *blob) resumeChunk(rc ResumableCache, chunk region, written int64, fr fetcher, opts *options) error {
+	if err := b.acquireFetch(); err != nil {
+		return err
+	}
+	defer b.releaseFetch()
+	tail := region{chunk.b + written, chunk.e}
+	fetchCtx, cancel := b.fetchContext(opts)
+	defer cancel()
+	mr, err := b.fetchWithRetry(fetchCtx, fr, []region{tail}, opts)
+	if err != nil {
+		return newFetchError([]region{tail}, fr, err)
+	}
+	defer mr.Close()
+	reg, p, err := mr.Next()
+	if err != nil {
+		return newFetchError([]region{tail}, fr, fmt.Errorf("failed to read resp: %w", err))
+	}
+	if reg.b > tail.b || reg.e < tail.e {
+		return newFetchError([]region{tail}, fr, fmt.Errorf("unexpected region %+v in the response", reg))
+	}
+	if _, err := io.CopyN(io.Discard, p, tail.b-reg.b); err != nil {
+		return err
+	}
+
+	id := fr.genID(chunk)
+	cw, err := rc.Resume(id, opts.cacheOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to resume chunk %+v in the cache %q: %w", chunk, id, err)
+	}
+	defer cw.Close()
+	if _, err := b.copyN(cw, p, tail.size(), opts); err != nil {
+		return err // keep the written contents for the next resume
+	}
+	atomic.AddInt64(&b.fetchedBytes, tail.size())
+	if err := cw.Commit(); err != nil {
+		return fmt.Errorf("failed to commit chunk %+v to the cache %q: %w", chunk, id, err)
+	}
+	atomic.AddInt64(&b.cacheEntries, 1)
+	b.markCached(chunk)
+	return nil
+}
+
+// Prefetch fetches the specified regions and adds them to the cache in the
+// background. The regions are in descending order of priority. Overlapping and
+// adjacent regions are coalesced and each of the coalesced regions is fetched by
+// one request, skipping the chunks already cached. The requests are issued in
+// the order of priority from the pool limited by WithPrefetchConcurrency, with
+// PriorityLow unless WithPriority is specified. The returned channel receives
+// the result once all the regions are fetched; callers not interested in the
+// completion can ignore it.
+func (b *blob) Prefetch(regions []Region, opts ...Option) <-chan error {
+	done := make(chan error, 1)
+	prefetchOpts := options{priority: PriorityLow}
+	for _, o := range opts {
+		o(&prefetchOpts)
+	}
+	prefetchOpts.background = true
+	if b.isClosed() {
+		done <- ErrBlobClosed
+		close(done)
+		return done
+	}
+	fr, err := b.snapshotFetcher(&prefetchOpts)
+	if err != nil {
+		done <- err
+		close(done)
+		return done
+	}
+	ctx := prefetchOpts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go func() {
+		defer close(done)
+		var eg errgroup.Group
+		for _, reg := range b.coalesceRegions(regions) {
+			if err := b.prefetchSem.Acquire(ctx, 1); err != nil {
+				eg.Go(func() error { return err })
+				break
+			}
+			reg := reg
+			eg.Go(func() error {
+				defer b.prefetchSem.Release(1)
+				return b.prefetchRegion(reg, fr, &prefetchOpts)
+			})
+		}
+		done <- eg.Wait()
+	}()
+	return done
+}
+
+// coalesceRegions aligns the regions to the chunks and merges the overlapping
+// and adjacent ones. The merged region takes the place of the one with the
+// highest priority (i.e. the first one) among the merged ones.
+func (b *blob) coalesceRegions(regions []Region) (res []region) {
+	size := b.currentSize()
+	touching := func(x, y region) bool { return x.b <= y.e+1 && y.b <= x.e+1 }
+	union := func(x, y region) region {
+		if y.b < x.b {
+			x.b = y.b
+		}
+		if y.e > x.e {
+			x.e = y.e
+		}
+		return x
+	}
+	for _, r := range regions {
+		if r.Offset < 0 || r.Size <= 0 || r.Offset >= size {
+			continue
+		}
+		if r.Offset+r.Size > size {
+			r.Size = size - r.Offset
+		}
+		reg := b.alignRegion(r.Offset, r.Size)
+		i := 0
+		for i < len(res) && !touching(res[i], reg) {
+			i++
+		}
+		if i == len(res) {
+			res = append(res, reg)
+			continue
+		}
+		res[i] = union(res[i], reg)
+		for j := i + 1; j < len(res); {
+			if touching(res[i], res[j]) {
+				res[i] = union(res[i], res[j])
+				res = append(res[:j], res[j+1:]...)
+				j = i + 1 // res[i] grew; check the rest again
+				continue
+			}
+			j++
+		}
+	}
+	return res
+}
+
+// prefetchRegion fetches the chunks in the region which aren't cached yet.
+func (b *blob) prefetchRegion(reg region, fr fetcher, opts *options) error {
+	missing := make(map[region]io.Writer)
+	if err := b.walkChunks(reg, func(chunk region) error {
+		if r, err := b.getCache(fr.genID(chunk), opts); err == nil {
+			return r.Close() // nop if the cache hits
+		}
+		missing[chunk] = io.Discard
+		return nil
+	}); err != nil {
+		return err
+	}
+	return b.fetchRange(missing, opts)
+}
+
+// Cache fetches the specified range and adds it to the cache. This is a no-op
+// for a zero-size blob and a materialized layer (see WithMaterializedLayer).
+// Canceling the context specified by WithContext aborts the in-flight fetches
+// and stops the remaining ones.
+func (b *blob) Cache(offset int64, size int64, opts ...Option) (retErr error) {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+
+	if b.currentSize() == 0 || b.IsMaterialized() {
+		return nil
+	}
+
+	var cacheOpts options
+	for _, o := range opts {
+		o(&cacheOpts)
+	}
+	cacheOpts.prefetch = true
+	cacheOpts.background = true
+	var span trace.Span
+	cacheOpts.spanCtx, span = b.startSpan(&cacheOpts, "Cache",
+		attribute.Int64("offset", offset), attribute.Int64("size", size))
+	defer func() { endSpan(span, retErr) }()
+
+	fr, err := b.snapshotFetcher(&cacheOpts)
+	if err != nil {
+		return err
+	}
+
+	cacheOpts.prefetchTracker = b.startPrefetchTracking()
+	defer b.stopPrefetchTracking(cacheOpts.prefetchTracker)
+
+	var total int
+	b.walkChunks(b.alignRegion(offset, size), func(reg region) error {
+		total++
+		return nil
+	})
+	b.prefetchStatsMu.Lock()
+	if b.prefetchInFlight == 0 {
+		b.prefetchStats = PrefetchStats{Start: time.Now()}
+	}
+	b.prefetchInFlight++
+	b.prefetchStats.Bytes += size
+	b.prefetchStats.RegionsTotal += total
+	b.prefetchStatsMu.Unlock()
+	defer func() {
+		b.prefetchStatsMu.Lock()
+		if b.prefetchInFlight--; b.prefetchInFlight == 0 {
+			b.prefetchStats.End = time.Now()
+		}
+		b.prefetchStatsMu.Unlock()
+	}()
+
+	if cacheOpts.shuffle {
+		return b.cacheShuffled(offset, size, fr, &cacheOpts)
+	}
+
+	if cacheOpts.yieldToReads {
+		return b.cacheYielding(offset, size, fr, &cacheOpts)
+	}
+
+	if b.prefetchChunkSize <= b.chunkSize {
+		return b.cacheAt(offset, size, fr, &cacheOpts)
+	}
+
+	ctx := cacheOpts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	rangeOpts := cacheOpts
+	if cacheOpts.ctx != nil {
+		// Abort the in-flight fetches once the caller cancels the context or
+		// any of the ranges fails. Without the context, each fetch times out
+		// after fetchTimeout as before.
+		rangeOpts.ctx = egCtx
+	}
+
+	fetchSize := b.chunkSize * (b.prefetchChunkSize / b.chunkSize)
+
+	end := offset + size
+	for i := offset; i < end; i += fetchSize {
+		i, l := i, fetchSize
+		if i+l > end {
+			l = end - i
+		}
+		if i > offset && cacheOpts.maxStagger > 0 {
+			timer := time.NewTimer(time.Duration(rand.Int63n(int64(cacheOpts.maxStagger) + 1)))
+			select {
+			case <-timer.C:
+			case <-egCtx.Done():
+				timer.Stop()
+				if err := eg.Wait(); err != nil {
+					return err
+				}
+				return ctx.Err()
+			}
+		}
+		eg.Go(func() error {
+			return b.cacheAt(i, l, fr, &rangeOpts)
+		})
+	}
+
+	return eg.Wait()
+}
+
+// cacheShuffled caches the chunks of the range one by one in the order shuffled
+// with the seed specified by WithShuffledOrder. If WithYieldToReads is specified,
+// each chunk waits for the in-flight reads.
+func (b *blob) cacheShuffled(offset int64, size int64, fr fetcher, cacheOpts *options) error {
+	ctx := cacheOpts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var chunks []region
+	if err := b.walkChunks(b.alignRegion(offset, size), func(chunk region) error {
+		chunks = append(chunks, chunk)
+		return nil
+	}); err != nil {
+		return err
+	}
+	rnd := rand.New(rand.NewSource(cacheOpts.shuffleSeed))
+	rnd.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+	for _, chunk := range chunks {
+		if cacheOpts.yieldToReads {
+			if err := b.waitReadsIdle(ctx); err != nil {
+				return err
+			}
+		}
+		if err := b.cacheAt(chunk.b, chunk.size(), fr, cacheOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheYielding caches the specified range sequentially by prefetchChunkSize (or
+// chunkSize if it's smaller). Before fetching each range, this waits until no
+// foreground read (ReadAt) is in progress so that prefetch doesn't contend
+// bandwidth with them.
+func (b *blob) cacheYielding(offset int64, size int64, fr fetcher, cacheOpts *options) error {
+	ctx := cacheOpts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	fetchSize := b.chunkSize
+	if b.prefetchChunkSize > b.chunkSize {
+		fetchSize = b.chunkSize * (b.prefetchChunkSize / b.chunkSize)
+	}
+	end := offset + size
+	for i := offset; i < end; i += fetchSize {
+		l := fetchSize
+		if i+l > end {
+			l = end - i
+		}
+		if err := b.waitReadsIdle(ctx); err != nil {
+			return err
+		}
+		if err := b.cacheAt(i, l, fr, cacheOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinnedChunk is the contents of the chunk pinned by FetchRegionAtomic.
+type pinnedChunk struct {
+	data []byte
+	refs int
+}
+
+// FetchRegionAtomic fetches all chunks of the specified region in a single
+// operation and pins them on the blob. Pinned chunks are served from memory,
+// regardless of the evictions from the cache, until the region is released by
+// ReleaseRegion. Each call must be paired with a call of ReleaseRegion.
+func (b *blob) FetchRegionAtomic(target Region, opts ...Option) error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+	size := b.currentSize()
+	if target.Offset < 0 || target.Size <= 0 || target.Offset+target.Size > size {
+		return fmt.Errorf("invalid region %+v of the blob of size %d", target, size)
+	}
+	reg := region{target.Offset, target.Offset + target.Size - 1}
+
+	var fetchOpts options
+	for _, o := range opts {
+		o(&fetchOpts)
+	}
+
+	fr, err := b.snapshotFetcher(&fetchOpts)
+	if err != nil {
+		return err
+	}
+
+	chunks := make(map[region][]byte)
+	allData := make(map[region]io.Writer)
+	if err := b.walkChunks(b.alignRegion(reg.b, reg.size()), func(chunk region) error {
+		data := make([]byte, chunk.size())
+		chunks[chunk] = data
+		if pinned := b.pinnedData(chunk); pinned != nil {
+			copy(data, pinned)
+			return nil
+		}
+		if err := b.readFromCache(chunk, data, 0, fr, &fetchOpts); err == nil {
+			return nil
+		}
+		allData[chunk] = newBytesWriter(data, 0)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := b.fetchRange(allData, &fetchOpts); err != nil {
+		return err
+	}
+
+	b.pinnedMu.Lock()
+	defer b.pinnedMu.Unlock()
+	if b.pinned == nil {
+		b.pinned = make(map[region]*pinnedChunk)
+	}
+	for chunk, data := range chunks {
+		if c, ok := b.pinned[chunk]; ok {
+			c.refs++ // already pinned by another call
+			continue
+		}
+		b.pinned[chunk] = &pinnedChunk{data: data, refs: 1}
+	}
+	return nil
+}
+
+// ReleaseRegion unpins the region pinned by FetchRegionAtomic. The chunks are
+// unpinned once all calls of FetchRegionAtomic pinning them are released.
+func (b *blob) ReleaseRegion(reg Region) {
+	if reg.Size <= 0 {
+		return
+	}
+	b.pinnedMu.Lock()
+	defer b.pinnedMu.Unlock()
+	b.walkChunks(b.alignRegion(reg.Offset, reg.Size), func(chunk region) error {
+		if c, ok := b.pinned[chunk]; ok {
+			if c.refs--; c.refs <= 0 {
+				delete(b.pinned, chunk)
+			}
+		}
+		return nil
+	})
+}
+
+// pinnedData returns the contents of the chunk if it's pinned. Otherwise, this
+// returns nil.
+func (b *blob) pinnedData(chunk region) []byte {
+	b.pinnedMu.Lock()
+	defer b.pinnedMu.Unlock()
+	if c, ok := b.pinned[chunk]; ok {
+		return c.data
+	}
+	return nil
+}
+
+// beginRead marks a foreground read as active. endRead must be called when the
+// read completes.
+func (b *blob) beginRead() {
+	b.activeReadsMu.Lock()
+	if b.activeReads == 0 {
+		b.readsIdle = make(chan struct{})
+	}
+	b.activeReads++
+	b.activeReadsMu.Unlock()
+}
+
+func (b *blob) endRead() {
+	b.activeReadsMu.Lock()
+	b.activeReads--
+	if b.activeReads == 0 {
+		close(b.readsIdle)
+	}
+	b.activeReadsMu.Unlock()
+}
+
+// waitReadsIdle blocks until no foreground read is active.
+func (b *blob) waitReadsIdle(ctx context.Context) error {
+	b.activeReadsMu.Lock()
+	if b.activeReads == 0 {
+		b.activeReadsMu.Unlock()
+		return nil
+	}
+	idle := b.readsIdle
+	b.activeReadsMu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReadAt reads remote chunks from specified offset for the buffer size.
+// It tries to fetch as many chunks as possible from local cache.
+// We can configure this function with options.
+// Reading beyond the end of the blob (including any read of a zero-size blob)
+// returns (0, nil) without accessing the cache and the registry.
+func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (_ int, retErr error) {
+	if b.isClosed() {
+		return 0, ErrBlobClosed
+	}
+
+	if size := b.currentSize(); len(p) == 0 || offset > size || size == 0 {
+		return 0, nil
+	}
+
+	b.beginRead()
+	defer b.endRead()
+
+	if f := b.materializedFile(); f != nil {
+		// Hold the reference so that Close doesn't close the file during the read.
+		if err := b.acquireFetch(); err != nil {
+			return 0, err
+		}
+		defer b.releaseFetch()
+		p = b.adjustBufferSize(p, offset)
+		n, err := f.ReadAt(p, offset)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+		if err == nil {
+			b.recordFirstRead()
+		}
+		return n, err
+	}
+
+	var readAtOpts options
+	for _, o := range opts {
+		o(&readAtOpts)
+	}
+	var span trace.Span
+	readAtOpts.spanCtx, span = b.startSpan(&readAtOpts, "ReadAt",
+		attribute.Int64("offset", offset), attribute.Int("size", len(p)))
+	defer func() { endSpan(span, retErr) }()
+
+	if readAtOpts.forceRefresh {
+		if err := b.forceRefresh(&readAtOpts); err != nil {
+			return 0, fmt.Errorf("failed to refresh blob: %w", err)
+		}
+	}
+
+	// Fetcher can be suddenly updated so we take and use the snapshot of it for
+	// consistency.
+	fr, err := b.snapshotFetcher(&readAtOpts)
+	if err != nil {
+		return 0, err
+	}
+
+	if readAtOpts.onRequestCount != nil {
+		var count int64
+		readAtOpts.requestCount = &count
+		defer func() {
+			readAtOpts.onRequestCount(int(atomic.LoadInt64(&count)))
+		}()
+	}
+	if readAtOpts.onReadTiming != nil {
+		readAtOpts.readTimer = &readTimer{start: time.Now()}
+		defer func() {
+			readAtOpts.onReadTiming(readAtOpts.readTimer.timing())
+		}()
+	}
+
+	if readAtOpts.readWindowChunks > 0 {
+		if err := b.readAtInWindows(p, offset, readAtOpts.readWindowChunks, fr, &readAtOpts); err != nil {
+			return 0, err
+		}
+	} else if err := b.readAt(p, offset, fr, &readAtOpts); err != nil {
+		return 0, err
+	}
+	b.prefetchTOC(p, offset, fr)
+	b.maybeAutoComplete()
+
+	b.recordFirstRead()
+
+	return len(b.adjustBufferSize(p, offset)), nil
+}
+
+// maybeAutoComplete starts fetching the rest of the blob in the background if the
+// fetched regions exceed the threshold specified by WithAutoComplete. This is
+// done only once. The fetch is canceled by Close.
+func (b *blob) maybeAutoComplete() {
+	if b.autoCompleteThreshold <= 0 || atomic.LoadInt32(&b.autoCompleteStarted) != 0 {
+		return
+	}
+	// Called by every ReadAt; check the threshold without the lock.
+	size := b.currentSize()
+	if float64(atomic.LoadInt64(&b.fetchedTotal)) <= b.autoCompleteThreshold*float64(size) ||
+		!atomic.CompareAndSwapInt32(&b.autoCompleteStarted, 0, 1) {
+		return
+	}
+	fr, err := b.getFetcher()
+	if err != nil {
+		return
+	}
+	if err := b.acquireFetch(); err != nil {
+		return
+	}
+	go func() {
+		defer b.releaseFetch()
+		if err := b.autoComplete(fr); err != nil {
+			log.L.WithError(err).Warnf("failed to fetch the rest of the blob")
+		}
+	}()
+}
+
+// autoComplete fetches the regions of the blob not fetched yet by batches of
+// prefetchChunkSize (or chunkSize if it's smaller), limited by prefetchSem.
+func (b *blob) autoComplete(fr fetcher) error {
+	opts := b.backgroundOptions()
+	opts.fetcher = fr
+	batchSize := b.chunkSize
+	if b.prefetchChunkSize > b.chunkSize {
+		batchSize = b.chunkSize * (b.prefetchChunkSize / b.chunkSize)
+	}
+
+	var (
+		eg         errgroup.Group
+		batch      = make(map[region]io.Writer)
+		batchBytes int64
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := b.prefetchSem.Acquire(opts.ctx, 1); err != nil {
+			return err
+		}
+		allData := batch
+		batch, batchBytes = make(map[region]io.Writer), 0
+		eg.Go(func() error {
+			defer b.prefetchSem.Release(1)
+			return b.fetchRange(allData, opts)
+		})
+		return nil
+	}
+	for _, gap := range b.unfetchedRegions() {
+		if err := b.walkChunks(b.alignRegion(gap.b, gap.size()), func(chunk region) error {
+			batch[chunk] = io.Discard
+			if batchBytes += chunk.size(); batchBytes >= batchSize {
+				return flush()
+			}
+			return nil
+		}); err != nil {
+			eg.Wait()
+			return err
+		}
+	}
+	if err := flush(); err != nil {
+		eg.Wait()
+		return err
+	}
+	return eg.Wait()
+}
+
+// unfetchedRegions returns the regions of the blob not in fetchedRegionSet.
+func (b *blob) unfetchedRegions() []region {
+	b.fetchedRegionSetMu.Lock()
+	gaps := make([]region, 0, len(b.fetchedRegionSet.rs)+1)
+	var next int64
+	for _, reg := range b.fetchedRegionSet.rs {
+		if next < reg.b {
+			gaps = append(gaps, region{next, reg.b - 1})
+		}
+		next = reg.e + 1
+	}
+	b.fetchedRegionSetMu.Unlock()
+	if size := b.currentSize(); next < size {
+		gaps = append(gaps, region{next, size - 1})
+	}
+	return gaps
+}
+
+// recordFirstRead records the time of the first successful read.
+func (b *blob) recordFirstRead() {
+	b.firstReadMu.Lock()
+	if b.firstRead.IsZero() {
+		b.firstRead = time.Now()
+	}
+	b.firstReadMu.Unlock()
+}
+
+// ReadFull is the same as ReadAt but fills p exactly, like io.ReadFull. If the
+// blob ends before p is filled, this returns the number of bytes read with
+// io.ErrUnexpectedEOF, or io.EOF if no byte is read.
+func (b *blob) ReadFull(p []byte, offset int64, opts ...Option) (int, error) {
+	n, err := b.ReadAt(p, offset, opts...)
+	if err != nil || n == len(p) {
+		return n, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, io.ErrUnexpectedEOF
+}
+
+// ReadAtWithDigest is the same as ReadAt but also returns the digest of the bytes
+// read to p, computed with the specified algorithm.
+func (b *blob) ReadAtWithDigest(p []byte, offset int64, alg digest.Algorithm, opts ...Option) (int, digest.Digest, error) {
+	if !alg.Available() {
+		return 0, "", fmt.Errorf("digest algorithm %q is unavailable", alg)
+	}
+	n, err := b.ReadAt(p, offset, opts...)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, alg.FromBytes(p[:n]), nil
+}
+
+// Reader returns a reader of the blob from the specified offset. The contents are
+// read with ReadAt by windows aligned to the chunk size, which span the number of
+// chunks specified by WithReadAhead (one by default). Closing the returned reader
+// doesn't close the blob.
+func (b *blob) Reader(offset int64, opts ...Option) io.ReadCloser {
+	var readerOpts options
+	for _, o := range opts {
+		o(&readerOpts)
+	}
+	window := readerOpts.readAheadChunks
+	if window <= 0 {
+		window = 1
+	}
+	return &blobReader{b: b, pos: offset, window: int64(window), opts: opts}
+}
+
+type blobReader struct {
+	b      *blob
+	pos    int64
+	window int64 // in chunks
+	opts   []Option
+	buf    []byte // read but not consumed yet
+	err    error
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.fill(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill reads the next window to buf.
+func (r *blobReader) fill() error {
+	size := r.b.Size()
+	if r.pos >= size {
+		return io.EOF
+	}
+	end := (r.pos/r.b.chunkSize + r.window) * r.b.chunkSize
+	if end > size {
+		end = size
+	}
+	if n := end - r.pos; int64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	} else {
+		r.buf = r.buf[:n]
+	}
+	n, err := r.b.ReadAt(r.buf, r.pos, r.opts...)
+	r.buf = r.buf[:n]
+	r.pos += int64(n)
+	if err != nil && (err != io.EOF || n == 0) {
+		return err
+	}
+	return nil
+}
+
+func (r *blobReader) Close() error {
+	return nil
+}
+
+// readAt reads the specified range from the cache and the registry to p.
+func (b *blob) readAt(p []byte, offset int64, fr fetcher, opts *options) error {
+	// Make the buffer chunk aligned
+	allRegion := b.alignRegion(offset, int64(len(p)))
+	allData := make(map[region]io.Writer)
+	byDigest := make(map[region]digest.Digest)
+	var overFetched int64 // bytes of the missed chunks out of p
+
+	b.walkChunks(allRegion, func(chunk region) error {
+		var (
+			base         = positive(chunk.b - offset)
+			lowerUnread  = positive(offset - chunk.b)
+			upperUnread  = positive(chunk.e + 1 - (offset + int64(len(p))))
+			expectedSize = chunk.size() - upperUnread - lowerUnread
+		)
+
+		// Check if the content exists in the cache
+		start := time.Now()
+		err := b.readFromCache(chunk, p[base:base+expectedSize], lowerUnread, fr, opts)
+		opts.readTimer.add(phaseCacheLookup, time.Since(start))
+		if err == nil {
+			return nil
+		}
+
+		// We missed cache. Take it from remote registry.
+		// We get the whole chunk here and add it to the cache so that following
+		// reads against neighboring chunks can take the data without making HTTP requests.
+		w := newBytesWriter(p[base:base+expectedSize], lowerUnread)
+		if b.chunkDigests != nil {
+			if dgst, ok := b.chunkDigests.ChunkDigest(chunk.b); ok {
+				byDigest[chunk] = dgst
+			}
+		}
+		allData[chunk] = w
+		overFetched += chunk.size() - expectedSize
+		return nil
+	})
+	if len(allData) > 0 && opts.byteRangeHint > 0 {
+		overFetched += b.includeHintedRange(allData, allRegion, opts.byteRangeHint, fr, opts)
+	}
+	joins, release := b.claimDigests(allData, byDigest, fr)
+	b.includeTrailingRegion(allData, fr, opts)
+
+	// Read required data
+	err := b.fetchRange(allData, opts)
+	release(err)
+	if err != nil {
+		return err
+	}
+	if err := b.joinDigestFetches(joins, fr, opts); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.overFetchedBytes, overFetched)
+	return nil
+}
+
+// includeHintedRange adds the uncached chunks covering n bytes following
+// allRegion (see WithByteRangeHint) to allData so that they are fetched into the
+// cache together. This returns the number of bytes added.
+func (b *blob) includeHintedRange(allData map[region]io.Writer, allRegion region, n int64, fr fetcher, opts *options) (added int64) {
+	end := allRegion.e + n
+	if last := b.currentSize() - 1; end > last {
+		end = last
+	}
+	if end <= allRegion.e {
+		return 0
+	}
+	b.walkChunks(b.alignRegion(allRegion.e+1, end-allRegion.e), func(chunk region) error {
+		if r, err := b.getCache(fr.genID(chunk), opts); err == nil {
+			return r.Close()
+		}
+		allData[chunk] = io.Discard
+		added += chunk.size()
+		return nil
+	})
+	return added
+}
+
+// digestFetch is a fetch of a chunk which other chunks with the same digest
+// can join (see WithDigestCoalescing).
+type digestFetch struct {
+	chunk region
+	id    string
+	done  chan struct{} // closed when the fetch completes
+	err   error
+}
+
+// digestJoin is a chunk to be filled from the contents of the digestFetch.
+type digestJoin struct {
+	chunk region
+	w     io.Writer
+	f     *digestFetch
+}
+
+// claimDigests removes from allData the chunks whose digests are already being
+// fetched, by another read or by another chunk in allData, so that they are
+// filled from those fetches after the fetch of allData. The remaining chunks with
+// digests are registered so that others can join them until release is called
+// with the result of the fetch.
+func (b *blob) claimDigests(allData map[region]io.Writer, byDigest map[region]digest.Digest, fr fetcher) (joins []digestJoin, release func(error)) {
+	if len(byDigest) == 0 {
+		return nil, func(error) {}
+	}
+	chunks := make([]region, 0, len(byDigest))
+	for chunk := range byDigest {
+		chunks = append(chunks, chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].b < chunks[j].b })
+
+	var claimed []digest.Digest
+	b.digestFetchesMu.Lock()
+	if b.digestFetches == nil {
+		b.digestFetches = make(map[digest.Digest]*digestFetch)
+	}
+	for _, chunk := range chunks {
+		dgst := byDigest[chunk]
+		if f, ok := b.digestFetches[dgst]; ok {
+			joins = append(joins, digestJoin{chunk, allData[chunk], f})
+			delete(allData, chunk)
+			continue
+		}
+		b.digestFetches[dgst] = &digestFetch{chunk: chunk, id: fr.genID(chunk), done: make(chan struct{})}
+		claimed = append(claimed, dgst)
+	}
+	b.digestFetchesMu.Unlock()
+
+	return joins, func(err error) {
+		b.digestFetchesMu.Lock()
+		defer b.digestFetchesMu.Unlock()
+		for _, dgst := range claimed {
+			f := b.digestFetches[dgst]
+			delete(b.digestFetches, dgst)
+			f.err = err
+			close(f.done)
+		}
+	}
+}
+
+// joinDigestFetches waits for the fetches joined by claimDigests and fills the
+// chunks from the cached contents. Chunks which can't be filled that way (e.g.
+// the fetch failed or the contents are already evicted) are fetched together.
+func (b *blob) joinDigestFetches(joins []digestJoin, fr fetcher, opts *options) error {
+	missed := make(map[region]io.Writer)
+	for _, j := range joins {
+		<-j.f.done
+		if j.f.err != nil || j.f.chunk.size() != j.chunk.size() {
+			// Digests are inconsistent with the sizes; fetch this chunk by itself.
+			missed[j.chunk] = j.w
+			continue
+		}
+		r, err := b.getCache(j.f.id, opts)
+		if err != nil {
+			missed[j.chunk] = j.w
+			continue
+		}
+		err = b.cacheChunkData(j.chunk, io.NewSectionReader(r, 0, j.chunk.size()), j.w, fr, opts)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+	return b.fetchRange(missed, opts)
+}
+
+// prefetchTOC starts fetching the uncached chunks of the TOC into the cache in
+// the background if p, read at offset, contains the footer and WithTOCPrefetch
+// is specified. This is best-effort; on failure, the TOC will be fetched by the
+// following read.
+func (b *blob) prefetchTOC(p []byte, offset int64, fr fetcher) {
+	if b.tocLocator == nil || b.tocFooterSize <= 0 {
+		return
+	}
+	size := b.currentSize()
+	footerOffset := size - b.tocFooterSize
+	if footerOffset <= 0 || offset > footerOffset || offset+int64(len(p)) < size {
+		return
+	}
+	tocOffset, err := b.tocLocator(p[footerOffset-offset : size-offset])
+	if err != nil || tocOffset < 0 || tocOffset >= footerOffset {
+		return
+	}
+	opts := b.backgroundOptions()
+	opts.fetcher = fr
+	tocData := make(map[region]io.Writer)
+	b.walkChunks(region{b.chunkAt(tocOffset).b, footerOffset - 1}, func(chunk region) error {
+		if r, err := b.getCache(fr.genID(chunk), opts); err == nil {
+			return r.Close() // nop if the cache hits
+		}
+		tocData[chunk] = io.Discard
+		return nil
+	})
+	if len(tocData) == 0 {
+		return
+	}
+	// Registered before returning so that Close waits for the prefetch.
+	if err := b.acquireFetch(); err != nil {
+		return
+	}
+	go func() {
+		defer b.releaseFetch()
+		if err := b.fetchRange(tocData, opts); err != nil {
+			log.L.WithError(err).Warnf("failed to prefetch TOC")
+		}
+	}()
+}
+
+// includeTrailingRegion adds the uncached chunks of the trailing region to data
+// if any of the chunks in data overlaps with it. This ensures that the trailing
+// gzip member and the footer are fetched together so that they can be
+// decompressed.
+func (b *blob) includeTrailingRegion(data map[region]io.Writer, fr fetcher, opts *options) {
+	size := b.currentSize()
+	if b.trailingRegionOffset <= 0 || b.trailingRegionOffset >= size {
+		return
+	}
+	var overlap bool
+	for reg := range data {
+		if reg.e >= b.trailingRegionOffset {
+			overlap = true
+			break
+		}
+	}
+	if !overlap {
+		return
+	}
+	tailReg := region{b.chunkAt(b.trailingRegionOffset).b, size - 1}
+	b.walkChunks(tailReg, func(chunk region) error {
+		if _, ok := data[chunk]; ok {
+			return nil
+		}
+		if r, err := b.getCache(fr.genID(chunk), opts); err == nil {
+			return r.Close() // nop if the cache hits
+		}
+		data[chunk] = io.Discard
+		return nil
+	})
+}
+
+// readAtInWindows reads the specified range to p sequentially, by windows of the
+// specified number of chunks. This bounds the number of chunks being fetched at
+// once and thus the peak memory used by a large read.
+func (b *blob) readAtInWindows(p []byte, offset int64, windowChunks int, fr fetcher, opts *options) error {
+	var (
+		end   = offset + int64(len(p))
+		cur   = offset
+		count int
+	)
+	if err := b.walkChunks(b.alignRegion(offset, int64(len(p))), func(chunk region) error {
+		if count++; count < windowChunks {
+			return nil
+		}
+		count = 0
+		windowEnd := chunk.e + 1
+		if windowEnd > end {
+			windowEnd = end
+		}
+		if err := b.readAt(p[cur-offset:windowEnd-offset], cur, fr, opts); err != nil {
+			return err
+		}
+		cur = windowEnd
+		return nil
+	}); err != nil {
+		return err
+	}
+	if cur < end {
+		return b.readAt(p[cur-offset:], cur, fr, opts)
+	}
+	return nil
+}
+
+// adjustBufferSize trims p according to the blob size.
+func (b *blob) adjustBufferSize(p []byte, offset int64) []byte {
+	if remain := b.currentSize() - offset; int64(len(p)) >= remain {
+		if remain < 0 {
+			remain = 0
+		}
+		p = p[:remain]
+	}
+	return p
+}
+
+// getCache returns the reader of the contents of id from the primary cache or,
+// if missed, from the first fallback cache having them.
+func (b *blob) getCache(id string, opts *options) (cache.Reader, error) {
+	r, err := b.cache.Get(id, opts.cacheOpts...)
+	if err == nil {
+		return r, nil
+	}
+	for _, c := range b.fallbackCaches {
+		if fr, ferr := c.Get(id, opts.cacheOpts...); ferr == nil {
+			return fr, nil
+		}
+	}
+	return nil, err
+}
+
+// readFromCache reads the part of the chunk from the cache to p. Chunks pinned
+// by FetchRegionAtomic are read from memory. The latency is reported to the
+// function specified by WithCacheLatencyFunc, if any. If the read takes longer
+// than the timeout specified by WithCacheTimeout, this gives up the read and
+// returns an error so that the chunk is fetched from the registry.
+func (b *blob) readFromCache(chunk region, p []byte, offset int64, fr fetcher, opts *options) (retErr error) {
+	_, span := b.startSpan(opts, "readFromCache",
+		attribute.Int64("offset", chunk.b+offset), attribute.Int("size", len(p)))
+	defer func() {
+		if span != nil {
+			span.SetAttributes(attribute.Bool("cache_hit", retErr == nil))
+		}
+		endSpan(span, nil) // a miss isn't an error of the read
+	}()
+	if data := b.pinnedData(chunk); data != nil {
+		copy(p, data[offset:])
+		atomic.AddInt64(&b.cacheHits, 1)
+		atomic.AddInt64(&b.cacheBytes, int64(len(p)))
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if opts.cacheTimeout > 0 {
+		err = b.readCacheWithTimeout(chunk, p, offset, fr, opts)
+	} else {
+		err = b.readCache(chunk, p, offset, fr, opts)
+	}
+	if opts.onCacheLatency != nil {
+		opts.onCacheLatency(time.Since(start))
+	}
+	if err != nil {
+		atomic.AddInt64(&b.cacheMisses, 1)
+		return err
+	}
+	atomic.AddInt64(&b.cacheHits, 1)
+	atomic.AddInt64(&b.cacheBytes, int64(len(p)))
+	if opts.auditSink != nil {
+		opts.auditSink.Record(AuditRecord{
+			Time:      start,
+			Range:     fmt.Sprintf("bytes=%d-%d", chunk.b+offset, chunk.b+offset+int64(len(p))-1),
+			Bytes:     int64(len(p)),
+			FromCache: true,
+		})
+	}
+	return nil
+}
+
+// readCacheWithTimeout is readCache but gives up after opts.cacheTimeout. The
+// cache is read to a temporary buffer so that the abandoned read doesn't write
+// to p.
+func (b *blob) readCacheWithTimeout(chunk region, p []byte, offset int64, fr fetcher, opts *options) error {
+	var (
+		buf  = make([]byte, len(p))
+		done = make(chan error, 1)
+	)
+	go func() {
+		done <- b.readCache(chunk, buf, offset, fr, opts)
+	}()
+	timer := time.NewTimer(opts.cacheTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		copy(p, buf)
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("reading chunk %+v from the cache %q timed out after %v", chunk, fr.genID(chunk), opts.cacheTimeout)
+	}
+}
+
+// readCache reads the part of the chunk from the cache (or the fallback
+// caches) to p. If the chunk is
+// missed in the cache but configured CacheIDRewriter gives a legacy ID of the
+// chunk, the entry cached with the legacy ID is migrated to the current ID.
+func (b *blob) readCache(chunk region, p []byte, offset int64, fr fetcher, opts *options) error {
+	id := fr.genID(chunk)
+	wrap := func(err error) error {
+		return fmt.Errorf("failed to read chunk %+v from the cache %q: %w", chunk, id, err)
+	}
+	r, err := b.getCache(id, opts)
+	if err != nil {
+		if b.cacheIDRewriter == nil {
+			return wrap(err)
+		}
+		legacyID, ok := b.cacheIDRewriter(id)
+		if !ok || legacyID == id {
+			return wrap(err)
+		}
+		if err := b.migrateCache(legacyID, id, chunk, opts); err != nil {
+			return wrap(err)
+		}
+		if r, err = b.getCache(id, opts); err != nil {
+			return wrap(err)
+		}
+	}
+	defer r.Close()
+	n, err := r.ReadAt(p, offset)
+	if err != nil && err != io.EOF {
+		return wrap(err)
+	}
+	if n != len(p) {
+		return wrap(&IncompleteCacheReadError{
+			ID:     id,
+			Region: Region{Offset: chunk.b + offset, Size: int64(len(p))},
+			Read:   int64(n),
+		})
+	}
+	if end := offset + int64(len(p)); end < chunk.size() {
+		// p doesn't reach the end of the chunk. Make sure that the whole chunk
+		// is cached so that a partially cached chunk isn't served as complete.
+		var last [1]byte
+		if n, err := r.ReadAt(last[:], chunk.size()-1); n != 1 {
+			if err != nil && err != io.EOF {
+				return wrap(err)
+			}
+			return wrap(&IncompleteCacheReadError{
+				ID:     id,
+				Region: Region{Offset: chunk.e, Size: 1},
+				Read:   int64(n),
+			})
+		}
+	}
+	return nil
+}
+
+// migrateCache copies the chunk cached with oldID to newID.
+func (b *blob) migrateCache(oldID, newID string, chunk region, opts *options) error {
+	r, err := b.cache.Get(oldID, opts.cacheOpts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cw, err := b.cache.Add(newID, opts.cacheOpts...)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	if _, err := io.CopyN(cw, io.NewSectionReader(r, 0, chunk.size()), chunk.size()); err != nil {
+		cw.Abort()
+		return fmt.Errorf("failed to migrate cache %q to %q: %w", oldID, newID, err)
+	}
+	if err := cw.Commit(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.cacheEntries, 1)
+	return nil
+}
+
+// Verify checks that the contents of the blob match the specified digest. Chunks
+// are read (from the cache or the registry) in parallel and fed to the hasher in
+// order. The parallelism can be configured with WithVerifyConcurrency.
+func (b *blob) Verify(dgst digest.Digest, opts ...Option) error {
+	if b.isClosed() {
+		return ErrBlobClosed
+	}
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	var verifyOpts options
+	for _, o := range opts {
+		o(&verifyOpts)
+	}
+	got, err := b.digest(dgst.Algorithm(), &verifyOpts)
+	if err != nil {
+		return err
+	}
+	if got != dgst {
+		return fmt.Errorf("invalid blob digest %v; want %v", got, dgst)
+	}
+	return nil
+}
+
+// digest computes the digest of the blob contents.
+func (b *blob) digest(alg digest.Algorithm, opts *options) (digest.Digest, error) {
+	concurrency := opts.verifyConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultVerifyConcurrency
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type chunkData struct {
+		data []byte
+		err  error
+	}
+	// pending holds results of chunks being read, in order. Its capacity bounds
+	// the number of chunks read in parallel.
+	pending := make(chan chan chunkData, concurrency)
+	go func() {
+		defer close(pending)
+		b.walkChunks(region{0, b.currentSize() - 1}, func(chunk region) error {
+			res := make(chan chunkData, 1)
+			select {
+			case pending <- res:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			go func() {
+				p := make([]byte, chunk.size())
+				n, err := b.ReadAt(p, chunk.b, withOptions(opts))
+				if err == nil && int64(n) != chunk.size() {
+					err = fmt.Errorf("unexpected size of chunk (%d, %d): %d", chunk.b, chunk.e, n)
+				}
+				res <- chunkData{p, err}
+			}()
+			return nil
+		})
+	}()
+
+	digester := alg.Digester()
+	for res := range pending {
+		c := <-res
+		if c.err != nil {
+			return "", fmt.Errorf("failed to read chunk for verification: %w", c.err)
+		}
+		if _, err := digester.Hash().Write(c.data); err != nil {
+			return "", err
+		}
+	}
+	return digester.Digest(), nil
+}
+
+// fetchRegions fetches all specified chunks from remote blob and puts it in the local cache.
+// It must be called from within fetchRange and need to ensure that it is inside the singleflight `Do` operation.
+func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]bool, opts *options) (retErr error) {
+	if len(allData) == 0 {
+		return nil
+	}
+	_, span := b.startSpan(opts, "fetchRegions", attribute.Int("regions", len(allData)))
+	var transferred int64
+	defer func() {
+		if span != nil {
+			span.SetAttributes(attribute.Int64("bytes", transferred))
+		}
+		endSpan(span, retErr)
+	}()
+	if err := b.acquireFetch(); err != nil {
+		return err
+	}
+	defer b.releaseFetch()
+	release, err := b.acquireFetchSlot(opts)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Fetcher can be suddenly updated so we take and use the snapshot of it for
+	// consistency.
+	fr, err := b.snapshotFetcher(opts)
+	if err != nil {
+		return err
+	}
+
+	if b.coalesceGap > 0 {
+		allData = b.fillGaps(allData)
+	}
+
+	// request missed regions
+	var req []region
+	for reg := range allData {
+		req = append(req, reg)
+		fetched[reg] = false
+	}
+
+	fetchCtx, cancel := b.fetchContext(opts)
+	defer cancel()
+	if span != nil {
+		fetchCtx = trace.ContextWithSpan(fetchCtx, span)
+	}
+	start := time.Now()
+	mr, err := b.fetchWithRetry(fetchCtx, fr, req, opts)
+	opts.readTimer.add(phaseFetch, time.Since(start))
+
+	if errors.Is(err, ErrRangeRejected) && len(req) > 1 {
+		// The registry rejected the coalesced request. Retry with smaller batches.
+		release() // the batches take the slots by themselves
+		return b.fetchRegionsInHalves(allData, req, fetched, opts)
+	} else if err != nil {
+		return newFetchError(req, fr, err)
+	}
+	defer mr.Close()
 
 	// Update the check timer because we succeeded to access the blob
 	b.lastCheckMu.Lock()
 	b.lastCheck = time.Now()
 	b.lastCheckMu.Unlock()
 
-	// chunk and cache responsed data. Regions must be aligned by chunk size.
-	// TODO: Reorganize remoteData to make it be aligned by chunk size
-	for {
-		reg, p, err := mr.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return fmt.Errorf("failed to read multipart resp: %w", err)
+	// The registry disallows storing the contents (Cache-Control: no-store).
+	// Deliver them to the callers only.
+	_, noStore := mr.(*noStoreReader)
+
+	// chunk and cache responsed data. Regions must be aligned by chunk size.
+	// Parts can cover more than the requested regions (e.g. the whole blob
+	// returned with 200 by registries ignoring Range); all of their chunks are
+	// cached and the requested ones are written to allData too.
+	// TODO: Reorganize remoteData to make it be aligned by chunk size
+	limiter := b.rateLimiter(opts)
+	maxParts := len(req) + b.maxExtraParts
+	for parts := 0; ; parts++ {
+		start := time.Now()
+		reg, p, err := mr.Next()
+		opts.readTimer.add(phaseFetch, time.Since(start))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return newFetchError(req, fr, fmt.Errorf("failed to read multipart resp: %w", err))
+		}
+		if parts >= maxParts {
+			return newFetchError(req, fr, &TooManyPartsError{Requested: len(req), Limit: maxParts})
+		}
+		if limiter != nil {
+			p = &throttledReader{r: p, l: limiter, ctx: fetchCtx}
+		}
+		if err := b.walkChunks(reg, func(chunk region) (retErr error) {
+			// If this chunk is one of the targets, write the content to the
+			// passed reader too.
+			var w io.Writer
+			if _, ok := fetched[chunk]; ok {
+				w = allData[chunk]
+			}
+			if noStore {
+				if w == nil {
+					w = io.Discard
+				}
+				start := time.Now()
+				if _, err := b.copyN(w, p, chunk.size(), opts); err != nil {
+					return err
+				}
+				opts.readTimer.add(phaseCopy, time.Since(start))
+				atomic.AddInt64(&b.fetchedBytes, chunk.size())
+				transferred += chunk.size()
+				fetched[chunk] = true
+				return nil
+			}
+			if err := b.cacheChunkData(chunk, p, w, fr, opts); err != nil {
+				return err
+			}
+			transferred += chunk.size()
+			fetched[chunk] = true
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to get chunks: %w", err)
+		}
+	}
+
+	// Check all chunks are fetched
+	var unfetched []region
+	for _, c := range req {
+		if !fetched[c] {
+			unfetched = append(unfetched, c)
+		}
+	}
+	if unfetched != nil {
+		return newFetchError(unfetched, fr, errors.New("missing in the response"))
+	}
+
+	return nil
+}
+
+// newFetchError returns the FetchError of the regions caused by err. err is
+// returned as is if it's already a FetchError.
+func newFetchError(regs []region, fr fetcher, err error) error {
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return err
+	}
+	fe = &FetchError{Regions: exportRegions(regs), Err: err}
+	if mf, ok := fr.(*multiFetcher); ok {
+		fr = mf.current()
+	}
+	if hf, ok := fr.(*httpFetcher); ok {
+		hf.urlMu.Lock()
+		fe.URL = hf.url
+		hf.urlMu.Unlock()
+	}
+	return fe
+}
+
+// rateLimiter returns the limiter of the bandwidth of the fetch, or nil if it's
+// unlimited.
+func (b *blob) rateLimiter(opts *options) RateLimiter {
+	if opts.readLimiter != nil {
+		return opts.readLimiter
+	}
+	if opts.background {
+		return b.backgroundLimiter
+	}
+	return b.foregroundLimiter
+}
+
+// throttledReader reads r at the rate allowed by l. Waiting for l is aborted when
+// ctx is done.
+type throttledReader struct {
+	r   io.Reader
+	l   RateLimiter
+	ctx context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.l.Burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if wErr := t.l.WaitN(t.ctx, n); wErr != nil {
+			return n, wErr
+		}
+	}
+	return n, err
+}
+
+// fillGaps returns allData with the chunks in the gaps of at most coalesceGap
+// bytes between the regions. The contents of the added chunks are only cached.
+func (b *blob) fillGaps(allData map[region]io.Writer) map[region]io.Writer {
+	regs := make([]region, 0, len(allData))
+	for reg := range allData {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].b < regs[j].b })
+	var filled map[region]io.Writer
+	for i := 1; i < len(regs); i++ {
+		gap := regs[i].b - regs[i-1].e - 1
+		if gap <= 0 || gap > b.coalesceGap {
+			continue
+		}
+		if filled == nil {
+			filled = make(map[region]io.Writer, len(allData))
+			for reg, w := range allData {
+				filled[reg] = w
+			}
+		}
+		b.walkChunks(region{regs[i-1].e + 1, regs[i].b - 1}, func(chunk region) error {
+			if _, ok := filled[chunk]; !ok {
+				filled[chunk] = io.Discard
+			}
+			return nil
+		})
+	}
+	if filled == nil {
+		return allData
+	}
+	return filled
+}
+
+// fetchRegionsInHalves fetches the regions in two batches, each of them fetched
+// by fetchRegions which halves it again on the rejection of the range.
+func (b *blob) fetchRegionsInHalves(allData map[region]io.Writer, req []region, fetched map[region]bool, opts *options) error {
+	sort.Slice(req, func(i, j int) bool { return req[i].b < req[j].b })
+	for _, batch := range [][]region{req[:len(req)/2], req[len(req)/2:]} {
+		data := make(map[region]io.Writer, len(batch))
+		for _, reg := range batch {
+			data[reg] = allData[reg]
+		}
+		if err := b.fetchRegions(data, fetched, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxFetchRetryDelay caps the backoff between the retries of a fetch.
+const maxFetchRetryDelay = 30 * time.Second
+
+// fetchWithRetry fetches the regions and retries it on a server error or a
+// network error, as configured with withFetchRetries or WithFetchRetries. The
+// delay between attempts is computed by fetchBackoff (newBackoffStrategy, a
+// random duration in [0, baseDelay * 2^(n-1)]). This gives up early if ctx is
+// done or its deadline comes before the next attempt.
+//
+// If these retries are enabled, the retries of the transport (MaxRetries of the
+// config) are disabled for the fetches so that the attempts of the two don't
+// multiply.
+func (b *blob) fetchWithRetry(ctx context.Context, fr fetcher, req []region, opts *options) (multipartReadCloser, error) {
+	maxAttempts, baseDelay := b.fetchMaxAttempts, b.fetchRetryBaseDelay
+	if opts.fetchMaxAttempts > 0 {
+		maxAttempts, baseDelay = opts.fetchMaxAttempts, opts.fetchRetryBaseDelay
+	}
+	if maxAttempts > 1 {
+		ctx = withoutTransportRetries(ctx)
+	}
+	backoff := b.fetchBackoff
+	if backoff == nil {
+		backoff = backoffStrategy
+	}
+	for attempt := 1; ; attempt++ {
+		mr, err := fr.fetch(ctx, req, true)
+		atomic.AddInt64(&b.roundTrips, 1)
+		if err == nil || attempt >= maxAttempts || !isRetryableFetchError(err) {
+			return mr, err
+		}
+		delay := backoff(baseDelay, maxFetchRetryDelay, attempt-1, nil)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// isRetryableFetchError returns true if the fetch failed with a server error
+// (5xx) or a network error.
+func isRetryableFetchError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var fe *FetchError
+	if errors.As(err, &fe) && fe.StatusCode != 0 {
+		return fe.StatusCode/100 == 5
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// startSpan starts the span of an operation as a child of the span of opts
+// (opts.spanCtx or opts.ctx). The returned context carries the new span. If the
+// blob has no tracer, it returns opts.spanCtx and a nil span.
+func (b *blob) startSpan(opts *options, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if b.tracer == nil {
+		return opts.spanCtx, nil
+	}
+	parent := opts.spanCtx
+	if parent == nil {
+		parent = opts.ctx
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+	return b.tracer.Start(parent, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err if non-nil. span can be nil.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fetchContext returns the context used for fetching contents from the registry.
+// This is opts.ctx if specified. Otherwise, this times out after fetchTimeout.
+// The timeout specified by WithFetchTimeout overrides fetchTimeout for the call.
+func (b *blob) fetchContext(opts *options) (context.Context, context.CancelFunc) {
+	parent, timeout := context.Background(), b.fetchTimeout
+	if opts.ctx != nil {
+		parent, timeout = opts.ctx, 0
+	}
+	if opts.fetchTimeout > 0 {
+		timeout = opts.fetchTimeout
+	}
+	fetchCtx, cancel := parent, context.CancelFunc(func() {})
+	if timeout > 0 {
+		fetchCtx, cancel = context.WithTimeout(parent, timeout)
+	}
+	if opts.authRefresher != nil {
+		fetchCtx = withAuthRefresher(fetchCtx, opts.authRefresher)
+	}
+	if opts.requestCount != nil {
+		fetchCtx = withRequestCounter(fetchCtx, opts.requestCount)
+	}
+	if opts.auditSink != nil {
+		fetchCtx = withAuditSink(fetchCtx, opts.auditSink)
+	}
+	if opts.priority != PriorityDefault {
+		fetchCtx = withPriority(fetchCtx, opts.priority)
+	}
+	if opts.maxPartHeaderSize > 0 {
+		fetchCtx = withMaxPartHeaderSize(fetchCtx, opts.maxPartHeaderSize)
+	}
+	return fetchCtx, cancel
+}
+
+// cacheChunkData reads the chunk from r and adds it to the cache. If w is non-nil,
+// the content is written to w too.
+func (b *blob) cacheChunkData(chunk region, r io.Reader, w io.Writer, fr fetcher, opts *options) error {
+	id := fr.genID(chunk)
+	if opts.prefetch {
+		// Stop adding churn to the cache under the eviction pressure.
+		if b.evictionPressure(opts.prefetchTracker) {
+			return ErrEvictionPressure
+		}
+		b.trackPrefetched(opts.prefetchTracker, id)
+	}
+	if async, release := b.acquireCacheFill(opts); async {
+		return b.cacheChunkDataAsync(chunk, id, r, w, release, opts)
+	}
+
+	// Coordinate with the concurrent writes of the same chunk (e.g. by Cache
+	// and ReadAt fetching the same chunk in different requests) so that the
+	// chunk is added to the cache only once.
+	var added bool
+	_, err, _ := b.cacheAddGroup.Do(id, func() (interface{}, error) {
+		added = true
+		return nil, b.addChunkData(chunk, id, r, w, opts)
+	})
+	if added {
+		return err
+	} else if err != nil {
+		// The other write failed. Try it by ourselves.
+		return b.addChunkData(chunk, id, r, w, opts)
+	}
+
+	// The other caller has just cached the same contents.
+	if w == nil {
+		w = io.Discard
+	}
+	if _, err := b.copyN(w, r, chunk.size(), opts); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.fetchedBytes, chunk.size())
+	return nil
+}
+
+// addChunkData reads the chunk from r and adds it to the cache with the ID. If w
+// is non-nil, the content is written to w too.
+func (b *blob) addChunkData(chunk region, id string, r io.Reader, w io.Writer, opts *options) error {
+	// The time other than copying is taken by the cache.
+	var copyTime time.Duration
+	defer func(start time.Time) {
+		opts.readTimer.add(phaseCopy, copyTime)
+		opts.readTimer.add(phaseCommit, time.Since(start)-copyTime)
+	}(time.Now())
+	cw, err := b.cache.Add(id, opts.cacheOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to add chunk %+v to the cache %q: %w", chunk, id, err)
+	}
+	defer cw.Close()
+	want, digester := b.chunkDigester(chunk)
+	if digester != nil {
+		r = io.TeeReader(r, digester.Hash())
+	}
+	var fetched *bytes.Buffer
+	if w == nil && !opts.writeVerify {
+		// Copy the target chunk
+		start := time.Now()
+		if _, err := b.copyN(cw, r, chunk.size(), opts); err != nil {
+			cw.Abort()
+			return err
+		}
+		copyTime = time.Since(start)
+	} else {
+		// Buffer the target chunk so that the caller gets the contents without
+		// waiting for the cache, which can be slower than the registry.
+		buf := b.getChunkBuffer(chunk.size())
+		defer b.putChunkBuffer(buf)
+		fetched = bytes.NewBuffer((*buf)[:0])
+		dst := io.Writer(fetched)
+		if w != nil {
+			dst = io.MultiWriter(w, fetched)
+		}
+		start := time.Now()
+		if _, err := b.copyN(dst, r, chunk.size(), opts); err != nil {
+			cw.Abort()
+			return err
+		}
+		copyTime = time.Since(start)
+		if _, err := cw.Write(fetched.Bytes()); err != nil {
+			cw.Abort()
+			return err
+		}
+	}
+	atomic.AddInt64(&b.fetchedBytes, chunk.size())
+	if digester != nil {
+		if got := digester.Digest(); got != want {
+			cw.Abort()
+			return &ChunkDigestMismatchError{Region: Region{Offset: chunk.b, Size: chunk.size()}, Expected: want, Actual: got}
+		}
+	}
+	if fetched != nil {
+		if opts.fetchPin != nil {
+			opts.fetchPin.add(chunk, append([]byte(nil), fetched.Bytes()...))
+		}
+		if !opts.writeVerify {
+			fetched = nil
+		}
+	}
+
+	// Add the target chunk to the cache
+	if err := cw.Commit(); err != nil {
+		atomic.AddInt64(&b.commitFailures, 1)
+		if w != nil && b.ignoreCommitErrors {
+			// The caller already got the contents.
+			log.L.WithError(err).Warnf("failed to commit chunk %+v to the cache %q", chunk, id)
+			return nil
+		}
+		return fmt.Errorf("failed to commit chunk %+v to the cache %q: %w", chunk, id, err)
+	}
+	atomic.AddInt64(&b.cacheEntries, 1)
+	if fetched != nil {
+		if err := b.verifyCached(id, fetched.Bytes(), opts); err != nil {
+			return fmt.Errorf("failed to verify cached chunk %+v in the cache %q: %w", chunk, id, err)
+		}
+	}
+
+	b.markCached(chunk)
+	return nil
+}
+
+// chunkDigester returns the expected digest of the chunk and the digester to
+// verify the fetched contents with (see WithChunkVerification). The digester is
+// nil if the chunk isn't verified.
+func (b *blob) chunkDigester(chunk region) (digest.Digest, digest.Digester) {
+	if b.chunkVerifier == nil {
+		return "", nil
+	}
+	dgst, ok := b.chunkVerifier.ChunkDigest(chunk.b)
+	if !ok || !dgst.Algorithm().Available() {
+		return "", nil
+	}
+	return dgst, dgst.Algorithm().Digester()
+}
+
+// getChunkBuffer returns a buffer with the capacity of at least n bytes. The
+// buffer should be returned by putChunkBuffer.
+func (b *blob) getChunkBuffer(n int64) *[]byte {
+	if b.bufPool != nil {
+		if buf, ok := b.bufPool.Get().(*[]byte); ok && int64(cap(*buf)) >= n {
+			return buf
+		} else if ok {
+			b.bufPool.Put(buf)
+		}
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+// putChunkBuffer returns the buffer taken by getChunkBuffer.
+func (b *blob) putChunkBuffer(buf *[]byte) {
+	if b.bufPool != nil && int64(len(*buf)) == b.chunkSize {
+		b.bufPool.Put(buf)
+	}
+}
+
+// acquireCacheFill returns true if the chunk can be written to the cache in the
+// background (see WithAsyncCacheFill). The returned function must be called when
+// the write finishes.
+func (b *blob) acquireCacheFill(opts *options) (bool, func()) {
+	if b.cacheFillSem == nil || opts.prefetch || !b.cacheFillSem.TryAcquire(1) {
+		return false, nil
+	}
+	// Close waits for the background write.
+	if err := b.acquireFetch(); err != nil {
+		b.cacheFillSem.Release(1)
+		return false, nil
+	}
+	return true, func() {
+		b.releaseFetch()
+		b.cacheFillSem.Release(1)
+	}
+}
+
+// cacheChunkDataAsync reads the chunk from r, writes it to w if non-nil and adds
+// it to the cache in the background. Errors of the background write are logged.
+func (b *blob) cacheChunkDataAsync(chunk region, id string, r io.Reader, w io.Writer, release func(), opts *options) error {
+	buf := bytes.NewBuffer(make([]byte, 0, chunk.size()))
+	if _, err := b.copyN(buf, r, chunk.size(), opts); err != nil {
+		release()
+		return err
+	}
+	atomic.AddInt64(&b.fetchedBytes, chunk.size())
+	if w != nil {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			release()
+			return err
+		}
+	}
+	opts.fetchPin.add(chunk, buf.Bytes())
+	go func() {
+		defer release()
+		if err := b.addToCache(chunk, id, buf.Bytes(), opts); err != nil {
+			log.L.WithError(err).Warnf("failed to cache chunk %+v in the background", chunk)
+		}
+	}()
+	return nil
+}
+
+// addToCache adds the contents of the chunk to the cache.
+func (b *blob) addToCache(chunk region, id string, data []byte, opts *options) error {
+	cw, err := b.cache.Add(id, opts.cacheOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to add chunk %+v to the cache %q: %w", chunk, id, err)
+	}
+	defer cw.Close()
+	if want, digester := b.chunkDigester(chunk); digester != nil {
+		digester.Hash().Write(data)
+		if got := digester.Digest(); got != want {
+			cw.Abort()
+			return &ChunkDigestMismatchError{Region: Region{Offset: chunk.b, Size: chunk.size()}, Expected: want, Actual: got}
+		}
+	}
+	if _, err := cw.Write(data); err != nil {
+		cw.Abort()
+		return err
+	}
+	if err := cw.Commit(); err != nil {
+		return fmt.Errorf("failed to commit chunk %+v to the cache %q: %w", chunk, id, err)
+	}
+	atomic.AddInt64(&b.cacheEntries, 1)
+	if opts.writeVerify {
+		if err := b.verifyCached(id, data, opts); err != nil {
+			return fmt.Errorf("failed to verify cached chunk %+v in the cache %q: %w", chunk, id, err)
+		}
+	}
+	b.markCached(chunk)
+	return nil
+}
+
+// markCached records that the chunk is cached.
+func (b *blob) markCached(chunk region) {
+	b.fetchedRegionSetMu.Lock()
+	b.fetchedRegionSet.add(chunk)
+	total := b.fetchedRegionSet.totalSize()
+	atomic.StoreInt64(&b.fetchedTotal, total)
+	fullyCached := !b.fullyCached && total >= b.currentSize()
+	if fullyCached {
+		b.fullyCached = true
+	}
+	b.fetchedRegionSetMu.Unlock()
+	if fullyCached && b.onFullyCached != nil {
+		b.onFullyCached()
+	}
+}
+
+// copyN is io.CopyN but uses a scratch buffer taken from the pool specified by
+// WithBufferPool or, by default, the pool of the blob.
+func (b *blob) copyN(dst io.Writer, src io.Reader, n int64, opts *options) (int64, error) {
+	pool := opts.bufPool
+	if pool == nil {
+		pool = b.bufPool
+	}
+	if pool == nil {
+		return io.CopyN(dst, src, n)
+	}
+	buf, ok := pool.Get().(*[]byte)
+	if !ok || buf == nil || len(*buf) == 0 {
+		return io.CopyN(dst, src, n)
+	}
+	defer pool.Put(buf)
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), *buf)
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		// src stopped early; must be EOF.
+		err = io.EOF
+	}
+	return written, err
+}
+
+// verifyCached reads the cached contents of id and compares them to want.
+func (b *blob) verifyCached(id string, want []byte, opts *options) error {
+	r, err := b.cache.Get(id, opts.cacheOpts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	got := make([]byte, len(want))
+	if n, err := r.ReadAt(got, 0); n != len(got) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("cached contents differ from the fetched contents")
+	}
+	return nil
+}
+
+// ReadTail returns the last n bytes of the blob, or the whole blob if it's smaller
+// than n. This is useful for reading the footer of the layer (e.g. TOC of eStargz).
+// Unless the tail is already fetched, this fetches it in one suffix-range request
+// ("bytes=-n") and caches the chunks fully contained in the response. If the
+// registry rejects suffix ranges, this falls back to ReadAt based on the size.
+func (b *blob) ReadTail(n int64, opts ...Option) ([]byte, error) {
+	if b.isClosed() {
+		return nil, ErrBlobClosed
+	}
+	if size := b.currentSize(); n > size {
+		n = size
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	p := make([]byte, n)
+	var tailOpts options
+	for _, o := range opts {
+		o(&tailOpts)
+	}
+	offset := b.currentSize() - n
+	if b.isFetched(region{offset, offset + n - 1}) {
+		m, err := b.ReadFull(p, offset, opts...)
+		return p[:m], err
+	}
+	m, err := b.fetchTail(p, &tailOpts)
+	if errors.Is(err, ErrRangeRejected) {
+		log.L.WithError(err).Debugf("suffix range rejected; falling back to reading by offset")
+		m, err = b.ReadFull(p, offset, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p[:m], nil
+}
+
+// isFetched returns true if the whole reg is contained in the fetched regions.
+func (b *blob) isFetched(reg region) bool {
+	b.fetchedRegionSetMu.Lock()
+	defer b.fetchedRegionSetMu.Unlock()
+	for _, r := range b.fetchedRegionSet.rs {
+		if r.b <= reg.b && reg.e <= r.e {
+			return true
 		}
-		if err := b.walkChunks(reg, func(chunk region) (retErr error) {
-			id := fr.genID(chunk)
-			cw, err := b.cache.Add(id, opts.cacheOpts...)
-			if err != nil {
-				return err
-			}
-			defer cw.Close()
-			w := io.Writer(cw)
+	}
+	return false
+}
 
-			// If this chunk is one of the targets, write the content to the
-			// passed reader too.
-			if _, ok := fetched[chunk]; ok {
-				w = io.MultiWriter(w, allData[chunk])
-			}
+// fetchTail fetches the last len(p) bytes of the blob to p using a suffix-range
+// request if the fetcher supports it. Chunks fully contained in the response are
+// added to the cache at their absolute offsets learned from the response.
+func (b *blob) fetchTail(p []byte, opts *options) (int, error) {
+	size := b.currentSize()
+	n := int64(len(p))
+	if n > size {
+		n = size
+		p = p[:n]
+	}
+	if n == 0 {
+		return 0, nil
+	}
 
-			// Copy the target chunk
-			if _, err := io.CopyN(w, p, chunk.size()); err != nil {
-				cw.Abort()
-				return err
-			}
+	fr, err := b.snapshotFetcher(opts)
+	if err != nil {
+		return 0, err
+	}
+	tf, ok := fr.(tailFetcher)
+	if !ok {
+		return b.ReadAt(p, size-n, withOptions(opts))
+	}
 
-			// Add the target chunk to the cache
-			if err := cw.Commit(); err != nil {
-				return err
-			}
+	if err := b.acquireFetch(); err != nil {
+		return 0, err
+	}
+	defer b.releaseFetch()
+	release, err := b.acquireFetchSlot(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
 
-			b.fetchedRegionSetMu.Lock()
-			b.fetchedRegionSet.add(chunk)
-			b.fetchedRegionSetMu.Unlock()
-			fetched[chunk] = true
-			return nil
-		}); err != nil {
-			return fmt.Errorf("failed to get chunks: %w", err)
-		}
+	fetchCtx, cancel := b.fetchContext(opts)
+	defer cancel()
+	mr, blobSize, err := tf.fetchTail(fetchCtx, n)
+	atomic.AddInt64(&b.roundTrips, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer mr.Close()
+	if blobSize < size {
+		return 0, fmt.Errorf("%w: size %d; want %d", ErrBlobShrank, blobSize, size)
+	} else if blobSize != size {
+		return 0, fmt.Errorf("unexpected blob size %d; want %d", blobSize, size)
+	}
+	reg, r, err := mr.Next()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read tail resp: %w", err)
+	}
+	if reg.e != size-1 || reg.b > size-n {
+		return 0, fmt.Errorf("unexpected tail region (%d, %d) for %d bytes", reg.b, reg.e, n)
 	}
 
-	// Check all chunks are fetched
-	var unfetched []region
-	for c, b := range fetched {
-		if !b {
-			unfetched = append(unfetched, c)
-		}
+	// Skip bytes not requested (servers may return the whole blob).
+	if _, err := io.CopyN(io.Discard, r, size-n-reg.b); err != nil {
+		return 0, err
 	}
-	if unfetched != nil {
-		return fmt.Errorf("failed to fetch region %v", unfetched)
+	reg.b = size - n
+	dest := newBytesWriter(p, 0)
+	if err := b.walkChunks(b.alignRegion(reg.b, n), func(chunk region) error {
+		if chunk.b < reg.b {
+			// The beginning of this chunk isn't contained in the response so
+			// we don't cache it.
+			_, err := io.CopyN(dest, r, chunk.e+1-reg.b)
+			return err
+		}
+		return b.cacheChunkData(chunk, r, dest, fr, opts)
+	}); err != nil {
+		return 0, fmt.Errorf("failed to get chunks: %w", err)
 	}
 
-	return nil
+	b.lastCheckMu.Lock()
+	b.lastCheck = time.Now()
+	b.lastCheckMu.Unlock()
+
+	return int(n), nil
 }
 
 // fetchRange fetches all specified chunks from local cache and remote blob.
@@ -411,76 +3661,564 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 	// We build a key based on regions we need to fetch and pass it to singleflightGroup.Do(...)
 	// to block simultaneous same requests. Once the request is finished and the data is ready,
 	// all blocked callers will be unblocked and that same data will be returned by all blocked callers.
-	key := makeSyncKey(allData)
+	key := b.syncKey(allData)
+	pin := b.pinFetch(key)
+	defer b.unpinFetch(key)
 	fetched := make(map[region]bool)
+	var leader bool
 	_, err, shared := b.fetchedRegionGroup.Do(key, func() (interface{}, error) {
-		return nil, b.fetchRegions(allData, fetched, opts)
+		leader = true
+		defer b.beginFetch(key, allData)()
+		fetchOpts := opts
+		if pin != nil {
+			o := *opts
+			o.fetchPin = pin
+			fetchOpts = &o
+		}
+		return nil, b.fetchRegions(allData, fetched, fetchOpts)
 	})
+	if leader {
+		atomic.AddInt64(&b.leaderFetches, 1)
+	} else if shared {
+		atomic.AddInt64(&b.sharedFetches, 1)
+	}
 
 	// When unblocked try to read from cache in case if there were no errors
 	// If we fail reading from cache, fetch from remote registry again
 	if err == nil && shared {
-		for reg := range allData {
-			if _, ok := fetched[reg]; ok {
-				continue
-			}
-			err = b.walkChunks(reg, func(chunk region) error {
-				b.fetcherMu.Lock()
-				fr := b.fetcher
-				b.fetcherMu.Unlock()
-
-				// Check if the content exists in the cache
-				// And if exists, read from cache
-				r, err := b.cache.Get(fr.genID(chunk), opts.cacheOpts...)
-				if err != nil {
-					return err
-				}
-				defer r.Close()
-				rr := io.NewSectionReader(r, 0, chunk.size())
+		return b.handleSharedFetch(allData, fetched, pin, opts)
+	}
+
+	return err
+}
+
+// fetchPin holds the chunks fetched by the leader of a shared fetch until all
+// the callers sharing the fetch copy them.
+type fetchPin struct {
+	refs     int // guarded by blob.fetchPinsMu
+	chunks   map[region][]byte
+	chunksMu sync.Mutex
+}
+
+func (p *fetchPin) add(chunk region, data []byte) {
+	if p == nil {
+		return
+	}
+	p.chunksMu.Lock()
+	p.chunks[chunk] = data
+	p.chunksMu.Unlock()
+}
+
+func (p *fetchPin) get(chunk region) []byte {
+	if p == nil {
+		return nil
+	}
+	p.chunksMu.Lock()
+	defer p.chunksMu.Unlock()
+	return p.chunks[chunk]
+}
+
+// pinFetch joins the caller to the pin of the fetch of the key. unpinFetch must
+// be called when the caller finishes. This returns nil unless WithFetchPinning
+// is specified.
+func (b *blob) pinFetch(key string) *fetchPin {
+	if !b.fetchPinning {
+		return nil
+	}
+	b.fetchPinsMu.Lock()
+	defer b.fetchPinsMu.Unlock()
+	if b.fetchPins == nil {
+		b.fetchPins = make(map[string]*fetchPin)
+	}
+	p, ok := b.fetchPins[key]
+	if !ok {
+		p = &fetchPin{chunks: make(map[region][]byte)}
+		b.fetchPins[key] = p
+	}
+	p.refs++
+	return p
+}
+
+// unpinFetch releases the pin taken by pinFetch. The chunks are released once
+// all callers are released.
+func (b *blob) unpinFetch(key string) {
+	if !b.fetchPinning {
+		return
+	}
+	b.fetchPinsMu.Lock()
+	defer b.fetchPinsMu.Unlock()
+	if p, ok := b.fetchPins[key]; ok {
+		if p.refs--; p.refs <= 0 {
+			delete(b.fetchPins, key)
+		}
+	}
+}
+
+// handleSharedFetch copies the data fetched by another caller in the singleflight
+// group from the cache. If it fails, this fetches the data again unless
+// WithoutSharedFetchRetry is specified.
+func (b *blob) handleSharedFetch(allData map[region]io.Writer, fetched map[region]bool, pin *fetchPin, opts *options) error {
+	if err := b.copyFetchedChunks(allData, fetched, pin, opts); err != nil {
+		if opts.noSharedFetchRetry {
+			return fmt.Errorf("failed to read shared fetch result from cache: %w", err)
+		}
+		// if we cannot read the data from cache, do fetch again
+		return b.fetchRange(allData, opts)
+	}
+	return nil
+}
 
-				// Copy the target chunk
+// copyFetchedChunks copies the chunks in allData, which aren't fetched by this
+// caller, from the pin of the fetch or the cache.
+func (b *blob) copyFetchedChunks(allData map[region]io.Writer, fetched map[region]bool, pin *fetchPin, opts *options) error {
+	for reg := range allData {
+		if _, ok := fetched[reg]; ok {
+			continue
+		}
+		if err := b.walkChunks(reg, func(chunk region) error {
+			if data := pin.get(chunk); data != nil {
 				b.fetchedRegionCopyMu.Lock()
 				defer b.fetchedRegionCopyMu.Unlock()
-				if _, err := io.CopyN(allData[chunk], rr, chunk.size()); err != nil {
-					return err
-				}
-				return nil
-			})
+				_, err := allData[chunk].Write(data)
+				return err
+			}
+
+			fr, err := b.snapshotFetcher(opts)
 			if err != nil {
-				break
+				return err
 			}
-		}
 
-		// if we cannot read the data from cache, do fetch again
-		if err != nil {
-			return b.fetchRange(allData, opts)
+			// Check if the content exists in the cache
+			// And if exists, read from cache
+			r, err := b.getCache(fr.genID(chunk), opts)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			rr := io.NewSectionReader(r, 0, chunk.size())
+
+			// Copy the target chunk
+			b.fetchedRegionCopyMu.Lock()
+			defer b.fetchedRegionCopyMu.Unlock()
+			if n, err := b.copyN(allData[chunk], rr, chunk.size(), opts); err == io.EOF {
+				return &IncompleteCacheReadError{
+					ID:     fr.genID(chunk),
+					Region: Region{Offset: chunk.b, Size: chunk.size()},
+					Read:   n,
+				}
+			} else if err != nil {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
-
-	return err
+	return nil
 }
 
 type walkFunc func(reg region) error
 
 // walkChunks walks chunks from begin to end in order in the specified region.
-// specified region must be aligned by chunk size.
+// specified region must be aligned by chunk size. walkFn mustn't be retained
+// after the walk so that the closures of the callers don't escape to the heap.
 func (b *blob) walkChunks(allRegion region, walkFn walkFunc) error {
-	if allRegion.b%b.chunkSize != 0 {
+	if b.chunkAt(allRegion.b).b != allRegion.b {
 		return fmt.Errorf("region (%d, %d) must be aligned by chunk size",
 			allRegion.b, allRegion.e)
 	}
-	for i := allRegion.b; i <= allRegion.e && i < b.size; i += b.chunkSize {
-		reg := region{i, i + b.chunkSize - 1}
-		if reg.e >= b.size {
-			reg.e = b.size - 1
-		}
+	// The size is read on each iteration so that the walk ends safely when the
+	// blob is updated to be smaller.
+	for i := allRegion.b; i <= allRegion.e && i < b.currentSize(); {
+		reg := b.chunkAt(i)
 		if err := walkFn(reg); err != nil {
 			return err
 		}
+		i = reg.e + 1
+	}
+	return nil
+}
+
+// chunkAt returns the chunk which contains the specified offset. If the
+// ChunkBoundaryProvider is configured, the chunk is aligned to the boundary it
+// returns. Otherwise, the chunk is aligned by the chunk size. The last chunk
+// ends at size-1 so that the fetch of the tail doesn't request the range beyond
+// the blob, which registries reject with 416.
+func (b *blob) chunkAt(offset int64) region {
+	size := b.currentSize()
+	reg := region{floor(offset, b.chunkSize), ceil(offset, b.chunkSize) - 1}
+	if b.chunkBoundary != nil && 0 <= offset && offset < size {
+		if begin, end := b.chunkBoundary.ChunkBoundary(offset); begin <= offset && offset <= end {
+			reg = region{begin, end}
+		}
+	}
+	if reg.e >= size && reg.b < size {
+		reg.e = size - 1
+	}
+	return reg
+}
+
+// alignRegion returns the smallest chunk-aligned region which contains the
+// specified range.
+func (b *blob) alignRegion(offset int64, size int64) region {
+	return region{b.chunkAt(offset).b, b.chunkAt(offset + size - 1).e}
+}
+
+// SharedCache is a cache shared by multiple blobs, e.g. the blobs of the layers
+// with identical contents. Combined with an IDGenerator which generates the IDs
+// from the content (see WithIDGenerator), the blobs reuse the chunks fetched by
+// each other. Each blob must be given its own handle returned by Share, and the
+// underlying cache is closed when all of the handles are closed. The handles
+// don't implement EvictionNotifier even if the underlying cache does.
+type SharedCache struct {
+	cache cache.BlobCache
+	refs  int
+	mu    sync.Mutex
+}
+
+// NewSharedCache returns the SharedCache of c. c mustn't be closed directly.
+func NewSharedCache(c cache.BlobCache) *SharedCache {
+	return &SharedCache{cache: c}
+}
+
+// Share returns a new handle of the cache, to be passed to a blob. Closing the
+// handle releases the reference to the cache.
+func (c *SharedCache) Share() cache.BlobCache {
+	c.mu.Lock()
+	c.refs++
+	c.mu.Unlock()
+	return &sharedCacheRef{BlobCache: c.cache, shared: c}
+}
+
+func (c *SharedCache) release() error {
+	c.mu.Lock()
+	c.refs--
+	last := c.refs == 0
+	c.mu.Unlock()
+	if last {
+		return c.cache.Close()
+	}
+	return nil
+}
+
+// sharedCacheRef is a handle of SharedCache.
+type sharedCacheRef struct {
+	cache.BlobCache
+	shared *SharedCache
+	once   sync.Once
+}
+
+func (r *sharedCacheRef) Close() (err error) {
+	r.once.Do(func() {
+		err = r.shared.release()
+	})
+	return err
+}
+
+// packingCache wraps the cache of a blob whose cache entries are capped (see
+// WithMaxCacheEntries). This counts the entries added to the cache and packs the
+// chunks added after the threshold into larger entries.
+//
+// Each pack begins with the index of its chunks (packHeader) so that the packs
+// are loaded by newPackingCache when the blob is recreated. The packs of a blob
+// are stored under the keys numbered from zero (see packKey).
+type packingCache struct {
+	cache.BlobCache
+	maxEntries int
+	chunks     int    // number of the chunks of the blob
+	base       string // base of the keys of the packs; unique to the blob
+	entries    int64
+
+	mu       sync.Mutex
+	added    int                    // number of the chunks added
+	index    map[string]packedChunk // location of the packed chunks
+	pending  *pendingPack
+	nextPack int // number of the next pack
+}
+
+type packedChunk struct {
+	key    string // key of the pack
+	offset int64
+	size   int64
+}
+
+// packHeader is the index of the chunks in a pack, encoded in JSON following
+// its length (8 bytes in big endian) at the head of the pack. The offsets are
+// relative to the end of the header.
+type packHeader struct {
+	Chunks []packHeaderChunk `json:"chunks"`
+}
+
+type packHeaderChunk struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// maxPackHeaderSize limits the header of a pack read from the cache.
+const maxPackHeaderSize = 16 << 20
+
+// pendingPack is a pack being filled.
+type pendingPack struct {
+	capacity int
+	keys     []string
+	index    map[string]packedChunk
+	buf      bytes.Buffer
+}
+
+func newPackingCache(c cache.BlobCache, maxEntries, chunks int, base string) *packingCache {
+	pc := &packingCache{
+		BlobCache:  c,
+		maxEntries: maxEntries,
+		chunks:     chunks,
+		base:       base,
+		index:      make(map[string]packedChunk),
+	}
+	// Load the packs added before. This stops at the first missing pack (e.g.
+	// evicted); the chunks in the following packs are refetched.
+	for ; ; pc.nextPack++ {
+		if !pc.loadPack(pc.packKey(pc.nextPack)) {
+			break
+		}
+	}
+	return pc
+}
+
+// packKey returns the key of the n-th pack.
+func (c *packingCache) packKey(n int) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("pack:%s:%d", c.base, n))))
+}
+
+// loadPack adds the chunks in the pack to the index. This returns false if the
+// pack can't be read.
+func (c *packingCache) loadPack(key string) bool {
+	r, err := c.BlobCache.Get(key)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	sr := io.NewSectionReader(r, 0, math.MaxInt64)
+	var lenBuf [8]byte
+	if _, err := io.ReadFull(sr, lenBuf[:]); err != nil {
+		log.L.WithError(err).Warnf("failed to read the header of pack %q", key)
+		return false
+	}
+	n := binary.BigEndian.Uint64(lenBuf[:])
+	if n > maxPackHeaderSize {
+		log.L.Warnf("the header of pack %q is too large (%d bytes)", key, n)
+		return false
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(sr, buf); err != nil {
+		log.L.WithError(err).Warnf("failed to read the header of pack %q", key)
+		return false
+	}
+	var h packHeader
+	if err := json.Unmarshal(buf, &h); err != nil {
+		log.L.WithError(err).Warnf("failed to parse the header of pack %q", key)
+		return false
+	}
+	dataOffset := int64(len(lenBuf)) + int64(n)
+	for _, hc := range h.Chunks {
+		c.index[hc.Key] = packedChunk{key: key, offset: dataOffset + hc.Offset, size: hc.Size}
+	}
+	c.added += len(h.Chunks)
+	atomic.AddInt64(&c.entries, 1)
+	return true
+}
+
+func (c *packingCache) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.entries)
+}
+
+func (c *packingCache) packing() bool {
+	// Pack the chunks after three quarters of the cap are used.
+	return atomic.LoadInt64(&c.entries) >= int64(c.maxEntries*3/4)
+}
+
+func (c *packingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	if c.packing() {
+		return &packWriter{c: c, key: key, opts: opts}, nil
+	}
+	w, err := c.BlobCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriter{Writer: w, c: c}, nil
+}
+
+func (c *packingCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	c.mu.Lock()
+	if c.pending != nil {
+		if pc, ok := c.pending.index[key]; ok {
+			data := c.pending.buf.Bytes()[pc.offset : pc.offset+pc.size]
+			c.mu.Unlock()
+			return &bytesCacheReader{bytes.NewReader(data)}, nil
+		}
+	}
+	pc, ok := c.index[key]
+	c.mu.Unlock()
+	if !ok {
+		return c.BlobCache.Get(key, opts...)
+	}
+	r, err := c.BlobCache.Get(pc.key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &packedReader{Reader: r, offset: pc.offset, size: pc.size}, nil
+}
+
+func (c *packingCache) Close() error {
+	c.mu.Lock()
+	err := c.flushLocked()
+	c.mu.Unlock()
+	if cErr := c.BlobCache.Close(); cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// addPacked adds the chunk to the pending pack and flushes the pack if it's full.
+func (c *packingCache) addPacked(key string, data []byte, opts []cache.Option) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.added++
+	if c.pending == nil {
+		// Size the pack so that the rest of the chunks fit in the rest of the cap.
+		var capacity int
+		if budget := c.maxEntries - int(atomic.LoadInt64(&c.entries)); budget > 0 {
+			capacity = (c.chunks - c.added + budget) / budget
+		} else {
+			capacity = c.chunks - c.added + 1
+		}
+		if capacity < 1 {
+			capacity = 1
+		}
+		c.pending = &pendingPack{capacity: capacity, index: make(map[string]packedChunk)}
+	}
+	p := c.pending
+	p.index[key] = packedChunk{offset: int64(p.buf.Len()), size: int64(len(data))}
+	p.keys = append(p.keys, key)
+	p.buf.Write(data)
+	if len(p.keys) < p.capacity {
+		return nil
+	}
+	return c.flushLocked(opts...)
+}
+
+// flushLocked adds the pending pack to the cache. c.mu must be held.
+func (c *packingCache) flushLocked(opts ...cache.Option) error {
+	p := c.pending
+	if p == nil {
+		return nil
+	}
+	c.pending = nil
+
+	// Don't overwrite the packs following a missing one at the load, which
+	// may be cached with the old contents.
+	packKey := c.packKey(c.nextPack)
+	for c.loadPack(packKey) {
+		c.nextPack++
+		packKey = c.packKey(c.nextPack)
+	}
+	c.nextPack++
+
+	var h packHeader
+	for _, key := range p.keys {
+		pc := p.index[key]
+		h.Chunks = append(h.Chunks, packHeaderChunk{Key: key, Offset: pc.offset, Size: pc.size})
+	}
+	hdr, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode the header of pack %q: %w", packKey, err)
+	}
+	head := binary.BigEndian.AppendUint64(nil, uint64(len(hdr)))
+	head = append(head, hdr...)
+
+	w, err := c.BlobCache.Add(packKey, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to add pack %q to the cache: %w", packKey, err)
+	}
+	defer w.Close()
+	for _, b := range [][]byte{head, p.buf.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			w.Abort()
+			return fmt.Errorf("failed to write pack %q to the cache: %w", packKey, err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		return fmt.Errorf("failed to commit pack %q to the cache: %w", packKey, err)
+	}
+	atomic.AddInt64(&c.entries, 1)
+	for key, pc := range p.index {
+		pc.key = packKey
+		pc.offset += int64(len(head))
+		c.index[key] = pc
+	}
+	return nil
+}
+
+// countingWriter counts the entry when it's committed.
+type countingWriter struct {
+	cache.Writer
+	c *packingCache
+}
+
+func (w *countingWriter) Commit() error {
+	if err := w.Writer.Commit(); err != nil {
+		return err
 	}
+	atomic.AddInt64(&w.c.entries, 1)
+	w.c.mu.Lock()
+	w.c.added++
+	w.c.mu.Unlock()
 	return nil
 }
 
+// packWriter adds the chunk to the pending pack when it's committed.
+type packWriter struct {
+	c    *packingCache
+	key  string
+	opts []cache.Option
+	buf  bytes.Buffer
+}
+
+func (w *packWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *packWriter) Commit() error               { return w.c.addPacked(w.key, w.buf.Bytes(), w.opts) }
+func (w *packWriter) Abort() error                { w.buf.Reset(); return nil }
+func (w *packWriter) Close() error                { return nil }
+
+// packedReader reads a chunk in a pack.
+type packedReader struct {
+	cache.Reader
+	offset int64
+	size   int64
+}
+
+func (r *packedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var err error
+	if remain := r.size - off; int64(len(p)) > remain {
+		p, err = p[:remain], io.EOF
+	}
+	n, rErr := r.Reader.ReadAt(p, r.offset+off)
+	if n < len(p) {
+		return n, rErr
+	}
+	return n, err
+}
+
+type bytesCacheReader struct {
+	*bytes.Reader
+}
+
+func (r *bytesCacheReader) Close() error { return nil }
+
 func newBytesWriter(dest []byte, destOff int64) io.Writer {
 	return &bytesWriter{
 		dest:    dest,
@@ -24,12 +24,20 @@ package remote
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -38,7 +46,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
+	rhttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -300,6 +318,891 @@ func checkBrokenHeader(t *testing.T, allowMultiRange bool) {
 	}
 }
 
+type testChunkBoundaries []region
+
+func (bs testChunkBoundaries) ChunkBoundary(offset int64) (int64, int64) {
+	for _, reg := range bs {
+		if reg.b <= offset && offset <= reg.e {
+			return reg.b, reg.e
+		}
+	}
+	return -1, -1
+}
+
+// Tests ReadAt and Cache method with variable-length chunks.
+func TestChunkBoundaryProvider(t *testing.T) {
+	chunks := testChunkBoundaries{{0, 1}, {2, 6}, {7, 9}}
+	tests := []struct {
+		name   string
+		offset int64
+		size   int64
+		want   []region
+	}{
+		{name: "inside_a_chunk", offset: 3, size: 2, want: []region{{2, 6}}},
+		{name: "across_chunks", offset: 1, size: 7, want: []region{{0, 1}, {2, 6}, {7, 9}}},
+		{name: "last_chunk", offset: 8, size: 2, want: []region{{7, 9}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, useCache := range []bool{false, true} {
+				tr := multiRoundTripper(t, []byte(sampleData1))
+				b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+				WithChunkBoundaryProvider(chunks)(b)
+				if useCache {
+					if err := b.Cache(tt.offset, tt.size); err != nil {
+						t.Fatalf("failed to cache: %v", err)
+					}
+				} else {
+					p := make([]byte, tt.size)
+					if _, err := b.ReadAt(p, tt.offset); err != nil {
+						t.Fatalf("failed to read: %v", err)
+					}
+					if want := sampleData1[tt.offset : tt.offset+tt.size]; string(p) != want {
+						t.Fatalf("unexpected data %q; want %q", string(p), want)
+					}
+				}
+				for _, reg := range chunks {
+					var wanted bool
+					for _, w := range tt.want {
+						wanted = wanted || w == reg
+					}
+					r, err := b.cache.Get(b.fetcher.genID(reg))
+					if !wanted {
+						if err == nil {
+							r.Close()
+							t.Errorf("chunk %v mustn't be cached", reg)
+						}
+						continue
+					}
+					if err != nil {
+						t.Fatalf("chunk %v must be cached (cache=%v): %v", reg, useCache, err)
+					}
+					data := make([]byte, reg.size())
+					if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+						t.Fatalf("failed to read cache of %v: %v", reg, err)
+					}
+					r.Close()
+					if want := sampleData1[reg.b : reg.e+1]; string(data) != want {
+						t.Errorf("cache of %v = %q; want %q", reg, string(data), want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLazyChunkBoundaries(t *testing.T) {
+	const sectionSize = 10
+	sections := map[int64][]ChunkEntry{
+		0: {{0, 1, "a"}, {2, 6, "b"}, {7, 12, "c"}},
+		1: {{13, 24, "d"}},
+		2: {{25, 29, "e"}},
+	}
+	tests := []struct {
+		name       string
+		offsets    []int64
+		want       []ChunkEntry
+		wantLoaded []int64
+	}{
+		{
+			name:       "single_section",
+			offsets:    []int64{3},
+			want:       []ChunkEntry{{2, 6, "b"}},
+			wantLoaded: []int64{0},
+		},
+		{
+			name:       "chunk_begins_in_previous_section",
+			offsets:    []int64{11},
+			want:       []ChunkEntry{{7, 12, "c"}},
+			wantLoaded: []int64{0, 1},
+		},
+		{
+			name:       "last_section",
+			offsets:    []int64{27, 29},
+			want:       []ChunkEntry{{25, 29, "e"}, {25, 29, "e"}},
+			wantLoaded: []int64{2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := make(map[int64]int)
+			l := NewLazyChunkBoundaries(sectionSize, 0, func(section int64) ([]ChunkEntry, error) {
+				loaded[section]++
+				return sections[section], nil
+			})
+			for i, offset := range tt.offsets {
+				e, ok := l.ChunkEntry(offset)
+				if !ok || e != tt.want[i] {
+					t.Errorf("chunk at %d = %+v (ok = %v); want %+v", offset, e, ok, tt.want[i])
+				}
+				if begin, end := l.ChunkBoundary(offset); begin != tt.want[i].Begin || end != tt.want[i].End {
+					t.Errorf("boundary at %d = [%d, %d]; want [%d, %d]", offset, begin, end, tt.want[i].Begin, tt.want[i].End)
+				}
+			}
+			if len(loaded) != len(tt.wantLoaded) {
+				t.Errorf("loaded sections %v; want %v", loaded, tt.wantLoaded)
+			}
+			for _, s := range tt.wantLoaded {
+				if loaded[s] != 1 {
+					t.Errorf("section %d must be loaded once; loaded %d times", s, loaded[s])
+				}
+			}
+		})
+	}
+
+	// The number of sections kept in memory is bounded.
+	var loads int
+	l := NewLazyChunkBoundaries(sectionSize, 1, func(section int64) ([]ChunkEntry, error) {
+		loads++
+		return sections[section], nil
+	})
+	for _, offset := range []int64{0, 28, 0} {
+		if _, ok := l.ChunkEntry(offset); !ok {
+			t.Fatalf("chunk at %d must be found", offset)
+		}
+	}
+	if n := l.sections.Len(); n != 1 {
+		t.Errorf("only 1 section must be kept; kept %d", n)
+	}
+	if loads != 3 {
+		t.Errorf("evicted section must be loaded again; loaded %d times", loads)
+	}
+}
+
+func TestPrefetchStats(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	tests := []struct {
+		name          string
+		failFrom      int64
+		wantCompleted int
+	}{
+		{name: "all_completed", failFrom: int64(len(sampleData1)), wantCompleted: 4},
+		{name: "partially_completed", failFrom: 2 * sampleChunkSize, wantCompleted: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, 2*sampleChunkSize, func(req *http.Request) *http.Response {
+				time.Sleep(delay)
+				begin, _ := parseRangeString(t, strings.TrimPrefix(req.Header.Get("Range"), rangeHeaderPrefix))
+				if begin >= tt.failFrom {
+					return &http.Response{
+						StatusCode: http.StatusInternalServerError,
+						Header:     make(http.Header),
+						Body:       io.NopCloser(bytes.NewReader([]byte{})),
+					}
+				}
+				return tr(req)
+			})
+			before := time.Now()
+			err := b.Cache(0, int64(len(sampleData1)))
+			if (err == nil) != (tt.wantCompleted == 4) {
+				t.Fatalf("unexpected result of Cache: %v", err)
+			}
+			stats := b.BlobStats().Prefetch
+			if stats.Start.Before(before) || stats.End.Before(stats.Start) {
+				t.Errorf("invalid prefetch period: start=%v, end=%v", stats.Start, stats.End)
+			}
+			if stats.Duration() < delay {
+				t.Errorf("prefetch duration = %v; want >= %v", stats.Duration(), delay)
+			}
+			if stats.Bytes != int64(len(sampleData1)) {
+				t.Errorf("prefetch bytes = %d; want %d", stats.Bytes, len(sampleData1))
+			}
+			if stats.RegionsTotal != 4 || stats.RegionsCompleted != tt.wantCompleted {
+				t.Errorf("completed regions = %d/%d; want %d/4", stats.RegionsCompleted, stats.RegionsTotal, tt.wantCompleted)
+			}
+			if want := float64(tt.wantCompleted) / 4; stats.Coverage() != want {
+				t.Errorf("coverage = %v; want %v", stats.Coverage(), want)
+			}
+		})
+	}
+}
+
+func TestPrefetchStatsOverlapping(t *testing.T) {
+	release := make(chan struct{})
+	tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		if begin, _ := parseRangeString(t, strings.TrimPrefix(req.Header.Get("Range"), rangeHeaderPrefix)); begin >= 2*sampleChunkSize {
+			<-release // the second half is prefetched slowly
+		}
+		return tr(req)
+	})
+
+	slow := make(chan error)
+	go func() { slow <- b.Cache(2*sampleChunkSize, int64(len(sampleData1))-2*sampleChunkSize) }()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if b.BlobStats().Prefetch.RegionsTotal == 2 {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatalf("the slow prefetch doesn't start")
+		}
+	}
+	if err := b.Cache(0, 2*sampleChunkSize); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	stats := b.BlobStats().Prefetch
+	if !stats.End.IsZero() {
+		t.Errorf("prefetch must be in progress until the slow one finishes; ended at %v", stats.End)
+	}
+	if stats.RegionsTotal != 4 || stats.RegionsCompleted != 2 {
+		t.Errorf("completed regions = %d/%d; want 2/4", stats.RegionsCompleted, stats.RegionsTotal)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	stats = b.BlobStats().Prefetch
+	if stats.End.IsZero() || stats.End.Before(stats.Start) {
+		t.Errorf("invalid prefetch period: start=%v, end=%v", stats.Start, stats.End)
+	}
+	if stats.Bytes != int64(len(sampleData1)) {
+		t.Errorf("prefetch bytes = %d; want %d", stats.Bytes, len(sampleData1))
+	}
+	if stats.RegionsTotal != 4 || stats.RegionsCompleted != 4 {
+		t.Errorf("completed regions = %d/%d; want 4/4", stats.RegionsCompleted, stats.RegionsTotal)
+	}
+}
+
+func TestCacheYieldToReads(t *testing.T) {
+	var (
+		tr            = multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+		readStarted   = make(chan struct{})
+		releaseRead   = make(chan struct{})
+		prefetchCount int64
+	)
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		begin, _ := parseRangeString(t, strings.TrimPrefix(req.Header.Get("Range"), rangeHeaderPrefix))
+		if begin == 0 {
+			close(readStarted)
+			<-releaseRead
+		} else {
+			atomic.AddInt64(&prefetchCount, 1)
+		}
+		return tr(req)
+	})
+
+	readDone := make(chan error)
+	go func() {
+		_, err := b.ReadAt(make([]byte, sampleChunkSize), 0)
+		readDone <- err
+	}()
+	<-readStarted
+
+	cacheDone := make(chan error)
+	go func() {
+		cacheDone <- b.Cache(sampleChunkSize, int64(len(sampleData1))-sampleChunkSize, WithYieldToReads())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&prefetchCount); n != 0 {
+		t.Fatalf("prefetch must pause during reads but %d requests issued", n)
+	}
+
+	close(releaseRead)
+	if err := <-readDone; err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if err := <-cacheDone; err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	if n := atomic.LoadInt64(&prefetchCount); n != 3 {
+		t.Errorf("prefetch must resume after reads; requests = %d, want 3", n)
+	}
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+}
+
+func TestFetchTail(t *testing.T) {
+	tests := []struct {
+		name       string
+		n          int64
+		wantCached []region
+		notCached  []region
+	}{
+		{
+			name:       "unaligned_suffix",
+			n:          5,
+			wantCached: []region{{6, 8}, {9, 9}},
+			notCached:  []region{{3, 5}},
+		},
+		{
+			name:       "aligned_suffix",
+			n:          7,
+			wantCached: []region{{3, 5}, {6, 8}, {9, 9}},
+			notCached:  []region{{0, 2}},
+		},
+		{
+			name:       "whole_blob",
+			n:          int64(len(sampleData1)),
+			wantCached: []region{{0, 2}, {3, 5}, {6, 8}, {9, 9}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobSize := int64(len(sampleData1))
+			b := makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				if got, want := req.Header.Get("Range"), fmt.Sprintf("bytes=-%d", tt.n); got != want {
+					t.Fatalf("unexpected range %q; want %q", got, want)
+				}
+				header := make(http.Header)
+				header.Add("Content-Length", fmt.Sprintf("%d", tt.n))
+				header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", blobSize-tt.n, blobSize-1, blobSize))
+				return &http.Response{
+					StatusCode: http.StatusPartialContent,
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader(sampleData1[blobSize-tt.n:])),
+				}
+			})
+			p := make([]byte, tt.n)
+			n, err := b.fetchTail(p, &options{})
+			if err != nil {
+				t.Fatalf("failed to fetch tail: %v", err)
+			}
+			if want := sampleData1[blobSize-tt.n:]; string(p[:n]) != want {
+				t.Errorf("tail = %q; want %q", string(p[:n]), want)
+			}
+			for _, reg := range tt.wantCached {
+				checkAllCached(t, b, reg.b, reg.size())
+			}
+			for _, reg := range tt.notCached {
+				if r, err := b.cache.Get(b.fetcher.genID(reg)); err == nil {
+					r.Close()
+					t.Errorf("partially fetched chunk %v mustn't be cached", reg)
+				}
+			}
+		})
+	}
+}
+
+func TestReadTail(t *testing.T) {
+	blobSize := int64(len(sampleData1))
+	const n = 5
+	var requests int64
+	b := makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		atomic.AddInt64(&requests, 1)
+		if got, want := req.Header.Get("Range"), fmt.Sprintf("bytes=-%d", n); got != want {
+			t.Fatalf("unexpected range %q; want %q", got, want)
+		}
+		header := make(http.Header)
+		header.Add("Content-Length", fmt.Sprintf("%d", n))
+		header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", blobSize-n, blobSize-1, blobSize))
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(sampleData1[blobSize-n:])),
+		}
+	})
+	for i := 0; i < 2; i++ {
+		tail, err := b.ReadTail(n)
+		if err != nil {
+			t.Fatalf("#%d: failed to read tail: %v", i, err)
+		}
+		if want := sampleData1[blobSize-n:]; string(tail) != want {
+			t.Errorf("#%d: tail = %q; want %q", i, string(tail), want)
+		}
+	}
+	// The chunks of the tail are cached but {3, 5} isn't fully contained.
+	if got := atomic.LoadInt64(&requests); got != 2 {
+		t.Errorf("requests = %d; want 2", got)
+	}
+	checkAllCached(t, b, 6, 4)
+
+	// Fall back to reading by offset if the registry rejects suffix ranges.
+	rangeTr := multiRoundTripper(t, []byte(sampleData1))
+	b = makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		if strings.HasPrefix(req.Header.Get("Range"), "bytes=-") {
+			return &http.Response{
+				StatusCode: http.StatusRequestedRangeNotSatisfiable,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			}
+		}
+		return rangeTr(req)
+	})
+	tail, err := b.ReadTail(blobSize + 1)
+	if err != nil {
+		t.Fatalf("failed to read tail with the fallback: %v", err)
+	}
+	if string(tail) != sampleData1 {
+		t.Errorf("tail = %q; want %q", string(tail), sampleData1)
+	}
+}
+
+func TestBlobShrank(t *testing.T) {
+	blobSize := int64(len(sampleData1))
+	shrunk := []byte(sampleData1[:blobSize-2])
+	tests := []struct {
+		name string
+		tr   RoundTripFunc
+	}{
+		{
+			name: "multipart",
+			tr:   multiRoundTripper(t, shrunk),
+		},
+		{
+			name: "singlepart",
+			tr:   multiRoundTripper(t, shrunk, allowMultiRange(false)),
+		},
+		{
+			name: "range_not_satisfiable",
+			tr: func(req *http.Request) *http.Response {
+				header := make(http.Header)
+				header.Add("Content-Range", fmt.Sprintf("bytes */%d", len(shrunk)))
+				return &http.Response{
+					StatusCode: http.StatusRequestedRangeNotSatisfiable,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader([]byte{})),
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, tt.tr)
+			b.fetcher.(*httpFetcher).size = blobSize
+			_, err := b.ReadAt(make([]byte, sampleChunkSize), sampleChunkSize)
+			if !errors.Is(err, ErrBlobShrank) {
+				t.Errorf("read must fail with ErrBlobShrank but got %v", err)
+			}
+		})
+	}
+}
+
+func TestCacheIDRewriter(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, failRoundTripper())
+	WithCacheIDRewriter(func(id string) (string, bool) {
+		return "legacy-" + id, true
+	})(b)
+	chunk := region{0, sampleChunkSize - 1}
+	id := b.fetcher.genID(chunk)
+	w, err := b.cache.Add("legacy-" + id)
+	if err != nil {
+		t.Fatalf("failed to add legacy cache: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData1[chunk.b : chunk.e+1])); err != nil {
+		t.Fatalf("failed to write legacy cache: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit legacy cache: %v", err)
+	}
+	w.Close()
+
+	p := make([]byte, sampleMiddleOffset)
+	if _, err := b.ReadAt(p, 1); err != nil {
+		t.Fatalf("legacy-keyed entry must be found without network: %v", err)
+	}
+	if want := sampleData1[1 : 1+sampleMiddleOffset]; string(p) != want {
+		t.Errorf("read data %q; want %q", string(p), want)
+	}
+	r, err := b.cache.Get(id)
+	if err != nil {
+		t.Fatalf("entry must be migrated to the new key: %v", err)
+	}
+	defer r.Close()
+	data := make([]byte, chunk.size())
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		t.Fatalf("failed to read migrated entry: %v", err)
+	}
+	if want := sampleData1[chunk.b : chunk.e+1]; string(data) != want {
+		t.Errorf("migrated entry %q; want %q", string(data), want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	want := digest.FromString(sampleData1)
+	for _, concurrency := range []int{1, 2, 4, 16} {
+		t.Run(fmt.Sprintf("concurrency_%d", concurrency), func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+			got, err := b.digest(want.Algorithm(), &options{verifyConcurrency: concurrency})
+			if err != nil {
+				t.Fatalf("failed to compute digest: %v", err)
+			}
+			if got != want {
+				t.Errorf("digest = %v; want %v", got, want)
+			}
+			if err := b.Verify(want, WithVerifyConcurrency(concurrency)); err != nil {
+				t.Errorf("failed to verify: %v", err)
+			}
+
+			// Corrupt a chunk in the cache
+			corrupted := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+			w, err := corrupted.cache.Add(corrupted.fetcher.genID(region{sampleChunkSize, 2*sampleChunkSize - 1}))
+			if err != nil {
+				t.Fatalf("failed to add cache: %v", err)
+			}
+			w.Write([]byte("xxx"))
+			w.Commit()
+			w.Close()
+			if err := corrupted.Verify(want, WithVerifyConcurrency(concurrency)); err == nil {
+				t.Errorf("verification must fail for corrupted chunk")
+			}
+		})
+	}
+}
+
+func TestReadAtWithDigest(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+	for _, alg := range []digest.Algorithm{digest.SHA256, digest.SHA512} {
+		for _, r := range []struct {
+			offset int64
+			size   int
+		}{
+			{0, len(sampleData1)},
+			{2, 5},
+			{8, 10}, // partially beyond the end of the blob
+		} {
+			p := make([]byte, r.size)
+			n, d, err := b.ReadAtWithDigest(p, r.offset, alg)
+			if err != nil {
+				t.Fatalf("failed to read at %d: %v", r.offset, err)
+			}
+			h := alg.Hash()
+			h.Write(p[:n])
+			if want := digest.NewDigest(alg, h); d != want {
+				t.Errorf("digest of %d bytes at %d = %v; want %v", n, r.offset, d, want)
+			}
+		}
+	}
+	if _, _, err := b.ReadAtWithDigest(make([]byte, 1), 0, digest.Algorithm("unknown")); err == nil {
+		t.Errorf("unavailable algorithm must be rejected")
+	}
+}
+
+func TestReadWindow(t *testing.T) {
+	const windowChunks = 2
+	for _, offset := range []int64{0, sampleMiddleOffset, sampleChunkSize} {
+		t.Run(fmt.Sprintf("offset_%d", offset), func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1))
+			var maxFetched int64
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				var fetched int64
+				for _, part := range strings.Split(strings.TrimPrefix(req.Header.Get("Range"), rangeHeaderPrefix), ",") {
+					begin, end := parseRangeString(t, part)
+					fetched += end - begin + 1
+				}
+				if fetched > maxFetched {
+					maxFetched = fetched
+				}
+				return tr(req)
+			})
+			p := make([]byte, int64(len(sampleData1))-offset)
+			n, err := b.ReadAt(p, offset, WithReadWindow(windowChunks))
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := sampleData1[offset:]; string(p[:n]) != want {
+				t.Errorf("read data %q; want %q", string(p[:n]), want)
+			}
+			if maxFetched > windowChunks*sampleChunkSize {
+				t.Errorf("fetched %d bytes at once; want <= %d", maxFetched, windowChunks*sampleChunkSize)
+			}
+		})
+	}
+}
+
+func TestOnFullyCached(t *testing.T) {
+	var called int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+	WithOnFullyCached(func() {
+		atomic.AddInt64(&called, 1)
+	})(b)
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < int64(len(sampleData1)); i++ {
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func(offset int64) {
+				defer wg.Done()
+				if _, err := b.ReadAt(make([]byte, 1), offset); err != nil {
+					t.Errorf("failed to read at %d: %v", offset, err)
+				}
+			}(i)
+		}
+		if i == int64(len(sampleData1))/2 {
+			wg.Wait()
+			if n := atomic.LoadInt64(&called); n != 0 {
+				t.Fatalf("callback mustn't be called before fully cached; called %d times", n)
+			}
+		}
+	}
+	wg.Wait()
+	if err := b.Cache(0, int64(len(sampleData1))); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	if n := atomic.LoadInt64(&called); n != 1 {
+		t.Errorf("callback must be called exactly once; called %d times", n)
+	}
+}
+
+func TestZeroSizeBlob(t *testing.T) {
+	b := makeTestBlob(t, 0, sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		t.Fatalf("zero-size blob mustn't access the registry: %v", req.Header.Get("Range"))
+		return nil
+	})
+	for _, offset := range []int64{0, 1} {
+		if n, err := b.ReadAt(make([]byte, sampleChunkSize), offset); n != 0 || err != nil {
+			t.Errorf("ReadAt(offset=%d) = (%d, %v); want (0, nil)", offset, n, err)
+		}
+	}
+	if err := b.Cache(0, sampleChunkSize); err != nil {
+		t.Errorf("Cache must be a no-op but got %v", err)
+	}
+	if stats := b.BlobStats().Prefetch; stats.RegionsTotal != 0 {
+		t.Errorf("Cache must be a no-op but prefetch stats = %+v", stats)
+	}
+	if err := b.Verify(digest.FromBytes(nil)); err != nil {
+		t.Errorf("Verify must match the empty digest: %v", err)
+	}
+	if err := b.Verify(digest.FromString(sampleData1)); err == nil {
+		t.Errorf("Verify must fail for non-empty digest")
+	}
+	if sz := b.FetchedSize(); sz != 0 {
+		t.Errorf("FetchedSize = %d; want 0", sz)
+	}
+}
+
+func TestAuthRefresher(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	var authorized int64
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		if req.Header.Get("Authorization") != "Bearer new" {
+			return &http.Response{
+				StatusCode: http.StatusUnauthorized,
+				Status:     "401 Unauthorized",
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			}
+		}
+		atomic.AddInt64(&authorized, 1)
+		return tr(req)
+	})
+
+	// Fails without refreshing the token
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err == nil {
+		t.Fatalf("read must fail on 401 without refreshing token")
+	}
+
+	var refreshed int
+	refresh := WithAuthRefresher(func(ctx context.Context, req *http.Request) error {
+		refreshed++
+		req.Header.Set("Authorization", "Bearer new")
+		return nil
+	})
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, refresh); err != nil {
+		t.Fatalf("failed to read with refreshing token: %v", err)
+	}
+	if want := sampleData1[:sampleChunkSize]; string(p) != want {
+		t.Errorf("read data %q; want %q", string(p), want)
+	}
+	if refreshed != 1 || authorized != 1 {
+		t.Errorf("token must be refreshed and retried once; refreshed=%d, authorized=%d", refreshed, authorized)
+	}
+}
+
+func TestRequestCount(t *testing.T) {
+	blobSize := int64(len(sampleData1))
+	tests := []struct {
+		name     string
+		cached   []region
+		multi    bool
+		opts     []Option
+		wantReqs int
+	}{
+		{
+			name:     "fully_cached",
+			cached:   []region{{0, 2}, {3, 5}, {6, 8}, {9, 9}},
+			multi:    true,
+			wantReqs: 0,
+		},
+		{
+			name:     "single_fetch",
+			cached:   []region{{3, 5}},
+			multi:    true,
+			wantReqs: 1,
+		},
+		{
+			name:     "split_by_single_range_fallback",
+			cached:   []region{{3, 5}},
+			multi:    false,
+			wantReqs: 2,
+		},
+		{
+			name:     "split_by_window",
+			multi:    true,
+			opts:     []Option{WithReadWindow(2)},
+			wantReqs: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(tt.multi), exceptChunks(tt.cached))
+			b := makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, tr)
+			cacheAll(t, b, tt.cached)
+			got := -1
+			p := make([]byte, blobSize-1)
+			if _, err := b.ReadAt(p, 1, append(tt.opts, WithRequestCountFunc(func(n int) { got = n }))...); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if string(p) != sampleData1[1:] {
+				t.Errorf("read data %q; want %q", string(p), sampleData1[1:])
+			}
+			if got != tt.wantReqs {
+				t.Errorf("request count = %d; want %d", got, tt.wantReqs)
+			}
+		})
+	}
+}
+
+func TestTrailingRegion(t *testing.T) {
+	const trailingOffset = 4 // the trailing region is [4, 9]
+	blobSize := int64(len(sampleData1))
+	tests := []struct {
+		name      string
+		offset    int64
+		size      int64
+		cache     bool
+		wantReg   region
+		notCached []region
+	}{
+		{
+			name:      "read_last_byte",
+			offset:    blobSize - 1,
+			size:      1,
+			wantReg:   region{3, 9},
+			notCached: []region{{0, 2}},
+		},
+		{
+			name:      "cache_inside_trailing_region",
+			offset:    6,
+			size:      2,
+			cache:     true,
+			wantReg:   region{3, 9},
+			notCached: []region{{0, 2}},
+		},
+		{
+			name:      "read_before_trailing_region",
+			offset:    0,
+			size:      2,
+			wantReg:   region{0, 2},
+			notCached: []region{{3, 5}, {6, 8}, {9, 9}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, blobSize, sampleChunkSize, defaultPrefetchChunkSize, tr)
+			WithTrailingRegion(trailingOffset)(b)
+			if tt.cache {
+				if err := b.Cache(tt.offset, tt.size); err != nil {
+					t.Fatalf("failed to cache: %v", err)
+				}
+			} else {
+				p := make([]byte, tt.size)
+				if _, err := b.ReadAt(p, tt.offset); err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if want := sampleData1[tt.offset : tt.offset+tt.size]; string(p) != want {
+					t.Errorf("read data %q; want %q", string(p), want)
+				}
+			}
+			checkAllCached(t, b, tt.wantReg.b, tt.wantReg.size())
+			for _, reg := range tt.notCached {
+				if r, err := b.cache.Get(b.fetcher.genID(reg)); err == nil {
+					r.Close()
+					t.Errorf("chunk %v mustn't be fetched", reg)
+				}
+			}
+		})
+	}
+}
+
+func TestTOCPrefetch(t *testing.T) {
+	const (
+		data       = "abcdefghijklmnopqrstuvwxyz0010" // TOC is [10, 25] and footer is [26, 29]
+		footerSize = 4
+	)
+	locate := func(footer []byte) (int64, error) {
+		return strconv.ParseInt(string(footer), 10, 64)
+	}
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled_%v", enabled), func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(data))
+			b := makeTestBlob(t, int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+			if enabled {
+				WithTOCPrefetch(footerSize, locate)(b)
+			}
+			p := make([]byte, footerSize)
+			var requests int
+			if _, err := b.ReadAt(p, int64(len(data))-footerSize, WithRequestCountFunc(func(n int) { requests = n })); err != nil {
+				t.Fatalf("failed to read footer: %v", err)
+			}
+			if want := data[len(data)-footerSize:]; string(p) != want {
+				t.Errorf("read footer %q; want %q", string(p), want)
+			}
+			if requests != 1 {
+				t.Errorf("footer read issued %d requests; want 1 (TOC is prefetched in the background)", requests)
+			}
+			// Wait for the TOC prefetch.
+			b.activeFetches.Wait()
+			checkAllCached(t, b, 24, 6) // chunks of the footer
+			tocChunks := []region{{9, 11}, {12, 14}, {15, 17}, {18, 20}, {21, 23}}
+			for _, reg := range append(tocChunks, region{0, 2}) {
+				r, err := b.cache.Get(b.fetcher.genID(reg))
+				if err == nil {
+					r.Close()
+				}
+				if wantCached := enabled && reg.b >= 9; wantCached && err != nil {
+					t.Errorf("TOC chunk %v must be fetched on footer read", reg)
+				} else if !wantCached && err == nil {
+					t.Errorf("chunk %v mustn't be fetched", reg)
+				}
+			}
+		})
+	}
+}
+
+func TestTOCPrefetchCanceledByClose(t *testing.T) {
+	const (
+		data       = "abcdefghijklmnopqrstuvwxyz0010" // TOC is [10, 25] and footer is [26, 29]
+		footerSize = 4
+	)
+	rangeTr := multiRoundTripper(t, []byte(data))
+	blocking := &blockingRoundTripper{started: make(chan struct{}, 1)}
+	var calls int64
+	b := makeTestBlob(t, int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			return rangeTr(req) // footer
+		}
+		res, err := blocking.RoundTrip(req) // TOC
+		if err != nil {
+			return failRoundTripper()(req)
+		}
+		return res
+	})
+	WithTOCPrefetch(footerSize, func(footer []byte) (int64, error) {
+		return strconv.ParseInt(string(footer), 10, 64)
+	})(b)
+	if _, err := b.ReadAt(make([]byte, footerSize), int64(len(data))-footerSize); err != nil {
+		t.Fatalf("failed to read footer: %v", err)
+	}
+	select {
+	case <-blocking.started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TOC prefetch isn't started")
+	}
+	closed := make(chan error)
+	go func() { closed <- b.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Close must cancel the TOC prefetch")
+	}
+}
+
 func TestParallelDownloadingBehavior(t *testing.T) {
 	type regionsBoundaries struct {
 		regions []region
@@ -307,254 +1210,4261 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 		end     int64
 	}
 
-	type testData struct {
-		name           string
-		regions        [3]regionsBoundaries
-		roundtripCount int64
-		chunkSize      int64
-		content        string
+	type testData struct {
+		name           string
+		regions        [3]regionsBoundaries
+		roundtripCount int64
+		sharedCount    int64
+		chunkSize      int64
+		content        string
+	}
+
+	tests := []testData{
+		{
+			name:           "no_data",
+			regions:        [3]regionsBoundaries{},
+			roundtripCount: 0,
+			chunkSize:      4,
+		},
+		{
+			name: "same_regions",
+			regions: [3]regionsBoundaries{
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+			},
+			roundtripCount: 1,
+			sharedCount:    2,
+			chunkSize:      4,
+			content:        "test",
+		},
+		{
+			name: "same_regions_multiple_values",
+			regions: [3]regionsBoundaries{
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+						{
+							b: 4,
+							e: 7,
+						},
+					},
+					start: 0,
+					end:   7,
+				},
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+						{
+							b: 4,
+							e: 7,
+						},
+					},
+					start: 0,
+					end:   7,
+				},
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+						{
+							b: 4,
+							e: 7,
+						},
+					},
+					start: 0,
+					end:   7,
+				},
+			},
+			roundtripCount: 1,
+			sharedCount:    2,
+			chunkSize:      4,
+			content:        "test1234",
+		},
+		{
+			name: "different_regions",
+			regions: [3]regionsBoundaries{
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+				{
+					regions: []region{
+						{
+							b: 4,
+							e: 7,
+						},
+					},
+					start: 4,
+					end:   7,
+				},
+				{
+					regions: []region{
+						{
+							b: 8,
+							e: 11,
+						},
+					},
+					start: 8,
+					end:   11,
+				},
+			},
+			roundtripCount: 3,
+			chunkSize:      4,
+			content:        "test12345678",
+		},
+		{
+			name: "some_overlap",
+			regions: [3]regionsBoundaries{
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+				{
+					regions: []region{
+						{
+							b: 0,
+							e: 3,
+						},
+					},
+					start: 0,
+					end:   3,
+				},
+				{
+					regions: []region{
+						{
+							b: 4,
+							e: 7,
+						},
+					},
+					start: 4,
+					end:   7,
+				},
+			},
+			roundtripCount: 2,
+			sharedCount:    1,
+			chunkSize:      4,
+			content:        "test1234",
+		},
+	}
+
+	var wg sync.WaitGroup
+	// we always run 3 routines
+	routines := 3
+
+	for _, tst := range tests {
+		var (
+			tr = &callsCountRoundTripper{
+				content: tst.content,
+			}
+			b = &blob{
+				fetcher: &httpFetcher{
+					url: "test",
+					tr:  tr,
+				},
+				chunkSize: tst.chunkSize,
+				size:      int64(len(tst.content)),
+				cache:     cache.NewMemoryCache(),
+			}
+		)
+
+		start := make(chan struct{})
+		wg.Add(routines)
+		var contentBytes [3][]byte
+
+		for i := 0; i < routines; i++ {
+			p := make([]byte, len(tst.content))
+			contentBytes[i] = p
+			allData := make(map[region]io.Writer)
+			if i < len(tst.regions) {
+				offset := int64(0)
+				for j := range tst.regions[i].regions {
+					r := tst.regions[i].regions[j]
+					var (
+						base         = positive(r.b - offset)
+						lowerUnread  = positive(offset - r.b)
+						upperUnread  = positive(r.e + 1 - (offset + int64(len(p))))
+						expectedSize = r.size() - upperUnread - lowerUnread
+					)
+					allData[tst.regions[i].regions[j]] = newBytesWriter(p[base:base+expectedSize], lowerUnread)
+				}
+			}
+
+			go func() {
+				<-start // by blocking on channel start we can ensure that the goroutines will run at approximately the same time
+				defer wg.Done()
+				b.fetchRange(allData, &options{})
+			}()
+		}
+		close(start) // starting
+		wg.Wait()
+
+		// We expect the number of round trip calls to be 1, since we are making 5 calls to fetchRange with
+		// overlapping intervals.
+		if tr.count != tst.roundtripCount {
+			t.Errorf("%v test failed: the round trip count should be %v, but was %v", tst.name, tst.roundtripCount, tr.count)
+		}
+		stats := b.BlobStats()
+		if stats.LeaderFetches != tst.roundtripCount || stats.SharedFetches != tst.sharedCount {
+			t.Errorf("%v test failed: leader/shared fetches should be %v/%v, but were %v/%v",
+				tst.name, tst.roundtripCount, tst.sharedCount, stats.LeaderFetches, stats.SharedFetches)
+		}
+		// Check for contents
+		for j := range contentBytes {
+			start := tst.regions[j].start
+			end := tst.regions[j].end
+			for i := start; i < end; i++ {
+				if contentBytes[j][i] != []byte(tst.content)[i] {
+					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, []byte(tst.content)[start:end], contentBytes[j][start:end])
+					break
+				}
+			}
+		}
+	}
+}
+
+// forgetfulCache is a cache which never holds committed contents.
+type forgetfulCache struct{}
+
+func (forgetfulCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	return &testCacheWriter{Writer: io.Discard, commit: func() error { return nil }}, nil
+}
+func (forgetfulCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	return nil, fmt.Errorf("missed cache: %q", key)
+}
+func (forgetfulCache) Close() error { return nil }
+
+type testCacheWriter struct {
+	io.Writer
+	commit func() error
+}
+
+func (w *testCacheWriter) Commit() error { return w.commit() }
+func (w *testCacheWriter) Abort() error  { return nil }
+func (w *testCacheWriter) Close() error  { return nil }
+
+func TestSharedFetchRetry(t *testing.T) {
+	const routines = 3
+	for _, noRetry := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no_retry_%v", noRetry), func(t *testing.T) {
+			tr := &callsCountRoundTripper{content: "test"}
+			b := &blob{
+				fetcher: &httpFetcher{
+					url: "test",
+					tr:  tr,
+				},
+				chunkSize: 4,
+				size:      4,
+				cache:     forgetfulCache{},
+			}
+			var (
+				wg     sync.WaitGroup
+				start  = make(chan struct{})
+				failed int64
+			)
+			for i := 0; i < routines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					allData := map[region]io.Writer{{0, 3}: io.Discard}
+					if err := b.fetchRange(allData, &options{noSharedFetchRetry: noRetry}); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+			if noRetry {
+				if tr.count != 1 {
+					t.Errorf("shared fetch mustn't be retried; round trips = %d", tr.count)
+				}
+				if failed != routines-1 {
+					t.Errorf("shared callers must fail; failed = %d, want %d", failed, routines-1)
+				}
+			} else {
+				if tr.count <= 1 {
+					t.Errorf("shared fetch must be retried; round trips = %d", tr.count)
+				}
+				if failed != 0 {
+					t.Errorf("retried callers mustn't fail; failed = %d", failed)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchPinning(t *testing.T) {
+	const routines = 3
+	tr := &callsCountRoundTripper{content: "test"}
+	b := &blob{
+		fetcher: &httpFetcher{
+			url: "test",
+			tr:  tr,
+		},
+		chunkSize: 4,
+		size:      4,
+		cache:     forgetfulCache{}, // evicts everything as soon as committed
+	}
+	WithFetchPinning()(b)
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		bufs  = make([]bytes.Buffer, routines)
+	)
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			allData := map[region]io.Writer{{0, 3}: &bufs[i]}
+			if err := b.fetchRange(allData, &options{noSharedFetchRetry: true}); err != nil {
+				t.Errorf("failed to fetch: %v", err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if tr.count != 1 {
+		t.Errorf("round trips = %d; want 1", tr.count)
+	}
+	for i := range bufs {
+		if got := bufs[i].String(); got != tr.content {
+			t.Errorf("caller %d got %q; want %q", i, got, tr.content)
+		}
+	}
+	if len(b.fetchPins) != 0 {
+		t.Errorf("pins must be released after the fetch: %v", b.fetchPins)
+	}
+}
+
+// corruptingCache is a cache which corrupts the first byte of the added contents.
+type corruptingCache struct {
+	cache.BlobCache
+}
+
+func (c corruptingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	w, err := c.BlobCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingWriter{Writer: w}, nil
+}
+
+type corruptingWriter struct {
+	cache.Writer
+	written bool
+}
+
+func (w *corruptingWriter) Write(p []byte) (int, error) {
+	if !w.written && len(p) > 0 {
+		w.written = true
+		corrupted := append([]byte{p[0] + 1}, p[1:]...)
+		return w.Writer.Write(corrupted)
+	}
+	return w.Writer.Write(p)
+}
+
+func TestWriteVerify(t *testing.T) {
+	for _, writeVerify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("write_verify_%v", writeVerify), func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+			b.cache = corruptingCache{cache.NewMemoryCache()}
+			var opts []Option
+			if writeVerify {
+				opts = append(opts, WithWriteVerify())
+			}
+			p := make([]byte, sampleChunkSize)
+			_, err := b.ReadAt(p, 0, opts...)
+			if writeVerify {
+				if err == nil {
+					t.Fatalf("corrupted cache must fail the verification")
+				}
+				if n := b.FetchedSize(); n != 0 {
+					t.Errorf("corrupted chunk mustn't be recorded as fetched; fetched %d bytes", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := sampleData1[:sampleChunkSize]; string(p) != want {
+				t.Errorf("read data = %q; want %q", string(p), want)
+			}
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	const blobs = 5
+	var (
+		created int64
+		pool    = &sync.Pool{
+			New: func() interface{} {
+				atomic.AddInt64(&created, 1)
+				buf := make([]byte, sampleChunkSize)
+				return &buf
+			},
+		}
+		copies int
+	)
+	for i := 0; i < blobs; i++ {
+		tr := multiRoundTripper(t, []byte(sampleData1))
+		b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+		for offset := int64(0); offset < int64(len(sampleData1)); offset += sampleChunkSize {
+			p := make([]byte, sampleChunkSize)
+			n, err := b.ReadAt(p, offset, WithBufferPool(pool))
+			if err != nil {
+				t.Fatalf("failed to read at %d: %v", offset, err)
+			}
+			if want := sampleData1[offset : offset+int64(n)]; string(p[:n]) != want {
+				t.Errorf("read data at %d = %q; want %q", offset, string(p[:n]), want)
+			}
+			copies++
+		}
+	}
+	// Buffers are created only when the pool is empty so buffers must be
+	// taken from the pool and returned to it to be reused.
+	if n := atomic.LoadInt64(&created); n == 0 || n >= int64(copies) {
+		t.Errorf("buffers must be taken from and returned to the pool; %d created for %d copies", n, copies)
+	}
+}
+
+func TestFetchedSizeAfterEviction(t *testing.T) {
+	var fetches int
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		fetches++
+		return tr(req)
+	})
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if n := b.FetchedSize(); n != sampleChunkSize {
+		t.Fatalf("fetched size = %d; want %d", n, sampleChunkSize)
+	}
+
+	// Evict the chunk from the cache and fetch it again.
+	b.cache = cache.NewMemoryCache()
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read after eviction: %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("evicted chunk must be fetched again; fetched %d times", fetches)
+	}
+	if string(p) != sampleData1[:sampleChunkSize] {
+		t.Errorf("read data = %q; want %q", string(p), sampleData1[:sampleChunkSize])
+	}
+	if n := b.FetchedSize(); n != sampleChunkSize {
+		t.Errorf("refetching mustn't inflate fetched size; got %d; want %d", n, sampleChunkSize)
+	}
+}
+
+func TestStalledFetch(t *testing.T) {
+	const window = 100 * time.Millisecond
+	tr := func(req *http.Request) *http.Response {
+		pr, pw := io.Pipe()
+		go func() {
+			// Trickle 1 byte per 50ms (20 bytes/sec)
+			for i := 0; ; i = (i + 1) % len(sampleData1) {
+				if _, err := pw.Write([]byte{sampleData1[i]}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		header := make(http.Header)
+		header.Add("Content-Type", "application/octet-stream")
+		header.Add("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(sampleData1)-1, len(sampleData1)))
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header:     header,
+			Body:       pr,
+		}
+	}
+	// Blob has a single chunk so that the trickling body can't fill it within the window.
+	b := makeTestBlob(t, int64(len(sampleData1)), int64(len(sampleData1)), defaultPrefetchChunkSize, tr)
+	f := b.fetcher.(*httpFetcher)
+	f.minThroughput = 1000
+	f.stallWindow = window
+
+	start := time.Now()
+	_, err := b.ReadAt(make([]byte, len(sampleData1)), 0)
+	if !errors.Is(err, ErrStalledFetch) {
+		t.Fatalf("stalled fetch must fail with ErrStalledFetch; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= b.fetchTimeout || elapsed > 10*window {
+		t.Errorf("stalled fetch must be aborted soon after the window; took %v", elapsed)
+	}
+}
+
+// sleepingLimiter allows a byte per delay.
+type sleepingLimiter struct {
+	delay time.Duration
+}
+
+func (l sleepingLimiter) WaitN(ctx context.Context, n int) error {
+	select {
+	case <-time.After(time.Duration(n) * l.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l sleepingLimiter) Burst() int { return 1 }
+
+func TestStallDetectionWithRateLimit(t *testing.T) {
+	const window = 100 * time.Millisecond
+	b := makeTestBlob(t, int64(len(sampleData1)), int64(len(sampleData1)), defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	f := b.fetcher.(*httpFetcher)
+	f.minThroughput = 1000
+	f.stallWindow = window
+	// The rate limit (about 33 bytes/sec) is below the minimum throughput and the read
+	// takes several windows, but the registry responds immediately.
+	WithRateLimiters(sleepingLimiter{30 * time.Millisecond}, nil)(b)
+
+	p := make([]byte, len(sampleData1))
+	start := time.Now()
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("throttled fetch must not be taken as a stall: %v", err)
+	}
+	if string(p) != sampleData1 {
+		t.Errorf("read %q; want %q", string(p), sampleData1)
+	}
+	if elapsed := time.Since(start); elapsed < window {
+		t.Errorf("the read must be throttled over the window; took %v", elapsed)
+	}
+}
+
+func TestFallbackCaches(t *testing.T) {
+	size := int64(len(sampleData1))
+	// The secondary cache is warmed by another blob.
+	warmed := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	if err := warmed.Cache(0, size); err != nil {
+		t.Fatalf("failed to warm the cache: %v", err)
+	}
+	var (
+		primary   = cache.NewMemoryCache()
+		secondary = warmed.cache
+		empty     = cache.NewMemoryCache()
+	)
+	b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		t.Fatalf("contents in the fallback cache mustn't be fetched: %v", req.Header.Get("Range"))
+		return nil
+	})
+	b.cache = primary
+	WithFallbackCaches(empty, secondary)(b)
+
+	p := make([]byte, size)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(p) != sampleData1 {
+		t.Errorf("read data %q; want %q", string(p), sampleData1)
+	}
+	if err := b.Cache(0, size); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	if r, err := primary.Get(b.fetcher.genID(region{0, sampleChunkSize - 1})); err == nil {
+		r.Close()
+		t.Errorf("hits in the fallback caches mustn't be added to the primary cache")
+	}
+}
+
+type testAuditSink struct {
+	records   []AuditRecord
+	recordsMu sync.Mutex
+}
+
+func (s *testAuditSink) Record(r AuditRecord) {
+	s.recordsMu.Lock()
+	s.records = append(s.records, r)
+	s.recordsMu.Unlock()
+}
+
+func TestAuditSink(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	// The first chunk is served from the cache and the second from the registry.
+	sink := &testAuditSink{}
+	p := make([]byte, 2*sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithAuditSink(sink)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want := sampleData1[:2*sampleChunkSize]; string(p) != want {
+		t.Errorf("read data %q; want %q", string(p), want)
+	}
+	sink.recordsMu.Lock()
+	defer sink.recordsMu.Unlock()
+	if len(sink.records) != 2 {
+		t.Fatalf("2 records must be recorded; got %+v", sink.records)
+	}
+	var cacheHit, network *AuditRecord
+	for i, r := range sink.records {
+		if r.Time.IsZero() {
+			t.Errorf("record %+v must have the time", r)
+		}
+		if r.FromCache {
+			cacheHit = &sink.records[i]
+		} else {
+			network = &sink.records[i]
+		}
+	}
+	if cacheHit == nil || cacheHit.Range != "bytes=0-2" || cacheHit.Bytes != sampleChunkSize || cacheHit.URL != "" {
+		t.Errorf("unexpected cache hit record %+v", cacheHit)
+	}
+	if network == nil || network.URL != testURL || network.Range != "bytes=3-5" ||
+		network.StatusCode != http.StatusPartialContent || network.Err != nil {
+		t.Errorf("unexpected network record %+v", network)
+	}
+}
+
+func TestPlainGetForSmallBlob(t *testing.T) {
+	size := int64(len(sampleData1))
+	for _, threshold := range []int64{0, size + 1} {
+		t.Run(fmt.Sprintf("threshold_%d", threshold), func(t *testing.T) {
+			var requests int64
+			tr := func(req *http.Request) *http.Response {
+				atomic.AddInt64(&requests, 1)
+				header := make(http.Header)
+				if req.Header.Get("Range") != "" {
+					// The registry rejects Range on small blobs
+					return &http.Response{
+						StatusCode: http.StatusBadRequest,
+						Header:     header,
+						Body:       io.NopCloser(bytes.NewReader([]byte{})),
+					}
+				}
+				header.Add("Content-Length", fmt.Sprintf("%d", size))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader([]byte(sampleData1))),
+				}
+			}
+			b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, tr)
+			f := b.fetcher.(*httpFetcher)
+			f.size = size
+			f.plainGetThreshold = threshold
+
+			p := make([]byte, sampleChunkSize)
+			_, err := b.ReadAt(p, sampleChunkSize)
+			if threshold == 0 {
+				if err == nil {
+					t.Fatalf("Range request must be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := sampleData1[sampleChunkSize : 2*sampleChunkSize]; string(p) != want {
+				t.Errorf("read data %q; want %q", string(p), want)
+			}
+			// All reads must be served from the single cached copy
+			for offset := int64(0); offset < size; offset++ {
+				p := make([]byte, 1)
+				if _, err := b.ReadAt(p, offset); err != nil {
+					t.Fatalf("failed to read at %d: %v", offset, err)
+				}
+				if p[0] != sampleData1[offset] {
+					t.Errorf("read data at %d %q; want %q", offset, p[0], sampleData1[offset])
+				}
+			}
+			if n := atomic.LoadInt64(&requests); n != 1 {
+				t.Errorf("small blob must be fetched once with plain GET; requested %d times", n)
+			}
+		})
+	}
+}
+
+// slowCache is a cache which takes the specified duration to get contents.
+type slowCache struct {
+	cache.BlobCache
+	delay time.Duration
+}
+
+func (c slowCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	time.Sleep(c.delay)
+	return c.BlobCache.Get(key, opts...)
+}
+
+func TestCacheTimeout(t *testing.T) {
+	const (
+		delay   = 500 * time.Millisecond
+		timeout = 50 * time.Millisecond
+	)
+	var fetches int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		atomic.AddInt64(&fetches, 1)
+		return tr(req)
+	})
+	if err := b.Cache(0, sampleChunkSize); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	b.cache = slowCache{b.cache, delay}
+	var latencies []time.Duration
+	observe := func(d time.Duration) { latencies = append(latencies, d) }
+
+	// Without the timeout, the cache is waited for.
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithCacheLatencyFunc(observe)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("cached chunk mustn't be fetched without timeout; fetched %d times", n)
+	}
+	if len(latencies) != 1 || latencies[0] < delay {
+		t.Errorf("latency of the cache must be reported; got %v", latencies)
+	}
+
+	// With the timeout, the slow cache is abandoned in favor of the registry.
+	latencies = nil
+	start := time.Now()
+	p = make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithCacheTimeout(timeout), WithCacheLatencyFunc(observe)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("read must not wait for the slow cache; took %v", elapsed)
+	}
+	if want := sampleData1[:sampleChunkSize]; string(p) != want {
+		t.Errorf("read data %q; want %q", string(p), want)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Errorf("chunk must be fetched after cache timeout; fetched %d times", n)
+	}
+	if len(latencies) == 0 || latencies[0] >= delay {
+		t.Errorf("latency of the abandoned cache read must be reported; got %v", latencies)
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy")}
+	for _, cooldown := range []time.Duration{0, time.Hour} {
+		t.Run(fmt.Sprintf("cooldown_%v", cooldown), func(t *testing.T) {
+			var resolved int
+			hostsFn := hostsConfig(&sampleRoundTripper{okURLs: []string{"newexample.com"}}, hostSimple("newexample.com"))(t)
+			hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+				resolved++
+				return hostsFn(refspec)
+			}
+			b := makeBlob(
+				&httpFetcher{
+					url: "oldexample.com",
+					tr:  &breakRoundTripper{success: false},
+				},
+				1, // the blob served by sampleRoundTripper has 1 byte
+				sampleChunkSize,
+				defaultPrefetchChunkSize,
+				cache.NewMemoryCache(),
+				time.Time{},
+				0,
+				&Resolver{},
+				time.Duration(defaultFetchTimeoutSec)*time.Second,
+				withSource(hosts, refspec, desc),
+				WithRefreshCooldown(cooldown))
+			if _, err := b.ReadAt(make([]byte, 1), 0); err == nil {
+				t.Fatalf("read must fail with the old fetcher")
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := b.ReadAt(make([]byte, 1), 0, WithForceRefresh()); err != nil {
+					t.Fatalf("forced refresh read must use the new fetcher: %v", err)
+				}
+			}
+			if url := b.fetcher.(*httpFetcher).url; !strings.Contains(url, "newexample.com") {
+				t.Errorf("fetcher must be refreshed; got URL %q", url)
+			}
+			if want := map[time.Duration]int{0: 2, time.Hour: 1}[cooldown]; resolved != want {
+				t.Errorf("blob must be resolved %d times; resolved %d times", want, resolved)
+			}
+		})
+	}
+}
+
+// evictingCache is a cache which notifies evictions. If evict is true, contents
+// are evicted as soon as they are committed.
+type evictingCache struct {
+	evict     bool
+	contents  map[string][]byte
+	adds      int
+	onEvicted func(key string)
+	mu        sync.Mutex
+}
+
+func (c *evictingCache) NotifyEvicted(f func(key string)) { c.onEvicted = f }
+
+func (c *evictingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	c.mu.Lock()
+	c.adds++
+	c.mu.Unlock()
+	var buf bytes.Buffer
+	return &testCacheWriter{Writer: &buf, commit: func() error {
+		if c.evict {
+			c.onEvicted(key)
+			return nil
+		}
+		c.mu.Lock()
+		c.contents[key] = buf.Bytes()
+		c.mu.Unlock()
+		return nil
+	}}, nil
+}
+
+func (c *evictingCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.contents[key]
+	if !ok {
+		return nil, fmt.Errorf("missed cache: %q", key)
+	}
+	return &testCacheReader{bytes.NewReader(data)}, nil
+}
+
+func (c *evictingCache) Close() error { return nil }
+
+type testCacheReader struct {
+	*bytes.Reader
+}
+
+func (r *testCacheReader) Close() error { return nil }
+
+func TestEvictionPressure(t *testing.T) {
+	data := strings.Repeat(sampleData1, 3)
+	chunks := (len(data) + sampleChunkSize - 1) / sampleChunkSize
+	for _, evict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("evict_%v", evict), func(t *testing.T) {
+			c := &evictingCache{evict: evict, contents: make(map[string][]byte)}
+			b := makeBlob(
+				&httpFetcher{
+					url: testURL,
+					tr:  multiRoundTripper(t, []byte(data), allowMultiRange(true)),
+				},
+				int64(len(data)),
+				sampleChunkSize,
+				defaultPrefetchChunkSize,
+				c,
+				time.Time{},
+				0,
+				&Resolver{},
+				time.Duration(defaultFetchTimeoutSec)*time.Second)
+			err := b.Cache(0, int64(len(data)))
+			if !evict {
+				if err != nil {
+					t.Fatalf("failed to cache: %v", err)
+				}
+				if c.adds != chunks {
+					t.Errorf("all %d chunks must be added; added %d", chunks, c.adds)
+				}
+				return
+			}
+			if !errors.Is(err, ErrEvictionPressure) {
+				t.Fatalf("prefetch must stop with ErrEvictionPressure; got %v", err)
+			}
+			if c.adds > evictionPressureMinChunks {
+				t.Errorf("prefetch must stop adding evicted chunks; added %d of %d chunks", c.adds, chunks)
+			}
+
+			// Reads aren't affected by the pressure
+			p := make([]byte, sampleChunkSize)
+			if _, err := b.ReadAt(p, 0); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := data[:sampleChunkSize]; string(p) != want {
+				t.Errorf("read data %q; want %q", string(p), want)
+			}
+		})
+	}
+}
+
+func TestEvictionPressureOverlapping(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	t1 := b.startPrefetchTracking()
+	defer b.stopPrefetchTracking(t1)
+	for i := 0; i < evictionPressureMinChunks; i++ {
+		id := fmt.Sprintf("chunk-%d", i)
+		b.trackPrefetched(t1, id)
+		b.onEvicted(id)
+	}
+	if !b.evictionPressure(t1) {
+		t.Fatalf("the first call must be under eviction pressure")
+	}
+
+	// Another Cache call doesn't reset the pressure of the first one
+	t2 := b.startPrefetchTracking()
+	defer b.stopPrefetchTracking(t2)
+	b.trackPrefetched(t2, "chunk-other")
+	if !b.evictionPressure(t1) {
+		t.Errorf("the first call must stay under eviction pressure")
+	}
+	if b.evictionPressure(t2) {
+		t.Errorf("the second call must not be under eviction pressure")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var (
+		priorities []string
+		mu         sync.Mutex
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		mu.Lock()
+		priorities = append(priorities, req.Header.Get("Priority"))
+		mu.Unlock()
+		return tr(req)
+	})
+	check := func(name, want string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(priorities) == 0 {
+			t.Fatalf("%s: no request recorded", name)
+		}
+		for _, p := range priorities {
+			if p != want {
+				t.Errorf("%s: priority = %q; want %q", name, p, want)
+			}
+		}
+		priorities = nil
+	}
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	check("default read", "")
+	if _, err := b.ReadAt(p, sampleChunkSize, WithPriority(PriorityHigh)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	check("foreground read", "u=0")
+	if err := b.Cache(0, int64(len(sampleData1)), WithPriority(PriorityLow)); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	check("prefetch", "u=7")
+}
+
+func TestFetchRegionAtomic(t *testing.T) {
+	var fetches int64
+	tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(true))
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				atomic.AddInt64(&fetches, 1)
+				return tr(req)
+			}),
+		},
+		int64(len(sampleData1)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		&evictingCache{evict: true, contents: make(map[string][]byte)}, // evicts everything
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second)
+
+	for _, invalid := range []Region{{-1, 2}, {0, 0}, {8, 3}} {
+		if err := b.FetchRegionAtomic(invalid); err == nil {
+			t.Errorf("invalid region %+v must be rejected", invalid)
+		}
+	}
+	reg := Region{3, 6}
+	if err := b.FetchRegionAtomic(reg); err != nil {
+		t.Fatalf("failed to fetch region: %v", err)
+	}
+	if n := atomic.LoadInt64(&fetches); n == 0 {
+		t.Fatalf("region must be fetched from the registry")
+	}
+	read := func() {
+		p := make([]byte, reg.Size)
+		if _, err := b.ReadAt(p, reg.Offset); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if want := sampleData1[reg.Offset : reg.Offset+reg.Size]; string(p) != want {
+			t.Errorf("read data %q; want %q", string(p), want)
+		}
+	}
+
+	// The region must stay available even though the cache evicted it.
+	atomic.StoreInt64(&fetches, 0)
+	read()
+	if n := atomic.LoadInt64(&fetches); n != 0 {
+		t.Errorf("pinned region mustn't be fetched again; fetched %d times", n)
+	}
+
+	// The region is fetched again after the release.
+	b.ReleaseRegion(reg)
+	read()
+	if n := atomic.LoadInt64(&fetches); n == 0 {
+		t.Errorf("released region must be fetched from the registry")
+	}
+}
+
+func TestInFlightFetches(t *testing.T) {
+	var (
+		requested = make(chan struct{})
+		release   = make(chan struct{})
+		once      sync.Once
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		once.Do(func() { close(requested) })
+		<-release
+		return tr(req)
+	})
+	if infos := b.InFlightFetches(); len(infos) != 0 {
+		t.Fatalf("no fetch must be in flight; got %+v", infos)
+	}
+
+	start := time.Now()
+	errCh := make(chan error)
+	go func() {
+		p := make([]byte, sampleChunkSize)
+		_, err := b.ReadAt(p, sampleChunkSize)
+		errCh <- err
+	}()
+	<-requested
+	infos := b.InFlightFetches()
+	if len(infos) != 1 {
+		t.Fatalf("one fetch must be in flight; got %+v", infos)
+	}
+	if infos[0].Offset != sampleChunkSize || infos[0].Size != sampleChunkSize {
+		t.Errorf("in-flight region = (%d, %d); want (%d, %d)",
+			infos[0].Offset, infos[0].Size, sampleChunkSize, sampleChunkSize)
+	}
+	if infos[0].Start.Before(start) {
+		t.Errorf("start time %v mustn't be before %v", infos[0].Start, start)
+	}
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if infos := b.InFlightFetches(); len(infos) != 0 {
+		t.Errorf("no fetch must be in flight after the read; got %+v", infos)
+	}
+}
+
+func TestCacheControlNoStore(t *testing.T) {
+	for _, noStore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no-store_%v", noStore), func(t *testing.T) {
+			var fetches int
+			tr := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				fetches++
+				res := tr(req)
+				if noStore {
+					res.Header.Set("Cache-Control", "private, no-store")
+				}
+				return res
+			})
+			for i := 0; i < 2; i++ {
+				p := make([]byte, sampleChunkSize)
+				if _, err := b.ReadAt(p, 0); err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if want := sampleData1[:sampleChunkSize]; string(p) != want {
+					t.Errorf("read data %q; want %q", string(p), want)
+				}
+			}
+			_, err := b.cache.Get(b.fetcher.genID(region{0, sampleChunkSize - 1}))
+			if noStore {
+				if err == nil {
+					t.Errorf("chunk mustn't be cached")
+				}
+				if fetches != 2 {
+					t.Errorf("uncached chunk must be fetched on each read; fetched %d times", fetches)
+				}
+				if n := b.FetchedSize(); n != 0 {
+					t.Errorf("fetched size = %d; want 0", n)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("chunk must be cached: %v", err)
+				}
+				if fetches != 1 {
+					t.Errorf("cached chunk must be fetched once; fetched %d times", fetches)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowCheckDoesntBlockRead(t *testing.T) {
+	var (
+		checking = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		if req.Header.Get("Range") == "bytes=0-1" { // request by check
+			close(checking)
+			<-release
+		}
+		return tr(req)
+	})
+	b.checkInterval = 0
+	b.lastCheck = time.Time{}
+
+	checkErr := make(chan error)
+	go func() { checkErr <- b.Check() }()
+	<-checking
+	defer func() {
+		close(release)
+		if err := <-checkErr; err != nil {
+			t.Errorf("failed to check: %v", err)
+		}
+	}()
+
+	readErr := make(chan error)
+	go func() {
+		p := make([]byte, sampleChunkSize)
+		_, err := b.ReadAt(p, sampleChunkSize)
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	case <-time.After(time.Duration(defaultFetchTimeoutSec) * time.Second):
+		t.Fatalf("read is blocked by check")
+	}
+}
+
+func TestNoFetcher(t *testing.T) {
+	b := makeBlob(nil, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		cache.NewMemoryCache(), time.Time{}, 0, &Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second)
+	p := make([]byte, sampleChunkSize)
+	for name, f := range map[string]func() error{
+		"Check": b.Check,
+		"ReadAt": func() error {
+			_, err := b.ReadAt(p, 0)
+			return err
+		},
+		"Cache": func() error {
+			return b.Cache(0, int64(len(sampleData1)))
+		},
+		"WarmConnections": func() error {
+			return b.WarmConnections(context.Background(), 1)
+		},
+		"FetchRegionAtomic": func() error {
+			return b.FetchRegionAtomic(Region{0, sampleChunkSize})
+		},
+	} {
+		if err := f(); !errors.Is(err, ErrNoFetcher) {
+			t.Errorf("%s: must fail with ErrNoFetcher; got %v", name, err)
+		}
+	}
+}
+
+func TestShuffledOrder(t *testing.T) {
+	const seed = 42
+	data := strings.Repeat(sampleData1, 3)
+	var (
+		ranges []string
+		mu     sync.Mutex
+	)
+	tr := multiRoundTripper(t, []byte(data))
+	b := makeTestBlob(t, int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		return tr(req)
+	})
+	if err := b.Cache(0, int64(len(data)), WithShuffledOrder(seed)); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	checkAllCached(t, b, 0, int64(len(data)))
+
+	var sequential, want []string
+	for i := int64(0); i < int64(len(data)); i += sampleChunkSize {
+		e := i + sampleChunkSize - 1
+		if e >= int64(len(data)) {
+			e = int64(len(data)) - 1
+		}
+		sequential = append(sequential, fmt.Sprintf("bytes=%d-%d", i, e))
+	}
+	want = append(want, sequential...)
+	rand.New(rand.NewSource(seed)).Shuffle(len(want), func(i, j int) { want[i], want[j] = want[j], want[i] })
+	if reflect.DeepEqual(want, sequential) {
+		t.Fatalf("seed %d doesn't shuffle the chunks", seed)
+	}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("requested ranges = %v; want %v", ranges, want)
+	}
+}
+
+func TestFirstRead(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+	stats := b.BlobStats()
+	if stats.Created.IsZero() {
+		t.Fatalf("creation time must be recorded")
+	}
+	if !stats.FirstRead.IsZero() || stats.TimeToFirstRead() != 0 {
+		t.Fatalf("first read must be zero before reads; got %v", stats.FirstRead)
+	}
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	first := b.BlobStats().FirstRead
+	if first.Before(stats.Created) {
+		t.Fatalf("first read %v mustn't be before creation %v", first, stats.Created)
+	}
+	if d := b.BlobStats().TimeToFirstRead(); d != first.Sub(stats.Created) {
+		t.Errorf("time to first read = %v; want %v", d, first.Sub(stats.Created))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := b.ReadAt(p, sampleChunkSize); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got := b.BlobStats().FirstRead; !got.Equal(first) {
+		t.Errorf("first read must be unchanged by following reads; got %v; want %v", got, first)
+	}
+}
+
+func TestRangeRejectedSplitsRequest(t *testing.T) {
+	const maxSpan = 2 * sampleChunkSize
+	data := strings.Repeat(sampleData1, 2)
+	var (
+		rejected int
+		spans    []int64
+		mu       sync.Mutex
+	)
+	tr := multiRoundTripper(t, []byte(data), allowMultiRange(true))
+	b := makeTestBlob(t, int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		var begin, end int64 = -1, -1
+		for _, r := range strings.Split(strings.TrimPrefix(req.Header.Get("Range"), "bytes="), ",") {
+			var b, e int64
+			if _, err := fmt.Sscanf(r, "%d-%d", &b, &e); err != nil {
+				t.Errorf("invalid range %q: %v", r, err)
+			}
+			if begin < 0 || b < begin {
+				begin = b
+			}
+			if e > end {
+				end = e
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if span := end - begin + 1; span > maxSpan {
+			rejected++
+			return &http.Response{
+				StatusCode: http.StatusRequestEntityTooLarge,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			}
+		}
+		spans = append(spans, end-begin+1)
+		return tr(req)
+	})
+	if err := b.Cache(0, int64(len(data))); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	checkAllCached(t, b, 0, int64(len(data)))
+	if rejected == 0 {
+		t.Errorf("coalesced request must be rejected")
+	}
+	var total int64
+	for _, s := range spans {
+		total += s
+	}
+	if total != int64(len(data)) {
+		t.Errorf("smaller batches must fetch the whole blob; fetched %d bytes in %v", total, spans)
+	}
+}
+
+func TestRefreshDuringRead(t *testing.T) {
+	const otherData = "abcdefghij"
+	var (
+		b    *blob
+		once sync.Once
+	)
+	refreshed := &httpFetcher{
+		url:     testURL,
+		blobURL: "refreshed",
+		tr:      multiRoundTripper(t, []byte(otherData)),
+	}
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	orig := &httpFetcher{
+		url:     testURL,
+		blobURL: "orig",
+		tr: RoundTripFunc(func(req *http.Request) *http.Response {
+			// Refresh lands in the middle of the read.
+			once.Do(func() {
+				b.fetcherMu.Lock()
+				b.fetcher = refreshed
+				b.fetcherMu.Unlock()
+			})
+			return tr(req)
+		}),
+	}
+	b = makeBlob(orig, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		cache.NewMemoryCache(), time.Time{}, 0, &Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second)
+
+	// Read chunk by chunk so that the read makes multiple requests.
+	p := make([]byte, len(sampleData1))
+	if _, err := b.ReadAt(p, 0, WithReadWindow(1)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(p) != sampleData1 {
+		t.Errorf("read data %q; want %q", string(p), sampleData1)
+	}
+	b.walkChunks(region{0, int64(len(sampleData1)) - 1}, func(chunk region) error {
+		if _, err := b.cache.Get(orig.genID(chunk)); err != nil {
+			t.Errorf("chunk %+v must be cached with the key of the fetcher at the read start: %v", chunk, err)
+		}
+		if _, err := b.cache.Get(refreshed.genID(chunk)); err == nil {
+			t.Errorf("chunk %+v mustn't be cached with the key of the refreshed fetcher", chunk)
+		}
+		return nil
+	})
+
+	// The following reads use the refreshed fetcher.
+	if fr, err := b.getFetcher(); err != nil || fr != refreshed {
+		t.Errorf("following reads must use the refreshed fetcher")
+	}
+}
+
+func TestWalkChunksWithShrinkingSize(t *testing.T) {
+	const newSize = 4
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	var walked []region
+	if err := b.walkChunks(region{0, int64(len(sampleData1)) - 1}, func(chunk region) error {
+		walked = append(walked, chunk)
+		atomic.StoreInt64(&b.size, newSize) // the size is updated during the walk
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk chunks: %v", err)
+	}
+	want := []region{{0, 2}, {3, newSize - 1}}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("walked chunks = %v; want %v", walked, want)
+	}
+}
+
+func TestConcurrentSizeUpdate(t *testing.T) {
+	const (
+		origSize = int64(len(sampleData1))
+		newSize  = 4
+	)
+	b := makeTestBlob(t, origSize, sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	done := make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			size := origSize
+			if i%2 == 0 {
+				size = newSize
+			}
+			atomic.StoreInt64(&b.size, size)
+			time.Sleep(time.Microsecond)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		var next int64
+		if err := b.walkChunks(region{0, origSize - 1}, func(chunk region) error {
+			if chunk.b != next || chunk.e < chunk.b || chunk.e >= origSize {
+				t.Fatalf("walked out-of-range chunk %+v (next %d)", chunk, next)
+			}
+			next = chunk.e + 1
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to walk chunks: %v", err)
+		}
+		// Any result is fine as long as there is no out-of-range access.
+		b.ReadAt(make([]byte, origSize), 0)
+		b.CachedRanges()
+		b.CachePlan(0, origSize)
+	}
+	close(done)
+	<-updated
+}
+
+// brokenCache is a cache which fails all operations.
+type brokenCache struct{}
+
+func (brokenCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	return nil, fmt.Errorf("disk is broken")
+}
+func (brokenCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	return nil, fmt.Errorf("disk is broken")
+}
+func (brokenCache) Close() error { return nil }
+
+func TestCacheErrorContext(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	b.cache = brokenCache{}
+	chunk := region{0, sampleChunkSize - 1}
+	id := b.fetcher.genID(chunk)
+	check := func(name string, err error) {
+		if err == nil {
+			t.Fatalf("%s: must fail", name)
+		}
+		for _, want := range []string{id, fmt.Sprintf("%+v", chunk)} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q must contain %q", name, err, want)
+			}
+		}
+	}
+
+	p := make([]byte, sampleChunkSize)
+	_, err := b.ReadAt(p, 0)
+	check("add", err)
+	check("get", b.readCache(chunk, p, 0, b.fetcher, &options{}))
+}
+
+func TestMaterializedLayerClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layer")
+	if err := os.WriteFile(path, []byte(sampleData1), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	b := makeBlob(&httpFetcher{url: testURL, tr: failRoundTripper()},
+		int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, cache.NewMemoryCache(),
+		time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second,
+		WithMaterializedLayer(path))
+
+	var eg errgroup.Group
+	for i := 0; i < 4; i++ {
+		eg.Go(func() error {
+			p := make([]byte, len(sampleData1))
+			for {
+				if _, err := b.ReadAt(p, 0); errors.Is(err, ErrBlobClosed) {
+					return nil
+				} else if err != nil {
+					return err // e.g. the file is closed during the read
+				}
+			}
+		})
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := eg.Wait(); err != nil {
+		t.Errorf("reads racing with Close must fail with ErrBlobClosed: %v", err)
+	}
+}
+
+func TestMaterializedLayer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layer")
+	var fetches int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				atomic.AddInt64(&fetches, 1)
+				return tr(req)
+			}),
+		},
+		int64(len(sampleData1)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		brokenCache{}, // fails if the cache is used
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second,
+		WithMaterializedLayer(path))
+	defer b.Close()
+
+	// The layer isn't materialized yet.
+	if b.IsMaterialized() {
+		t.Fatalf("layer mustn't be materialized before the file exists")
+	}
+	if err := os.WriteFile(path, []byte(sampleData1[:5]), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if b.IsMaterialized() {
+		t.Fatalf("layer mustn't be materialized until the file has the full size")
+	}
+
+	if err := os.WriteFile(path, []byte(sampleData1), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if !b.IsMaterialized() {
+		t.Fatalf("layer must be materialized")
+	}
+	for offset := int64(0); offset < int64(len(sampleData1)); offset++ {
+		for size := int64(1); size <= int64(len(sampleData1))-offset+2; size++ {
+			p := make([]byte, size)
+			n, err := b.ReadAt(p, offset)
+			if err != nil {
+				t.Fatalf("failed to read (offset=%d,size=%d): %v", offset, size, err)
+			}
+			want := sampleData1[offset:]
+			if int64(len(want)) > size {
+				want = want[:size]
+			}
+			if string(p[:n]) != want {
+				t.Errorf("read data (offset=%d,size=%d) = %q; want %q", offset, size, string(p[:n]), want)
+			}
+		}
+	}
+	if err := b.Cache(0, int64(len(sampleData1))); err != nil {
+		t.Errorf("cache must be a no-op: %v", err)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 0 {
+		t.Errorf("materialized layer mustn't be fetched; fetched %d times", n)
+	}
+}
+
+// closeCheckingCache is a memory cache which reports the use after Close.
+type closeCheckingCache struct {
+	cache.BlobCache
+	t      *testing.T
+	closed int32
+}
+
+func (c *closeCheckingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		c.t.Errorf("cache is written after close: %q", key)
+	}
+	return c.BlobCache.Add(key, opts...)
+}
+
+func (c *closeCheckingCache) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.BlobCache.Close()
+}
+
+func TestCloseDuringFetch(t *testing.T) {
+	const routines = 10
+	data := strings.Repeat(sampleData1, routines)
+	c := &closeCheckingCache{BlobCache: cache.NewMemoryCache(), t: t}
+	var (
+		requested = make(chan struct{})
+		once      sync.Once
+	)
+	tr := multiRoundTripper(t, []byte(data))
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				once.Do(func() { close(requested) })
+				time.Sleep(10 * time.Millisecond)
+				return tr(req)
+			}),
+		},
+		int64(len(data)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		c,
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, len(sampleData1))
+			// The read may fail if it starts after Close.
+			b.ReadAt(p, int64(i*len(sampleData1)))
+		}(i)
+	}
+	<-requested
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	wg.Wait()
+
+	if _, err := b.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Errorf("read after close must fail")
+	}
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	const (
+		routines = 100
+		limit    = 4
+	)
+	data := strings.Repeat("x", routines*sampleChunkSize)
+	tr := &callsCountRoundTripper{content: data}
+	var inFlight, maxInFlight int64
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				n := atomic.AddInt64(&inFlight, 1)
+				defer atomic.AddInt64(&inFlight, -1)
+				for {
+					max := atomic.LoadInt64(&maxInFlight)
+					if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+						break
+					}
+				}
+				res, _ := tr.RoundTrip(req)
+				return res
+			}),
+		},
+		int64(len(data)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		cache.NewMemoryCache(),
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second,
+		WithMaxConcurrentFetches(limit))
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offset := int64(i * sampleChunkSize)
+			if i%2 == 0 {
+				p := make([]byte, sampleChunkSize)
+				if _, err := b.ReadAt(p, offset); err != nil {
+					t.Errorf("failed to read: %v", err)
+				}
+				return
+			}
+			if err := b.Cache(offset, sampleChunkSize); err != nil {
+				t.Errorf("failed to cache: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt64(&maxInFlight); max > limit {
+		t.Errorf("max concurrency = %d; want <= %d", max, limit)
+	}
+}
+
+func TestMaxConcurrentFetchesCancel(t *testing.T) {
+	var (
+		requested = make(chan struct{})
+		release   = make(chan struct{})
+		once      sync.Once
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				once.Do(func() { close(requested) })
+				<-release
+				return tr(req)
+			}),
+		},
+		int64(len(sampleData1)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		cache.NewMemoryCache(),
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second,
+		WithMaxConcurrentFetches(1))
+
+	errCh := make(chan error)
+	go func() {
+		_, err := b.ReadAt(make([]byte, sampleChunkSize), 0)
+		errCh <- err
+	}()
+	<-requested
+
+	// The slot is taken by the first read.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), sampleChunkSize, WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting read must give up with the context; got %v", err)
+	}
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+}
+
+func TestBlobStatsCounters(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(true))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+
+	// Pre-fill the cache with the 1st and the 3rd chunks.
+	for _, offset := range []int64{0, 2 * sampleChunkSize} {
+		if _, err := b.ReadAt(make([]byte, sampleChunkSize), offset); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	}
+	b.ResetStats()
+	if stats := b.BlobStats(); stats.CacheHits != 0 || stats.CacheMisses != 0 ||
+		stats.CacheBytes != 0 || stats.FetchedBytes != 0 || stats.RoundTrips != 0 {
+		t.Fatalf("counters must be reset: %+v", stats)
+	}
+
+	// Chunks: [0,2] (cached), [3,5], [6,8] (cached), [9,9]
+	p := make([]byte, len(sampleData1))
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(p) != sampleData1 {
+		t.Fatalf("read data %q; want %q", string(p), sampleData1)
+	}
+	stats := b.BlobStats()
+	if stats.CacheHits != 2 || stats.CacheMisses != 2 {
+		t.Errorf("hits/misses = %d/%d; want 2/2", stats.CacheHits, stats.CacheMisses)
+	}
+	if stats.CacheBytes != 2*sampleChunkSize {
+		t.Errorf("cache bytes = %d; want %d", stats.CacheBytes, 2*sampleChunkSize)
+	}
+	if want := int64(len(sampleData1)) - 2*sampleChunkSize; stats.FetchedBytes != want {
+		t.Errorf("fetched bytes = %d; want %d", stats.FetchedBytes, want)
+	}
+	if stats.RoundTrips != 1 {
+		t.Errorf("round trips = %d; want 1", stats.RoundTrips)
+	}
+
+	// All chunks are cached now.
+	b.ResetStats()
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	stats = b.BlobStats()
+	if stats.CacheHits != 4 || stats.CacheMisses != 0 || stats.RoundTrips != 0 || stats.FetchedBytes != 0 {
+		t.Errorf("all chunks must be served from the cache: %+v", stats)
+	}
+}
+
+func TestOverFetchedBytes(t *testing.T) {
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, tr)
+
+	// Reading 1 byte in the middle of the chunk [0, 2] fetches the whole chunk.
+	if _, err := b.ReadAt(make([]byte, 1), sampleMiddleOffset); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got, want := b.BlobStats().OverFetchedBytes, int64(sampleChunkSize-1); got != want {
+		t.Errorf("over-fetched bytes = %d; want %d", got, want)
+	}
+
+	// The rest of the chunk is served from the cache without over-fetching.
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got, want := b.BlobStats().OverFetchedBytes, int64(sampleChunkSize-1); got != want {
+		t.Errorf("over-fetched bytes = %d; want %d", got, want)
+	}
+
+	// [5, 6] spans the chunks [3, 5] and [6, 8], and [9, 9] is read fully.
+	b.ResetStats()
+	if _, err := b.ReadAt(make([]byte, 2), 2*sampleChunkSize-1); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if _, err := b.ReadAt(make([]byte, 1), 3*sampleChunkSize); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got, want := b.BlobStats().OverFetchedBytes, int64(2*sampleChunkSize-2); got != want {
+		t.Errorf("over-fetched bytes = %d; want %d", got, want)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestWholeBlobResponseStreaming(t *testing.T) {
+	const (
+		size      = 64 << 20
+		chunkSize = 1 << 20
+	)
+	var read int64
+	c := &testChunkCountingCache{
+		consumed: func() int64 { return atomic.LoadInt64(&read) },
+	}
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				// The registry ignores the range and returns the whole blob.
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Length": []string{strconv.Itoa(size)}},
+					Body:       io.NopCloser(&testCountingReader{io.LimitReader(zeroReader{}, size), &read}),
+				}
+			}),
+		},
+		size,
+		chunkSize,
+		defaultPrefetchChunkSize,
+		c,
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second)
+
+	if _, err := b.ReadAt(make([]byte, chunkSize), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.added != size/chunkSize {
+		t.Errorf("whole blob must be cached chunk by chunk; cached %d chunks", c.added)
+	}
+	if c.maxWrite > chunkSize {
+		t.Errorf("a single cache write of %d bytes must not exceed the chunk size", c.maxWrite)
+	}
+	// The first chunk must be committed while the body is still being read;
+	// buffering the whole body first would consume it entirely.
+	if c.consumedAtFirstCommit >= size {
+		t.Errorf("the first chunk was committed after reading %d bytes; must stream", c.consumedAtFirstCommit)
+	}
+}
+
+// testCountingReader counts the bytes read from the underlying reader.
+type testCountingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *testCountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// testChunkCountingCache discards the contents and records the committed
+// chunks and the largest single write.
+type testChunkCountingCache struct {
+	forgetfulCache
+	consumed func() int64
+
+	mu                    sync.Mutex
+	added                 int64
+	maxWrite              int
+	consumedAtFirstCommit int64
+}
+
+func (c *testChunkCountingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	w := func(p []byte) (int, error) {
+		c.mu.Lock()
+		if len(p) > c.maxWrite {
+			c.maxWrite = len(p)
+		}
+		c.mu.Unlock()
+		return len(p), nil
+	}
+	return &testCacheWriter{Writer: writerFunc(w), commit: func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.added == 0 {
+			c.consumedAtFirstCommit = c.consumed()
+		}
+		c.added++
+		return nil
+	}}, nil
+}
+
+// testChunkDigests provides the digests of the chunks of data.
+type testChunkDigests struct {
+	data      string
+	chunkSize int64
+}
+
+func (d testChunkDigests) ChunkDigest(offset int64) (digest.Digest, bool) {
+	if offset%d.chunkSize != 0 || offset >= int64(len(d.data)) {
+		return "", false
+	}
+	end := offset + d.chunkSize
+	if end > int64(len(d.data)) {
+		end = int64(len(d.data))
+	}
+	return digest.FromString(d.data[offset:end]), true
+}
+
+func TestDigestCoalescing(t *testing.T) {
+	const data = "abcXYZabcQ" // chunks at 0 and 6 have identical contents
+	for _, coalesce := range []bool{false, true} {
+		t.Run(fmt.Sprintf("coalesce_%v", coalesce), func(t *testing.T) {
+			var fetches int64
+			tr := multiRoundTripper(t, []byte(data))
+			var opts []BlobOption
+			if coalesce {
+				opts = append(opts, WithDigestCoalescing(testChunkDigests{data, sampleChunkSize}))
+			}
+			b := makeBlob(
+				&httpFetcher{
+					url: testURL,
+					tr: RoundTripFunc(func(req *http.Request) *http.Response {
+						atomic.AddInt64(&fetches, 1)
+						time.Sleep(100 * time.Millisecond) // let the concurrent read join
+						return tr(req)
+					}),
+				},
+				int64(len(data)),
+				sampleChunkSize,
+				defaultPrefetchChunkSize,
+				cache.NewMemoryCache(),
+				time.Time{},
+				0,
+				&Resolver{},
+				time.Duration(defaultFetchTimeoutSec)*time.Second,
+				opts...)
+
+			var wg sync.WaitGroup
+			for _, offset := range []int64{0, 6} {
+				wg.Add(1)
+				go func(offset int64) {
+					defer wg.Done()
+					p := make([]byte, sampleChunkSize)
+					if _, err := b.ReadAt(p, offset); err != nil {
+						t.Errorf("failed to read: %v", err)
+						return
+					}
+					if want := data[offset : offset+sampleChunkSize]; string(p) != want {
+						t.Errorf("read data at %d = %q; want %q", offset, string(p), want)
+					}
+				}(offset)
+			}
+			wg.Wait()
+			want := int64(2)
+			if coalesce {
+				want = 1
+			}
+			if n := atomic.LoadInt64(&fetches); n != want {
+				t.Errorf("fetched %d times; want %d", n, want)
+			}
+
+			// Both chunks are cached.
+			checkAllCached(t, b, 0, sampleChunkSize)
+			checkAllCached(t, b, 6, sampleChunkSize)
+		})
+	}
+}
+
+func TestDigestCoalescingInOneRead(t *testing.T) {
+	const data = "abcXYZabcQ" // chunks at 0 and 6 have identical contents
+	var fetches int64
+	tr := multiRoundTripper(t, []byte(data))
+	b := makeBlob(
+		&httpFetcher{
+			url: testURL,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				atomic.AddInt64(&fetches, 1)
+				return tr(req)
+			}),
+		},
+		int64(len(data)),
+		sampleChunkSize,
+		defaultPrefetchChunkSize,
+		cache.NewMemoryCache(),
+		time.Time{},
+		0,
+		&Resolver{},
+		time.Duration(defaultFetchTimeoutSec)*time.Second,
+		WithDigestCoalescing(testChunkDigests{data, sampleChunkSize}))
+
+	p := make([]byte, len(data))
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(p) != data {
+		t.Errorf("read data = %q; want %q", string(p), data)
+	}
+	// The unique chunks are fetched in one request and the duplicated chunk is
+	// filled from the cached contents.
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("fetched %d times; want 1", n)
+	}
+	checkAllCached(t, b, 0, int64(len(data)))
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		failCode       int
+		opts           []Option
+		wantRoundTrips int64
+		wantErr        bool
+	}{
+		{
+			name:           "server error",
+			failCode:       http.StatusInternalServerError,
+			wantRoundTrips: 3,
+		},
+		{
+			name:           "not found",
+			failCode:       http.StatusNotFound,
+			wantRoundTrips: 1,
+			wantErr:        true,
+		},
+		{
+			name:           "range not satisfiable",
+			failCode:       http.StatusRequestedRangeNotSatisfiable,
+			wantRoundTrips: 1,
+			wantErr:        true,
+		},
+		{
+			name:           "disabled by option",
+			failCode:       http.StatusInternalServerError,
+			opts:           []Option{WithFetchRetries(1, 0)},
+			wantRoundTrips: 1,
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var roundTrips int64
+			rt := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					if n := atomic.AddInt64(&roundTrips, 1); n <= 2 {
+						return &http.Response{
+							StatusCode: tt.failCode,
+							Status:     http.StatusText(tt.failCode),
+							Header:     make(http.Header),
+							Body:       io.NopCloser(bytes.NewReader([]byte{})),
+						}
+					}
+					return rt(req)
+				})
+			withFetchRetries(5, time.Millisecond)(b)
+			p := make([]byte, sampleChunkSize)
+			_, err := b.ReadAt(p, 0, tt.opts...)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("read must fail")
+				}
+			} else if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			} else if string(p) != sampleData1[:sampleChunkSize] {
+				t.Errorf("read %q; want %q", string(p), sampleData1[:sampleChunkSize])
+			}
+			if n := atomic.LoadInt64(&roundTrips); n != tt.wantRoundTrips {
+				t.Errorf("round trips = %d; want %d", n, tt.wantRoundTrips)
+			}
+		})
+	}
+}
+
+func TestFetchRetriesWithTransportRetries(t *testing.T) {
+	for _, attempts := range []int{0, 3} {
+		t.Run(fmt.Sprintf("attempts_%d", attempts), func(t *testing.T) {
+			var roundTrips int64
+			rclient := rhttp.NewClient()
+			rclient.RetryMax = 2
+			rclient.RetryWaitMin, rclient.RetryWaitMax = 0, 0
+			rclient.CheckRetry = retryStrategy
+			rclient.HTTPClient.Transport = &countingErrRoundTripper{
+				errRoundTripper{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+				&roundTrips,
+			}
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, nil)
+			b.fetcher = &httpFetcher{url: testURL, tr: &rhttp.RoundTripper{Client: rclient}}
+			withFetchRetries(attempts, 0)(b)
+			if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err == nil {
+				t.Fatalf("read must fail")
+			}
+			// The transport retries only if the blob doesn't.
+			want := int64(1 + rclient.RetryMax)
+			if attempts > 1 {
+				want = int64(attempts)
+			}
+			if n := atomic.LoadInt64(&roundTrips); n != want {
+				t.Errorf("round trips = %d; want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestFetchRetriesBackoff(t *testing.T) {
+	const baseDelay = time.Millisecond
+	var (
+		ceils []int64
+		mu    sync.Mutex
+	)
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, failRoundTripper())
+	withFetchRetries(4, baseDelay)(b)
+	b.fetchBackoff = newBackoffStrategy(func(n int64) int64 {
+		mu.Lock()
+		ceils = append(ceils, n)
+		mu.Unlock()
+		return 0
+	})
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err == nil {
+		t.Fatalf("read must fail")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []int64{int64(baseDelay) + 1, int64(2*baseDelay) + 1, int64(4*baseDelay) + 1}
+	if !reflect.DeepEqual(ceils, want) {
+		t.Errorf("backoff ceils = %v; want %v", ceils, want)
+	}
+}
+
+func TestFetchRetriesRespectDeadline(t *testing.T) {
+	var roundTrips int64
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&roundTrips, 1)
+			return failRoundTripper()(req)
+		})
+	withFetchRetries(5, time.Hour)(b)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0, WithContext(ctx)); err == nil {
+		t.Fatalf("read must fail")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("retries must stop at the deadline; took %v", d)
+	}
+	if n := atomic.LoadInt64(&roundTrips); n >= 5 {
+		t.Errorf("round trips = %d; want fewer than 5", n)
+	}
+}
+
+// slowCommitCache is evictingCache whose commits wait for release.
+type slowCommitCache struct {
+	*evictingCache
+	release chan struct{}
+}
+
+func (c *slowCommitCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	w, err := c.evictingCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tw := w.(*testCacheWriter)
+	commit := tw.commit
+	tw.commit = func() error {
+		<-c.release
+		return commit()
+	}
+	return tw, nil
+}
+
+func TestAsyncCacheFill(t *testing.T) {
+	c := &slowCommitCache{
+		evictingCache: &evictingCache{contents: make(map[string][]byte)},
+		release:       make(chan struct{}),
+	}
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	b.cache = c
+	WithAsyncCacheFill(2)(b)
+	chunk := region{0, sampleChunkSize - 1}
+
+	done := make(chan error)
+	p := make([]byte, sampleChunkSize)
+	go func() {
+		_, err := b.ReadAt(p, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		close(c.release)
+		t.Fatalf("read must return before the cache write completes")
+	}
+	if string(p) != sampleData1[:sampleChunkSize] {
+		t.Errorf("read %q; want %q", string(p), sampleData1[:sampleChunkSize])
+	}
+	if _, err := c.Get(b.fetcher.genID(chunk)); err == nil {
+		t.Errorf("chunk must not be cached before the write completes")
+	}
+
+	close(c.release)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := c.Get(b.fetcher.genID(chunk)); err == nil {
+			break
+		} else if time.Since(start) > 10*time.Second {
+			t.Fatalf("chunk must be cached eventually: %v", err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, readAhead := range []int{0, 1, 3} {
+		for _, bufSize := range []int{1, 2, sampleChunkSize, 100} {
+			for offset := 0; offset <= len(sampleData1); offset++ {
+				name := fmt.Sprintf("readahead=%d,buf=%d,offset=%d", readAhead, bufSize, offset)
+				b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+					multiRoundTripper(t, []byte(sampleData1)))
+				r := b.Reader(int64(offset), WithReadAhead(readAhead))
+				var got []byte
+				buf := make([]byte, bufSize)
+				for {
+					n, err := r.Read(buf)
+					got = append(got, buf[:n]...)
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("%s: failed to read: %v", name, err)
+					}
+				}
+				if string(got) != sampleData1[offset:] {
+					t.Errorf("%s: read %q; want %q", name, string(got), sampleData1[offset:])
+				}
+				if n, err := r.Read(buf); n != 0 || err != io.EOF {
+					t.Errorf("%s: read after EOF = %d, %v; want 0, EOF", name, n, err)
+				}
+				if err := r.Close(); err != nil {
+					t.Fatalf("%s: failed to close reader: %v", name, err)
+				}
+				if _, err := b.ReadAt(make([]byte, 1), 0); err != nil {
+					t.Errorf("%s: blob must be readable after closing the reader: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	tests := []struct {
+		name           string
+		regions        []Region
+		wantRoundTrips int64
+	}{
+		{
+			name:           "adjacent",
+			regions:        []Region{{6, 3}, {0, 3}, {3, 3}},
+			wantRoundTrips: 1,
+		},
+		{
+			name:           "overlapping",
+			regions:        []Region{{1, 4}, {0, 2}, {4, 3}},
+			wantRoundTrips: 1,
+		},
+		{
+			name:           "separated",
+			regions:        []Region{{9, 1}, {0, 3}},
+			wantRoundTrips: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var roundTrips int64
+			rt := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					atomic.AddInt64(&roundTrips, 1)
+					if got := req.Header.Get("Priority"); got != "u=7" {
+						t.Errorf("Priority = %q; want %q", got, "u=7")
+					}
+					return rt(req)
+				})
+			if err := <-b.Prefetch(tt.regions); err != nil {
+				t.Fatalf("failed to prefetch: %v", err)
+			}
+			if n := atomic.LoadInt64(&roundTrips); n != tt.wantRoundTrips {
+				t.Errorf("round trips = %d; want %d", n, tt.wantRoundTrips)
+			}
+			for _, r := range tt.regions {
+				checkAllCached(t, b, r.Offset, r.Size)
+			}
+
+			// The cached regions aren't fetched again.
+			if err := <-b.Prefetch(tt.regions); err != nil {
+				t.Fatalf("failed to prefetch again: %v", err)
+			}
+			if n := atomic.LoadInt64(&roundTrips); n != tt.wantRoundTrips {
+				t.Errorf("round trips = %d after prefetching cached regions; want %d", n, tt.wantRoundTrips)
+			}
+		})
+	}
+}
+
+func TestMaxCacheEntries(t *testing.T) {
+	data := []byte(strings.Repeat(sampleData1, 10))
+	chunks := (len(data) + sampleChunkSize - 1) / sampleChunkSize
+	for _, maxEntries := range []int{0, 10, 1} {
+		t.Run(fmt.Sprintf("max=%d", maxEntries), func(t *testing.T) {
+			b := makeBlob(&httpFetcher{url: testURL, tr: multiRoundTripper(t, data)},
+				int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, cache.NewMemoryCache(),
+				time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second,
+				WithMaxCacheEntries(maxEntries))
+			if _, ok := b.cache.(*packingCache); ok != (maxEntries > 0) {
+				t.Errorf("the cache must be wrapped iff the entries are capped")
+			}
+			readAll := func() {
+				for offset := 0; offset < len(data); offset += sampleChunkSize {
+					end := offset + sampleChunkSize
+					if end > len(data) {
+						end = len(data)
+					}
+					p := make([]byte, end-offset)
+					if _, err := b.ReadAt(p, int64(offset)); err != nil {
+						t.Fatalf("failed to read at %d: %v", offset, err)
+					}
+					if !bytes.Equal(p, data[offset:end]) {
+						t.Fatalf("read %q at %d; want %q", string(p), offset, string(data[offset:end]))
+					}
+				}
+			}
+			readAll()
+			entries := b.BlobStats().CacheEntries
+			if maxEntries == 0 {
+				if entries != int64(chunks) {
+					t.Errorf("entries = %d; want %d", entries, chunks)
+				}
+			} else if entries > int64(maxEntries) {
+				t.Errorf("entries = %d; want at most %d", entries, maxEntries)
+			}
+
+			// All chunks are read from the cache.
+			b.fetcher = &httpFetcher{url: testURL, tr: failRoundTripper()}
+			readAll()
+			if got := b.BlobStats().CacheEntries; got != entries {
+				t.Errorf("entries = %d after reading from the cache; want %d", got, entries)
+			}
+		})
+	}
+}
+
+func TestMaxCacheEntriesAfterRecreation(t *testing.T) {
+	const maxEntries = 3
+	data := []byte(strings.Repeat(sampleData1, 10))
+	mc := cache.NewMemoryCache().(*cache.MemoryCache)
+	newBlob := func(tr http.RoundTripper) *blob {
+		return makeBlob(&httpFetcher{url: testURL, tr: tr},
+			int64(len(data)), sampleChunkSize, defaultPrefetchChunkSize, mc,
+			time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second,
+			WithMaxCacheEntries(maxEntries))
+	}
+	readAll := func(b *blob) {
+		p := make([]byte, len(data))
+		if _, err := b.ReadAt(p, 0); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if !bytes.Equal(p, data) {
+			t.Fatalf("read %q; want %q", string(p), string(data))
+		}
+	}
+	b := newBlob(multiRoundTripper(t, data))
+	for offset := int64(0); offset < int64(len(data)); offset += sampleChunkSize {
+		if _, err := b.ReadAt(make([]byte, 1), offset); err != nil {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+	}
+	entries := b.BlobStats().CacheEntries
+	// Closing the blob flushes the partially filled pack.
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if n := int64(len(mc.Membuf)); n != entries {
+		t.Errorf("the cache has %d entries; want %d", n, entries)
+	}
+
+	// The packed chunks are read from the cache by the recreated blob.
+	b = newBlob(failRoundTripper())
+	readAll(b)
+	if got := b.BlobStats().CacheEntries; got > maxEntries {
+		t.Errorf("entries = %d after recreation; want at most %d", got, maxEntries)
+	}
+}
+
+// slowGetCache delays Get of the key.
+type slowGetCache struct {
+	cache.BlobCache
+	key   string
+	delay time.Duration
+}
+
+func (c *slowGetCache) Get(key string, opts ...cache.Option) (cache.Reader, error) {
+	if key == c.key {
+		time.Sleep(c.delay)
+	}
+	return c.BlobCache.Get(key, opts...)
+}
+
+func TestPackingCacheConcurrentFlush(t *testing.T) {
+	const (
+		base     = "test"
+		routines = 8
+		perRoute = 20
+	)
+	mc := cache.NewMemoryCache().(*cache.MemoryCache)
+	add := func(c *packingCache, key string) error {
+		w, err := c.Add(key)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(key)); err != nil {
+			return err
+		}
+		return w.Commit()
+	}
+
+	// Another instance adds the first pack after this one is created so that
+	// the flush finds and loads it.
+	other := newPackingCache(mc, 1, 4, base)
+	for i := 0; i < 4; i++ {
+		if err := add(other, fmt.Sprintf("other-%d", i)); err != nil {
+			t.Fatalf("failed to add: %v", err)
+		}
+	}
+	firstPack := other.packKey(0)
+	packed := mc.Membuf[firstPack]
+	delete(mc.Membuf, firstPack)
+	// Loading the pack is slow so that it overlaps the concurrent adds.
+	c := newPackingCache(&slowGetCache{BlobCache: mc, key: firstPack, delay: 10 * time.Millisecond},
+		1, routines*perRoute/2, base)
+	mc.Membuf[firstPack] = packed
+
+	var eg errgroup.Group
+	for i := 0; i < routines; i++ {
+		i := i
+		eg.Go(func() error {
+			for j := 0; j < perRoute; j++ {
+				if err := add(c, fmt.Sprintf("key-%d-%d", i, j)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	for i := 0; i < routines; i++ {
+		for j := 0; j < perRoute; j++ {
+			key := fmt.Sprintf("key-%d-%d", i, j)
+			r, err := c.Get(key)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", key, err)
+			}
+			p := make([]byte, len(key))
+			if _, err := r.ReadAt(p, 0); err != nil && err != io.EOF {
+				t.Fatalf("failed to read %q: %v", key, err)
+			}
+			r.Close()
+			if string(p) != key {
+				t.Errorf("read %q; want %q", string(p), key)
+			}
+		}
+	}
+}
+
+func TestCoalesceGap(t *testing.T) {
+	for _, tt := range []struct {
+		gap       int64
+		wantRange string
+	}{
+		{gap: 0, wantRange: "bytes=0-2,6-8"},
+		{gap: sampleChunkSize - 1, wantRange: "bytes=0-2,6-8"},
+		{gap: sampleChunkSize, wantRange: "bytes=0-8"},
+	} {
+		t.Run(fmt.Sprintf("gap=%d", tt.gap), func(t *testing.T) {
+			var ranges []string
+			var mu sync.Mutex
+			rt := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					mu.Lock()
+					ranges = append(ranges, req.Header.Get("Range"))
+					mu.Unlock()
+					return rt(req)
+				})
+			WithCoalesceGap(tt.gap)(b)
+			p1, p2 := make([]byte, sampleChunkSize), make([]byte, sampleChunkSize)
+			if err := b.fetchRange(map[region]io.Writer{
+				{0, 2}: newBytesWriter(p1, 0),
+				{6, 8}: newBytesWriter(p2, 0),
+			}, &options{}); err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			if string(p1) != sampleData1[0:3] || string(p2) != sampleData1[6:9] {
+				t.Errorf("fetched %q, %q; want %q, %q", string(p1), string(p2), sampleData1[0:3], sampleData1[6:9])
+			}
+			if len(ranges) != 1 || ranges[0] != tt.wantRange {
+				t.Errorf("requested ranges %q; want [%q]", ranges, tt.wantRange)
+			}
+			checkAllCached(t, b, 0, 3)
+			checkAllCached(t, b, 6, 3)
+			if _, err := b.cache.Get(b.fetcher.genID(region{3, 5})); (err == nil) != (tt.wantRange == "bytes=0-8") {
+				t.Errorf("the gap must be cached iff it's fetched; got %v", err)
+			}
+		})
+	}
+}
+
+func TestErrBlobClosed(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	for name, f := range map[string]func() error{
+		"ReadAt": func() error {
+			_, err := b.ReadAt(make([]byte, 1), 0)
+			return err
+		},
+		"ReadAtWithDigest": func() error {
+			_, _, err := b.ReadAtWithDigest(make([]byte, 1), 0, digest.SHA256)
+			return err
+		},
+		"Cache": func() error { return b.Cache(0, 1) },
+		"Refresh": func() error {
+			return b.Refresh(context.Background(), nil, reference.Spec{}, ocispec.Descriptor{})
+		},
+		"Check":             b.Check,
+		"Verify":            func() error { return b.Verify(digest.FromString(sampleData1)) },
+		"WarmConnections":   func() error { return b.WarmConnections(context.Background(), 1) },
+		"FetchRegionAtomic": func() error { return b.FetchRegionAtomic(Region{0, 3}) },
+		"Prefetch":          func() error { return <-b.Prefetch([]Region{{0, 1}}) },
+		"Reader": func() error {
+			_, err := b.Reader(0).Read(make([]byte, 1))
+			return err
+		},
+	} {
+		if err := f(); !errors.Is(err, ErrBlobClosed) {
+			t.Errorf("%s must fail with ErrBlobClosed; got %v", name, err)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	withTracer(tracer)(b)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithContext(ctx)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	root.End()
+
+	readAt := tracer.span(t, "ReadAt", root)
+	if got := readAt.attrs["size"]; got.AsInt64() != sampleChunkSize {
+		t.Errorf("ReadAt size = %v; want %d", got.Emit(), sampleChunkSize)
+	}
+	if got := tracer.span(t, "readFromCache", readAt).attrs["cache_hit"]; got.AsBool() {
+		t.Errorf("the read of the empty cache must miss")
+	}
+	if got := tracer.span(t, "fetchRegions", readAt).attrs["bytes"]; got.AsInt64() != sampleChunkSize {
+		t.Errorf("fetched bytes = %v; want %d", got.Emit(), sampleChunkSize)
+	}
+	for _, s := range tracer.spans {
+		if !s.ended {
+			t.Errorf("span %q isn't ended", s.name)
+		}
+	}
+
+	// The cached chunk is served without fetching.
+	tracer.spans = nil
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	readAt = tracer.span(t, "ReadAt", nil)
+	if got := tracer.span(t, "readFromCache", readAt).attrs["cache_hit"]; !got.AsBool() {
+		t.Errorf("the read of the cached chunk must hit")
+	}
+	for _, s := range tracer.spans {
+		if s.name == "fetchRegions" {
+			t.Errorf("the cached chunk must not be fetched")
+		}
+	}
+}
+
+// recordingTracer is a trace.Tracer recording the spans in memory.
+type recordingTracer struct {
+	spans []*recordedSpan
+	mu    sync.Mutex
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &recordedSpan{
+		Span:  trace.SpanFromContext(context.Background()), // no-op for the unrecorded methods
+		name:  name,
+		attrs: make(map[attribute.Key]attribute.Value),
+	}
+	if parent, ok := trace.SpanFromContext(ctx).(*recordedSpan); ok {
+		s.parent = parent
+	}
+	cfg := trace.NewSpanStartConfig(opts...)
+	s.SetAttributes(cfg.Attributes()...)
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// span returns the only span named name and checks its parent.
+func (r *recordingTracer) span(t *testing.T, name string, parent trace.Span) *recordedSpan {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found *recordedSpan
+	for _, s := range r.spans {
+		if s.name == name {
+			if found != nil {
+				t.Fatalf("multiple spans named %q", name)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		t.Fatalf("no span named %q", name)
+	}
+	if (parent == nil && found.parent != nil) || (parent != nil && trace.Span(found.parent) != parent) {
+		t.Fatalf("span %q has unexpected parent %v", name, found.parent)
+	}
+	return found
+}
+
+type recordedSpan struct {
+	trace.Span
+	name   string
+	parent *recordedSpan
+	attrs  map[attribute.Key]attribute.Value
+	ended  bool
+	mu     sync.Mutex
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+}
+
+func TestLastChunkRange(t *testing.T) {
+	for _, size := range []int64{3 * sampleChunkSize, 3*sampleChunkSize + 1} {
+		for _, tt := range []struct {
+			name              string
+			prefetchChunkSize int64
+			op                func(b *blob) error
+		}{
+			{
+				name: "read_last_byte",
+				op: func(b *blob) error {
+					p := make([]byte, 1)
+					if _, err := b.ReadAt(p, size-1); err != nil {
+						return err
+					}
+					if string(p) != sampleData1[size-1:size] {
+						return fmt.Errorf("read %q; want %q", string(p), sampleData1[size-1:size])
+					}
+					return nil
+				},
+			},
+			{
+				name: "cache_single_get",
+				op:   func(b *blob) error { return b.Cache(0, size) },
+			},
+			{
+				name:              "cache_multiple_get",
+				prefetchChunkSize: sampleChunkSize * 2,
+				op:                func(b *blob) error { return b.Cache(0, size) },
+			},
+		} {
+			t.Run(fmt.Sprintf("size=%d/%s", size, tt.name), func(t *testing.T) {
+				var ends []int64
+				var mu sync.Mutex
+				rt := multiRoundTripper(t, []byte(sampleData1[:size]))
+				b := makeTestBlob(t, size, sampleChunkSize, tt.prefetchChunkSize,
+					func(req *http.Request) *http.Response {
+						mu.Lock()
+						for _, part := range strings.Split(strings.TrimPrefix(req.Header.Get("Range"), rangeHeaderPrefix), ",") {
+							e, err := strconv.ParseInt(part[strings.Index(part, "-")+1:], 10, 64)
+							if err != nil {
+								t.Errorf("malformed range %q", part)
+							}
+							ends = append(ends, e)
+						}
+						mu.Unlock()
+						return rt(req)
+					})
+				if err := tt.op(b); err != nil {
+					t.Fatalf("failed to run the operation: %v", err)
+				}
+				var last int64 = -1
+				for _, e := range ends {
+					if e >= size {
+						t.Errorf("requested range ends at %d beyond the blob of size %d", e, size)
+					}
+					if e > last {
+						last = e
+					}
+				}
+				if last != size-1 {
+					t.Errorf("the final range ends at %d; want %d", last, size-1)
+				}
+				checkAllCached(t, b, floor(size-1, sampleChunkSize), size-floor(size-1, sampleChunkSize))
+			})
+		}
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	encoders := map[string]func(t *testing.T, p []byte) []byte{
+		"identity": func(t *testing.T, p []byte) []byte { return p },
+		"gzip": func(t *testing.T, p []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(p); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			return buf.Bytes()
+		},
+		"zstd": func(t *testing.T, p []byte) []byte {
+			w, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatalf("failed to create encoder: %v", err)
+			}
+			defer w.Close()
+			return w.EncodeAll(p, nil)
+		},
+	}
+	// encodeResponse encodes the whole body of the response.
+	encodeResponse := func(t *testing.T, encoding string, res *http.Response) *http.Response {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(encoders[encoding](t, body)))
+		res.Header.Set("Content-Encoding", encoding)
+		res.Header.Del("Content-Length")
+		return res
+	}
+	// encodeParts encodes each part of the multipart response.
+	encodeParts := func(t *testing.T, encoding string, res *http.Response) *http.Response {
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("the response isn't multipart: %v", err)
+		}
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.SetBoundary(params["boundary"]); err != nil {
+			t.Fatalf("failed to set boundary: %v", err)
+		}
+		mr := multipart.NewReader(res.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("failed to read part: %v", err)
+			}
+			data, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatalf("failed to read part: %v", err)
+			}
+			header := p.Header
+			header.Set("Content-Encoding", encoding)
+			pw, err := mw.CreatePart(header)
+			if err != nil {
+				t.Fatalf("failed to create part: %v", err)
+			}
+			pw.Write(encoders[encoding](t, data))
+		}
+		mw.Close()
+		res.Body = io.NopCloser(&buf)
+		return res
+	}
+	for _, encoding := range []string{"identity", "gzip", "zstd"} {
+		for _, tt := range []struct {
+			name   string
+			encode func(t *testing.T, encoding string, res *http.Response) *http.Response
+			regs   []region
+		}{
+			{name: "single_part", encode: encodeResponse, regs: []region{{0, 2}}},
+			{name: "multipart", encode: encodeResponse, regs: []region{{0, 2}, {6, 8}}},
+			{name: "encoded_parts", encode: encodeParts, regs: []region{{0, 2}, {6, 8}}},
+		} {
+			t.Run(encoding+"/"+tt.name, func(t *testing.T) {
+				rt := multiRoundTripper(t, []byte(sampleData1))
+				b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+					func(req *http.Request) *http.Response {
+						return tt.encode(t, encoding, rt(req))
+					})
+				allData := make(map[region]io.Writer)
+				bufs := make(map[region][]byte)
+				for _, reg := range tt.regs {
+					bufs[reg] = make([]byte, reg.size())
+					allData[reg] = newBytesWriter(bufs[reg], 0)
+				}
+				if err := b.fetchRange(allData, &options{}); err != nil {
+					t.Fatalf("failed to fetch: %v", err)
+				}
+				for reg, p := range bufs {
+					if want := sampleData1[reg.b : reg.e+1]; string(p) != want {
+						t.Errorf("fetched %q at %d; want %q", string(p), reg.b, want)
+					}
+					checkAllCached(t, b, reg.b, reg.size())
+				}
+			})
+		}
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		rt := multiRoundTripper(t, []byte(sampleData1))
+		b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+			func(req *http.Request) *http.Response {
+				res := rt(req)
+				res.Header.Set("Content-Encoding", "br")
+				return res
+			})
+		if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); !errors.Is(err, ErrUnsupportedEncoding) {
+			t.Errorf("read = %v; want %v", err, ErrUnsupportedEncoding)
+		}
+	})
+}
+
+func TestCachedRanges(t *testing.T) {
+	var requests int
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			requests++
+			return failRoundTripper()(req)
+		})
+	if got := b.CachedRanges(); got != nil {
+		t.Errorf("empty cache reports %v", got)
+	}
+
+	// Fill the cache sparsely: chunks [0, 2], [3, 5] and the last one [9, 9].
+	for _, chunk := range []region{{0, 2}, {3, 5}, {9, 9}} {
+		w, err := b.cache.Add(b.fetcher.genID(chunk))
+		if err != nil {
+			t.Fatalf("failed to add chunk %v: %v", chunk, err)
+		}
+		if _, err := w.Write([]byte(sampleData1[chunk.b : chunk.e+1])); err != nil {
+			t.Fatalf("failed to write chunk %v: %v", chunk, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit chunk %v: %v", chunk, err)
+		}
+		w.Close()
+	}
+	want := []Region{{0, 6}, {9, 1}}
+	if got := b.CachedRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cached ranges = %v; want %v", got, want)
+	}
+	if requests != 0 {
+		t.Errorf("probing the cache sent %d requests; want 0", requests)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if got := b.CachedRanges(); got != nil {
+		t.Errorf("closed blob reports %v", got)
+	}
+}
+
+func TestSyncKeyFunc(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		key         SyncKeyFunc
+		offsets     []int64
+		wantFetches int64
+	}{
+		{
+			name:        "same_regions",
+			key:         func(regions []Region) string { return fmt.Sprint(regions) },
+			offsets:     []int64{0, 0},
+			wantFetches: 1,
+		},
+		{
+			name:        "distinct_regions",
+			key:         func(regions []Region) string { return fmt.Sprint(regions) },
+			offsets:     []int64{0, 6},
+			wantFetches: 2,
+		},
+		{
+			// The caller joining the fetch of the other regions fetches its own.
+			name:        "colliding_keys",
+			key:         func(regions []Region) string { return "constant" },
+			offsets:     []int64{0, 6},
+			wantFetches: 2,
+		},
+		{
+			name:        "empty_key",
+			key:         func(regions []Region) string { return "" },
+			offsets:     []int64{0, 0},
+			wantFetches: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches int64
+			rt := multiRoundTripper(t, []byte(sampleData1))
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					atomic.AddInt64(&fetches, 1)
+					time.Sleep(100 * time.Millisecond) // let the concurrent read join
+					return rt(req)
+				})
+			var keyed []Region
+			var mu sync.Mutex
+			WithSyncKeyFunc(func(regions []Region) string {
+				mu.Lock()
+				keyed = append(keyed, regions...)
+				mu.Unlock()
+				return tt.key(regions)
+			})(b)
+
+			var wg sync.WaitGroup
+			for _, offset := range tt.offsets {
+				wg.Add(1)
+				go func(offset int64) {
+					defer wg.Done()
+					p := make([]byte, sampleChunkSize)
+					if _, err := b.ReadAt(p, offset); err != nil {
+						t.Errorf("failed to read: %v", err)
+						return
+					}
+					if want := sampleData1[offset : offset+sampleChunkSize]; string(p) != want {
+						t.Errorf("read data at %d = %q; want %q", offset, string(p), want)
+					}
+				}(offset)
+			}
+			wg.Wait()
+			if n := atomic.LoadInt64(&fetches); n != tt.wantFetches {
+				t.Errorf("fetched %d times; want %d", n, tt.wantFetches)
+			}
+			for _, reg := range keyed {
+				if reg.Size != sampleChunkSize || reg.Offset%sampleChunkSize != 0 {
+					t.Errorf("key function got unaligned region %+v", reg)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWalkChunks(b *testing.B) {
+	const chunks = 1000
+	blob := &blob{chunkSize: sampleChunkSize, size: chunks * sampleChunkSize}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var total int64
+	for i := 0; i < b.N; i++ {
+		if err := blob.walkChunks(region{0, blob.size - 1}, func(chunk region) error {
+			total += chunk.size()
+			return nil
+		}); err != nil {
+			b.Fatalf("failed to walk chunks: %v", err)
+		}
+	}
+	if total != int64(b.N)*blob.size {
+		b.Fatalf("walked %d bytes; want %d", total, int64(b.N)*blob.size)
+	}
+}
+
+func BenchmarkReadAtParallel(b *testing.B) {
+	const (
+		chunkSize = 64 * 1024
+		chunks    = 16
+	)
+	data := bytes.Repeat([]byte("0123456789abcdef"), chunkSize*chunks/16)
+	tr := RoundTripFunc(func(req *http.Request) *http.Response {
+		var begin, end int64
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &begin, &end); err != nil {
+			return &http.Response{StatusCode: http.StatusBadRequest, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(nil))}
+		}
+		header := make(http.Header)
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", begin, end, len(data)))
+		header.Set("Content-Type", "application/octet-stream")
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader(data[begin : end+1])),
+		}
+	})
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool_%v", pooled), func(b *testing.B) {
+			// The cache drops the chunks so that every read fetches and caches one.
+			blob := makeBlob(&httpFetcher{url: testURL, tr: tr}, int64(len(data)), chunkSize, 0,
+				&evictingCache{evict: true, contents: make(map[string][]byte)},
+				time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second)
+			if !pooled {
+				blob.bufPool = nil
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			var next int64
+			b.RunParallel(func(pb *testing.PB) {
+				p := make([]byte, chunkSize)
+				for pb.Next() {
+					offset := (atomic.AddInt64(&next, 1) % chunks) * chunkSize
+					if _, err := blob.ReadAt(p, offset); err != nil {
+						b.Errorf("failed to read at %d: %v", offset, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRateLimiters(t *testing.T) {
+	const limit = 100 // bytes per second
+	size := int64(len(sampleData1))
+	// The first byte is allowed by the burst and the rest takes (size-1)/limit.
+	budget := time.Duration(size-1) * time.Second / limit
+
+	t.Run("background", func(t *testing.T) {
+		b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+		WithRateLimiters(nil, rate.NewLimiter(limit, 1))(b)
+
+		// The foreground read isn't limited.
+		start := time.Now()
+		if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= budget/2 {
+			t.Errorf("foreground read took %v; must not be limited", elapsed)
+		}
+
+		b = makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+		WithRateLimiters(nil, rate.NewLimiter(limit, 1))(b)
+		start = time.Now()
+		if err := b.Cache(0, size); err != nil {
+			t.Fatalf("failed to cache: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < budget*9/10 || elapsed > budget*3 {
+			t.Errorf("caching %d bytes took %v; want about %v", size, elapsed, budget)
+		}
+		checkAllCached(t, b, 0, size)
+	})
+
+	t.Run("read_limit", func(t *testing.T) {
+		b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+		p := make([]byte, size)
+		start := time.Now()
+		if _, err := b.ReadAt(p, 0, WithReadLimit(rate.NewLimiter(limit, 1))); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < budget*9/10 || elapsed > budget*3 {
+			t.Errorf("reading %d bytes took %v; want about %v", size, elapsed, budget)
+		}
+		if string(p) != sampleData1 {
+			t.Errorf("read %q; want %q", string(p), sampleData1)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+		WithRateLimiters(rate.NewLimiter(1, 1), nil)(b)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := b.ReadAt(make([]byte, size), 0, WithContext(ctx)); err == nil {
+			t.Errorf("read must fail when the context is done while waiting for the limiter")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("read took %v; must give up on the cancellation", elapsed)
+		}
+	})
+}
+
+func TestRequestedBytesBeforeCaching(t *testing.T) {
+	var (
+		p          = make([]byte, 1)
+		atFirstAdd []byte
+		mu         sync.Mutex
+	)
+	c := &hookedCache{
+		evictingCache: &evictingCache{contents: make(map[string][]byte)},
+		onWrite: func() {
+			mu.Lock()
+			if atFirstAdd == nil {
+				atFirstAdd = append([]byte{}, p...)
+			}
+			mu.Unlock()
+		},
+	}
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	b.cache = c
+
+	// The requested byte is in the middle of the chunk [0, 2].
+	if _, err := b.ReadAt(p, sampleMiddleOffset); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want := sampleData1[sampleMiddleOffset : sampleMiddleOffset+1]; string(atFirstAdd) != want {
+		t.Errorf("the requested bytes are %q when the cache is written; want %q", string(atFirstAdd), want)
+	}
+	checkAllCached(t, b, 0, sampleChunkSize)
+}
+
+func TestConcurrentCacheAdd(t *testing.T) {
+	var (
+		requests int64
+		release  = make(chan struct{})
+		c        = &hookedCache{
+			evictingCache: &evictingCache{contents: make(map[string][]byte)},
+			onWrite:       func() { <-release },
+		}
+		tr = multiRoundTripper(t, []byte(sampleData1))
+	)
+	size := int64(2 * sampleChunkSize)
+	b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			return tr(req)
+		})
+	b.cache = c
+
+	var (
+		eg errgroup.Group
+		p  = make([]byte, sampleChunkSize)
+	)
+	eg.Go(func() error { return b.Cache(0, size) })
+	eg.Go(func() error {
+		_, err := b.ReadAt(p, 0)
+		return err
+	})
+	// Let the writes of both requests meet on the first chunk.
+	for atomic.LoadInt64(&requests) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := eg.Wait(); err != nil {
+		t.Fatalf("failed to cache and read: %v", err)
+	}
+	if want := sampleData1[:sampleChunkSize]; string(p) != want {
+		t.Errorf("read %q; want %q", string(p), want)
+	}
+	if c.adds != 2 {
+		t.Errorf("adds = %d; want one add for each of 2 chunks", c.adds)
+	}
+	checkAllCached(t, b, 0, size)
+}
+
+// hookedCache calls onWrite before each write to the cache.
+type hookedCache struct {
+	*evictingCache
+	onWrite func()
+}
+
+func (c *hookedCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	w, err := c.evictingCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tw := w.(*testCacheWriter)
+	inner := tw.Writer
+	tw.Writer = writerFunc(func(p []byte) (int, error) {
+		c.onWrite()
+		return inner.Write(p)
+	})
+	return tw, nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestFetchError(t *testing.T) {
+	statusRoundTripper := func(code int) RoundTripFunc {
+		return func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: code,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(bytes.NewReader([]byte{})),
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name       string
+		tr         http.RoundTripper
+		wantStatus int
+		wantNet    bool
+	}{
+		{name: "not_found", tr: statusRoundTripper(http.StatusNotFound), wantStatus: http.StatusNotFound},
+		{name: "unavailable", tr: statusRoundTripper(http.StatusServiceUnavailable), wantStatus: http.StatusServiceUnavailable},
+		{name: "server_error", tr: failRoundTripper(), wantStatus: http.StatusInternalServerError},
+		{
+			name:    "network",
+			tr:      errRoundTripper{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			wantNet: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, nil)
+			b.fetcher.(*httpFetcher).tr = tt.tr
+			_, err := b.ReadAt(make([]byte, sampleChunkSize), sampleChunkSize)
+			var fe *FetchError
+			if !errors.As(err, &fe) {
+				t.Fatalf("read = %v; want FetchError", err)
+			}
+			if fe.StatusCode != tt.wantStatus {
+				t.Errorf("status code = %d; want %d", fe.StatusCode, tt.wantStatus)
+			}
+			if want := []Region{{sampleChunkSize, sampleChunkSize}}; !reflect.DeepEqual(fe.Regions, want) {
+				t.Errorf("regions = %v; want %v", fe.Regions, want)
+			}
+			if fe.URL != testURL {
+				t.Errorf("URL = %q; want %q", fe.URL, testURL)
+			}
+			var ne net.Error
+			if errors.As(err, &ne) != tt.wantNet {
+				t.Errorf("network error = %v; want %v", errors.As(err, &ne), tt.wantNet)
+			}
+		})
+	}
+}
+
+func TestIncompleteCacheReadError(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, failRoundTripper())
+	chunk := region{0, sampleChunkSize - 1}
+	id := b.fetcher.genID(chunk)
+
+	// The cached chunk is truncated.
+	w, err := b.cache.Add(id)
+	if err != nil {
+		t.Fatalf("failed to add chunk: %v", err)
+	}
+	w.Write([]byte(sampleData1[:1]))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit chunk: %v", err)
+	}
+	w.Close()
+
+	err = b.readFromCache(chunk, make([]byte, sampleChunkSize), 0, b.fetcher, &options{})
+	var ie *IncompleteCacheReadError
+	if !errors.As(err, &ie) {
+		t.Fatalf("read = %v; want IncompleteCacheReadError", err)
+	}
+	if ie.ID != id || ie.Read != 1 || ie.Region != (Region{0, sampleChunkSize}) {
+		t.Errorf("error = %+v; want the read of 1 byte of %v from %q", ie, chunk, id)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("error must wrap io.ErrUnexpectedEOF: %v", err)
+	}
+}
+
+// countingErrRoundTripper is errRoundTripper counting the round trips.
+type countingErrRoundTripper struct {
+	errRoundTripper
+	n *int64
+}
+
+func (c *countingErrRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(c.n, 1)
+	return c.errRoundTripper.RoundTrip(req)
+}
+
+type errRoundTripper struct {
+	err error
+}
+
+func (e errRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, e.err
+}
+
+func TestContentRangeOn200(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lenient_%v", lenient), func(t *testing.T) {
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					var begin, end int64
+					if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &begin, &end); err != nil {
+						t.Errorf("unexpected range %q", req.Header.Get("Range"))
+					}
+					header := make(http.Header)
+					header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", begin, end, len(sampleData1)))
+					header.Set("Content-Length", fmt.Sprintf("%d", end-begin+1))
+					return &http.Response{
+						StatusCode: http.StatusOK, // must be 206
+						Header:     header,
+						Body:       io.NopCloser(strings.NewReader(sampleData1[begin : end+1])),
+					}
+				})
+			b.fetcher.(*httpFetcher).lenientContentRange = lenient
+
+			p := make([]byte, sampleChunkSize)
+			_, err := b.ReadAt(p, sampleChunkSize)
+			if !lenient {
+				if err == nil {
+					t.Fatalf("200 with the Content-Range of the part must be rejected")
+				}
+				if _, err := b.cache.Get(b.fetcher.genID(region{0, sampleChunkSize - 1})); err == nil {
+					t.Errorf("the part must not be cached as the head of the blob")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := sampleData1[sampleChunkSize : 2*sampleChunkSize]; string(p) != want {
+				t.Errorf("read %q; want %q", string(p), want)
+			}
+			checkAllCached(t, b, sampleChunkSize, sampleChunkSize)
+			if _, err := b.cache.Get(b.fetcher.genID(region{0, sampleChunkSize - 1})); err == nil {
+				t.Errorf("only the part must be cached")
+			}
+		})
+	}
+}
+
+func TestSnapshotState(t *testing.T) {
+	shared := cache.NewMemoryCache()
+	newBlob := func(size int64, tr RoundTripFunc) *blob {
+		return makeBlob(&httpFetcher{url: testURL, tr: tr}, size, sampleChunkSize, defaultPrefetchChunkSize,
+			shared, time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second)
+	}
+	b := newBlob(int64(len(sampleData1)), multiRoundTripper(t, []byte(sampleData1)))
+	for _, offset := range []int64{0, 2 * sampleChunkSize} {
+		if _, err := b.ReadAt(make([]byte, 1), offset); err != nil {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+	}
+	state, err := b.SnapshotState()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %v", err)
+	}
+
+	// The restored blob serves the cached regions without fetching.
+	restored := newBlob(int64(len(sampleData1)), failRoundTripper())
+	if err := restored.RestoreState(state); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if got, want := restored.FetchedSize(), b.FetchedSize(); got != want || got != 2*sampleChunkSize {
+		t.Errorf("fetched size = %d; want %d", got, want)
+	}
+	if got, want := restored.CachedRanges(), b.CachedRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cached ranges = %v; want %v", got, want)
+	}
+	p := make([]byte, sampleChunkSize)
+	if _, err := restored.ReadAt(p, 2*sampleChunkSize); err != nil {
+		t.Fatalf("failed to read the restored region: %v", err)
+	} else if want := sampleData1[2*sampleChunkSize : 3*sampleChunkSize]; string(p) != want {
+		t.Errorf("read %q; want %q", string(p), want)
+	}
+
+	// The state of another blob is rejected.
+	other := newBlob(int64(len(sampleData1))-1, failRoundTripper())
+	if err := other.RestoreState(state); err == nil {
+		t.Errorf("the state of the blob of another size must be rejected")
+	}
+	if other.FetchedSize() != 0 {
+		t.Errorf("rejected state must not be restored")
+	}
+	if err := other.RestoreState([]byte("{")); err == nil {
+		t.Errorf("the malformed state must be rejected")
+	}
+}
+
+func TestParallelRangeFetches(t *testing.T) {
+	var requests int64
+	tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			if r := req.Header.Get("Range"); strings.Contains(r, ",") {
+				t.Errorf("unexpected multi-range request %q", r)
+			}
+			return tr(req)
+		})
+	b.fetcher.(*httpFetcher).parallelRanges = 2
+
+	// Sparse chunks can't be squashed into one range.
+	chunks := []region{
+		{0, sampleChunkSize - 1},
+		{2 * sampleChunkSize, 3*sampleChunkSize - 1},
+	}
+	allData := make(map[region]io.Writer)
+	bufs := make(map[region]*bytes.Buffer)
+	for _, c := range chunks {
+		bufs[c] = new(bytes.Buffer)
+		allData[c] = bufs[c]
+	}
+	if err := b.fetchRange(allData, &options{}); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if got := atomic.LoadInt64(&requests); got != int64(len(chunks)) {
+		t.Errorf("requests = %d; want %d single-range requests", got, len(chunks))
+	}
+	for _, c := range chunks {
+		if want := sampleData1[c.b : c.e+1]; bufs[c].String() != want {
+			t.Errorf("chunk %v = %q; want %q", c, bufs[c].String(), want)
+		}
+		checkAllCached(t, b, c.b, c.size())
+	}
+}
+
+func TestIgnoreCommitErrors(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignore_%v", ignore), func(t *testing.T) {
+			b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+				multiRoundTripper(t, []byte(sampleData1)))
+			b.cache = failingCommitCache{}
+			b.ignoreCommitErrors = ignore
+
+			p := make([]byte, len(sampleData1))
+			_, err := b.ReadAt(p, 0)
+			if !ignore {
+				if err == nil {
+					t.Fatalf("read must fail if the commit fails")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if string(p) != sampleData1 {
+				t.Errorf("read %q; want %q", string(p), sampleData1)
+			}
+			if got, want := b.BlobStats().CommitFailures, int64(len(sampleData1)+sampleChunkSize-1)/sampleChunkSize; got != want {
+				t.Errorf("commit failures = %d; want %d", got, want)
+			}
+			if got := b.FetchedSize(); got != 0 {
+				t.Errorf("fetched size = %d; the chunks mustn't be marked as cached", got)
+			}
+		})
+	}
+}
+
+// failingCommitCache is a cache which always fails to commit.
+type failingCommitCache struct{ forgetfulCache }
+
+func (failingCommitCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	return &testCacheWriter{Writer: io.Discard, commit: func() error { return fmt.Errorf("dummy commit error") }}, nil
+}
+
+func TestCacheContext(t *testing.T) {
+	tr := &blockingRoundTripper{started: make(chan struct{}, 1)}
+	b := makeTestBlob(t, int64(len(sampleData1)), 1, 2, nil)
+	b.fetcher.(*httpFetcher).tr = tr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-tr.started
+		cancel()
+	}()
+	done := make(chan error, 1)
+	go func() { done <- b.Cache(0, int64(len(sampleData1)), WithContext(ctx)) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Cache = %v; want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Cache must return once the context is canceled")
+	}
+
+	requests := atomic.LoadInt64(&tr.requests)
+	if max := int64(len(sampleData1) / 2); requests > max {
+		t.Errorf("requests = %d; want at most %d", requests, max)
+	}
+	if err := b.Cache(0, int64(len(sampleData1)), WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cache with the canceled context = %v; want context.Canceled", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadInt64(&tr.requests); got != requests {
+		t.Errorf("requests = %d after cancellation; want %d", got, requests)
+	}
+}
+
+// blockingRoundTripper blocks each request until its context is done.
+type blockingRoundTripper struct {
+	requests int64
+	started  chan struct{}
+}
+
+func (tr *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&tr.requests, 1)
+	select {
+	case tr.started <- struct{}{}:
+	default:
+	}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestChunkVerification(t *testing.T) {
+	corrupted := []byte(sampleData1)
+	corrupted[sampleChunkSize] ^= 0xff // the head of the second chunk
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, corrupted))
+	digests := testChunkDigests{data: sampleData1, chunkSize: sampleChunkSize}
+	WithChunkVerification(digests)(b)
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read the intact chunk: %v", err)
+	}
+	_, err := b.ReadAt(p, sampleChunkSize)
+	var mismatch *ChunkDigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("read of the corrupted chunk = %v; want ChunkDigestMismatchError", err)
+	}
+	if want := (Region{Offset: sampleChunkSize, Size: sampleChunkSize}); mismatch.Region != want {
+		t.Errorf("region = %+v; want %+v", mismatch.Region, want)
+	}
+	if want, _ := digests.ChunkDigest(sampleChunkSize); mismatch.Expected != want {
+		t.Errorf("expected digest = %v; want %v", mismatch.Expected, want)
+	}
+	if _, err := b.cache.Get(b.fetcher.genID(region{sampleChunkSize, 2*sampleChunkSize - 1})); err == nil {
+		t.Errorf("the corrupted chunk mustn't be cached")
+	}
+}
+
+func TestByteRangeHint(t *testing.T) {
+	var requests int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			return tr(req)
+		})
+
+	// The hint beyond the end of the blob is clipped.
+	p := make([]byte, 1)
+	if n, err := b.ReadAt(p, 0, WithByteRangeHint(int64(len(sampleData1))*2)); err != nil || n != 1 {
+		t.Fatalf("failed to read: n = %d, err = %v", n, err)
+	} else if string(p) != sampleData1[:1] {
+		t.Errorf("read %q; want %q", string(p), sampleData1[:1])
+	}
+	if got := atomic.LoadInt64(&requests); got != 1 {
+		t.Errorf("requests = %d; want 1", got)
+	}
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+
+	// The following sequential reads hit the cache.
+	b.fetcher.(*httpFetcher).tr = failRoundTripper()
+	for offset := int64(1); offset < int64(len(sampleData1)); offset += sampleChunkSize {
+		p := make([]byte, sampleChunkSize)
+		n, err := b.ReadAt(p, offset)
+		if err != nil && err != io.EOF {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+		if want := sampleData1[offset:min(offset+sampleChunkSize, int64(len(sampleData1)))]; string(p[:n]) != want {
+			t.Errorf("read %q at %d; want %q", string(p[:n]), offset, want)
+		}
+	}
+}
+
+func TestReadTiming(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			time.Sleep(delay)
+			return tr(req)
+		})
+	b.cache = slowCache{
+		BlobCache: &hookedCache{
+			evictingCache: &evictingCache{contents: make(map[string][]byte)},
+			onWrite:       func() { time.Sleep(delay) },
+		},
+		delay: delay,
+	}
+
+	var timing ReadTiming
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithReadTimingFunc(func(t ReadTiming) { timing = t })); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	for name, d := range map[string]time.Duration{
+		"cache lookup": timing.CacheLookup,
+		"fetch":        timing.Fetch,
+		"commit":       timing.Commit,
+	} {
+		if d < delay {
+			t.Errorf("%s = %v; want at least %v", name, d, delay)
+		}
+	}
+	if timing.Copy <= 0 {
+		t.Errorf("copy = %v; want positive", timing.Copy)
+	}
+	sum := timing.CacheLookup + timing.Fetch + timing.Copy + timing.Commit
+	if sum > timing.Total || sum < timing.Total*8/10 {
+		t.Errorf("sum of the breakdown %v isn't close to the total %v (%+v)", sum, timing.Total, timing)
+	}
+}
+
+func TestRangeIgnored(t *testing.T) {
+	var requests int64
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			header := make(http.Header)
+			header.Set("Content-Length", fmt.Sprintf("%d", len(sampleData1)))
+			return &http.Response{
+				StatusCode: http.StatusOK, // ignores Range
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader(sampleData1)),
+			}
+		})
+
+	// A multi-chunk read in the middle of the blob
+	p := make([]byte, 2*sampleChunkSize)
+	if _, err := b.ReadAt(p, sampleMiddleOffset); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want := sampleData1[sampleMiddleOffset : sampleMiddleOffset+2*sampleChunkSize]; string(p) != want {
+		t.Errorf("read %q; want %q", string(p), want)
+	}
+
+	// All chunks covered by the response are cached.
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+	q := make([]byte, len(sampleData1))
+	if _, err := b.ReadAt(q, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	} else if string(q) != sampleData1 {
+		t.Errorf("read %q; want %q", string(q), sampleData1)
+	}
+	if got := atomic.LoadInt64(&requests); got != 1 {
+		t.Errorf("requests = %d; want 1", got)
+	}
+}
+
+func TestPartiallyCachedChunk(t *testing.T) {
+	var requests int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			return tr(req)
+		})
+
+	// Only the head of the first chunk is cached.
+	chunk := region{0, sampleChunkSize - 1}
+	w, err := b.cache.Add(b.fetcher.genID(chunk))
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData1[:sampleChunkSize-1])); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+
+	var incomplete *IncompleteCacheReadError
+	if err := b.readCache(chunk, make([]byte, 1), 0, b.fetcher, &options{}); !errors.As(err, &incomplete) {
+		t.Fatalf("read of the partially cached chunk = %v; want IncompleteCacheReadError", err)
+	}
+	p := make([]byte, 1)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	} else if string(p) != sampleData1[:1] {
+		t.Errorf("read %q; want %q", string(p), sampleData1[:1])
+	}
+	if got := atomic.LoadInt64(&requests); got != 1 {
+		t.Errorf("requests = %d; the partially cached chunk must be fetched", got)
+	}
+	checkAllCached(t, b, 0, sampleChunkSize)
+}
+
+func TestFetchedRegions(t *testing.T) {
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+	if regs := b.FetchedRegions(); len(regs) != 0 {
+		t.Fatalf("regions = %v; want none", regs)
+	}
+	// chunks: [0,2] [3,5] [6,8] [9,9]
+	for _, offset := range []int64{0, 2 * sampleChunkSize, sampleChunkSize, 3 * sampleChunkSize} {
+		if _, err := b.ReadAt(make([]byte, 1), offset); err != nil {
+			t.Fatalf("failed to read at %d: %v", offset, err)
+		}
+		if offset == 2*sampleChunkSize {
+			want := []Region{{0, sampleChunkSize}, {2 * sampleChunkSize, sampleChunkSize}}
+			if regs := b.FetchedRegions(); !reflect.DeepEqual(regs, want) {
+				t.Errorf("regions = %v; want %v", regs, want)
+			}
+		}
+	}
+	want := []Region{{0, int64(len(sampleData1))}}
+	regs := b.FetchedRegions()
+	if !reflect.DeepEqual(regs, want) {
+		t.Errorf("regions = %v; want %v", regs, want)
+	}
+
+	// The returned slice is a copy.
+	regs[0].Size = 1
+	if got := b.FetchedRegions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("regions = %v after modifying the returned slice; want %v", got, want)
+	}
+}
+
+func TestAutoComplete(t *testing.T) {
+	var requests int64
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	// The rest of the blob fits in a batch of the prefetch chunk size.
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, 2*sampleChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			return tr(req)
+		})
+	WithAutoComplete(0.5)(b)
+
+	// chunks: [0,2] [3,5] [6,8] [9,9]
+	if _, err := b.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := b.FetchedSize(); got != sampleChunkSize {
+		t.Fatalf("fetched size = %d; mustn't be completed under the threshold", got)
+	}
+	if _, err := b.ReadAt(make([]byte, 1), 2*sampleChunkSize); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	for start := time.Now(); b.FetchedSize() < int64(len(sampleData1)); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("the rest of the blob isn't fetched: %v", b.FetchedRegions())
+		}
+	}
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+	if got := atomic.LoadInt64(&requests); got != 3 {
+		t.Errorf("requests = %d; want 2 reads and 1 for the rest", got)
+	}
+}
+
+func TestAutoCompleteThreshold(t *testing.T) {
+	for _, tt := range []struct {
+		threshold float64
+		want      float64
+	}{
+		{threshold: -0.5, want: 0},
+		{threshold: 0, want: 0},
+		{threshold: 0.5, want: 0.5},
+		{threshold: 1, want: 1},
+		{threshold: 1.5, want: 0},
+	} {
+		b := &blob{}
+		WithAutoComplete(tt.threshold)(b)
+		if b.autoCompleteThreshold != tt.want {
+			t.Errorf("threshold %v: got %v; want %v", tt.threshold, b.autoCompleteThreshold, tt.want)
+		}
+	}
+}
+
+func TestAutoCompleteBatches(t *testing.T) {
+	data := []byte(strings.Repeat(sampleData1, 3))
+	var (
+		requests, inFlight, maxInFlight int64
+		ranges                          []string
+		mu                              sync.Mutex
+	)
+	tr := multiRoundTripper(t, data)
+	b := makeTestBlob(t, int64(len(data)), sampleChunkSize, 2*sampleChunkSize,
+		func(req *http.Request) *http.Response {
+			atomic.AddInt64(&requests, 1)
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			mu.Lock()
+			if n > maxInFlight {
+				maxInFlight = n
+			}
+			ranges = append(ranges, req.Header.Get("Range"))
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			return tr(req)
+		})
+	WithAutoComplete(0.1)(b)
+	WithPrefetchConcurrency(1)(b)
+
+	// chunks: 10 chunks of 3 bytes; the read fetches 2 of them.
+	if _, err := b.ReadAt(make([]byte, 2*sampleChunkSize), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	for start := time.Now(); b.FetchedSize() < int64(len(data)); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("the rest of the blob isn't fetched: %v", b.FetchedRegions())
+		}
+	}
+	b.activeFetches.Wait()
+	checkAllCached(t, b, 0, int64(len(data)))
+	// The rest (8 chunks) is fetched by 4 batches of 2 chunks, one at a time.
+	mu.Lock()
+	defer mu.Unlock()
+	if got := atomic.LoadInt64(&requests); got != 5 {
+		t.Errorf("requests = %d (%q); want 1 read and 4 batches", got, ranges)
+	}
+	if maxInFlight != 1 {
+		t.Errorf("max requests in flight = %d; want 1", maxInFlight)
+	}
+}
+
+func TestAutoCompleteCanceledByClose(t *testing.T) {
+	rt := multiRoundTripper(t, []byte(sampleData1))
+	var requests int64
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			if atomic.AddInt64(&requests, 1) == 1 {
+				return rt(req)
+			}
+			<-req.Context().Done() // the rest of the blob never arrives
+			return failRoundTripper()(req)
+		})
+	WithAutoComplete(0.1)(b)
+	if _, err := b.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	for start := time.Now(); atomic.LoadInt64(&requests) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("the rest of the blob isn't requested")
+		}
+	}
+	done := make(chan error)
+	go func() { done <- b.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+	case <-time.After(b.fetchTimeout / 2):
+		t.Fatalf("Close must cancel the fetch of the rest of the blob")
+	}
+}
+
+func TestResumePartialChunk(t *testing.T) {
+	var (
+		ranges []string
+		mu     sync.Mutex
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			mu.Lock()
+			ranges = append(ranges, req.Header.Get("Range"))
+			mu.Unlock()
+			return tr(req)
+		})
+	rc := &resumableMemoryCache{BlobCache: cache.NewMemoryCache(), partial: make(map[string][]byte)}
+	b.cache = rc
+
+	// The previous process wrote the head of the second chunk before the restart.
+	chunk := region{sampleChunkSize, 2*sampleChunkSize - 1}
+	rc.partial[b.fetcher.genID(chunk)] = []byte(sampleData1[chunk.b : chunk.b+1])
+
+	if err := b.Cache(0, int64(len(sampleData1))); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	wantTail := fmt.Sprintf("bytes=%d-%d", chunk.b+1, chunk.e)
+	var resumed bool
+	for _, r := range ranges {
+		if r == wantTail {
+			resumed = true
+		}
+		for _, part := range strings.Split(strings.TrimPrefix(r, rangeHeaderPrefix), ",") {
+			if begin, end := parseRangeString(t, part); begin <= chunk.b && chunk.b <= end {
+				t.Errorf("the written head of the chunk is requested: %q", r)
+			}
+		}
+	}
+	if !resumed {
+		t.Errorf("the tail %q isn't requested: %v", wantTail, ranges)
+	}
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+
+	b.fetcher.(*httpFetcher).tr = failRoundTripper()
+	p := make([]byte, len(sampleData1))
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	} else if string(p) != sampleData1 {
+		t.Errorf("read %q; want %q", string(p), sampleData1)
+	}
+}
+
+// resumableMemoryCache is a memory cache which keeps the uncommitted contents in
+// partial.
+type resumableMemoryCache struct {
+	cache.BlobCache
+	partial map[string][]byte
+	mu      sync.Mutex
+}
+
+func (c *resumableMemoryCache) PartialSize(key string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(len(c.partial[key]))
+}
+
+func (c *resumableMemoryCache) Resume(key string, opts ...cache.Option) (cache.Writer, error) {
+	c.mu.Lock()
+	buf := bytes.NewBuffer(append([]byte{}, c.partial[key]...))
+	c.mu.Unlock()
+	return &testCacheWriter{Writer: buf, commit: func() error {
+		w, err := c.BlobCache.Add(key, opts...)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		delete(c.partial, key)
+		c.mu.Unlock()
+		return w.Commit()
+	}}, nil
+}
+
+func TestStagger(t *testing.T) {
+	var (
+		times []time.Time
+		mu    sync.Mutex
+	)
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	newBlob := func() *blob {
+		// 5 ranges of 2 chunks
+		return makeTestBlob(t, int64(len(sampleData1)), 1, 2, func(req *http.Request) *http.Response {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+			return tr(req)
+		})
+	}
+
+	b := newBlob()
+	if err := b.Cache(0, int64(len(sampleData1)), WithStagger(20*time.Millisecond)); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	checkAllCached(t, b, 0, int64(len(sampleData1)))
+	if len(times) != 5 {
+		t.Fatalf("round trips = %d; want 5", len(times))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	if spread := times[len(times)-1].Sub(times[0]); spread < 5*time.Millisecond {
+		t.Errorf("round trips are spread over %v; want stagger", spread)
+	}
+
+	// The stagger is canceled with the context.
+	times = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	err := newBlob().Cache(0, int64(len(sampleData1)), WithStagger(time.Hour), WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Cache = %v; want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Cache took %v after cancellation", d)
+	}
+	if len(times) != 1 {
+		t.Errorf("round trips = %d; want only the first range", len(times))
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	tr := &blockingRoundTripper{started: make(chan struct{}, 1)}
+	b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, nil)
+	b.fetcher.(*httpFetcher).tr = tr
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0, WithFetchTimeout(10*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReadAt error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := b.Cache(0, int64(len(sampleData1)), WithFetchTimeout(10*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Cache error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if b.fetchTimeout != time.Duration(defaultFetchTimeoutSec)*time.Second {
+		t.Errorf("default fetch timeout changed to %v", b.fetchTimeout)
+	}
+}
+
+func TestReadFull(t *testing.T) {
+	size := int64(len(sampleData1))
+	b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize,
+		multiRoundTripper(t, []byte(sampleData1)))
+
+	tests := []struct {
+		offset  int64
+		size    int
+		wantN   int
+		wantErr error
+	}{
+		{offset: 0, size: int(size), wantN: int(size)},
+		{offset: 4, size: 6, wantN: 6},
+		{offset: 8, size: 2, wantN: 2},
+		{offset: 8, size: 3, wantN: 2, wantErr: io.ErrUnexpectedEOF}, // across the boundary
+		{offset: size, size: 1, wantN: 0, wantErr: io.EOF},
+		{offset: size + 1, size: 1, wantN: 0, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		p := make([]byte, tt.size)
+		n, err := b.ReadFull(p, tt.offset)
+		if n != tt.wantN || err != tt.wantErr {
+			t.Errorf("ReadFull(%d, %d) = %d, %v; want %d, %v", tt.offset, tt.size, n, err, tt.wantN, tt.wantErr)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		if want := sampleData1[tt.offset : tt.offset+int64(n)]; string(p[:n]) != want {
+			t.Errorf("ReadFull(%d, %d) read %q; want %q", tt.offset, tt.size, string(p[:n]), want)
+		}
+	}
+}
+
+func TestTooManyParts(t *testing.T) {
+	const bogusParts = 100
+	size := int64(len(sampleData1))
+	tr := func(req *http.Request) *http.Response {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for i := 0; i < bogusParts; i++ {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Type", "application/octet-stream")
+			header.Set("Content-Range", fmt.Sprintf("bytes 0-2/%d", size))
+			pw, err := mw.CreatePart(header)
+			if err != nil {
+				t.Fatalf("failed to create part: %v", err)
+			}
+			pw.Write([]byte(sampleData1[:3]))
+		}
+		mw.Close()
+		header := make(http.Header)
+		header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header:     header,
+			Body:       io.NopCloser(&buf),
+		}
+	}
+	b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize, tr)
+	allData := map[region]io.Writer{
+		{0, 2}: io.Discard,
+		{6, 8}: io.Discard,
+	}
+	err := b.fetchRange(allData, &options{})
+	var tooMany *TooManyPartsError
+	if !errors.As(err, &tooMany) {
+		t.Fatalf("fetch must fail with TooManyPartsError; got %v", err)
+	}
+	if want := 2 + defaultMaxExtraParts; tooMany.Requested != 2 || tooMany.Limit != want {
+		t.Errorf("error = %+v; want %d parts allowed for 2 chunks", tooMany, want)
+	}
+}
+
+// closeCountingCache counts the calls of Close.
+type closeCountingCache struct {
+	cache.BlobCache
+	closed int64
+}
+
+func (c *closeCountingCache) Close() error {
+	atomic.AddInt64(&c.closed, 1)
+	return c.BlobCache.Close()
+}
+
+func TestSharedCache(t *testing.T) {
+	size := int64(len(sampleData1))
+	contentAddressed := IDGeneratorFunc(func(url string, dgst digest.Digest, offset, size int64) string {
+		return fmt.Sprintf("%s-%d-%d", dgst, offset, size)
+	})
+	dgst := digest.FromString(sampleData1)
+	underlying := &closeCountingCache{BlobCache: cache.NewMemoryCache()}
+	shared := NewSharedCache(underlying)
+	newBlob := func(url string, tr http.RoundTripper) *blob {
+		return makeBlob(&httpFetcher{url: url, blobURL: url, digest: dgst, tr: tr, idGenerator: contentAddressed},
+			size, sampleChunkSize, defaultPrefetchChunkSize, shared.Share(),
+			time.Time{}, 0, &Resolver{}, time.Duration(defaultFetchTimeoutSec)*time.Second)
+	}
+	b1 := newBlob(testURL, multiRoundTripper(t, []byte(sampleData1)))
+	tr := &callsCountRoundTripper{content: sampleData1}
+	b2 := newBlob("registry2", tr)
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b1.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read by the first blob: %v", err)
+	}
+	if err := b1.Close(); err != nil {
+		t.Fatalf("failed to close the first blob: %v", err)
+	}
+	if n := atomic.LoadInt64(&underlying.closed); n != 0 {
+		t.Fatalf("shared cache is closed while used by the second blob")
+	}
+	p = make([]byte, sampleChunkSize)
+	if _, err := b2.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read by the second blob: %v", err)
+	}
+	if string(p) != sampleData1[:sampleChunkSize] {
+		t.Errorf("read %q; want %q", string(p), sampleData1[:sampleChunkSize])
+	}
+	if tr.count != 0 {
+		t.Errorf("the chunk fetched by the first blob must be served from the cache; round trips = %d", tr.count)
+	}
+	if err := b2.Close(); err != nil {
+		t.Fatalf("failed to close the second blob: %v", err)
 	}
+	if n := atomic.LoadInt64(&underlying.closed); n != 1 {
+		t.Errorf("shared cache is closed %d times after all blobs are closed; want 1", n)
+	}
+}
 
-	tests := []testData{
-		{
-			name:           "no_data",
-			regions:        [3]regionsBoundaries{},
-			roundtripCount: 0,
-			chunkSize:      4,
-		},
+func TestCachePlan(t *testing.T) {
+	size := int64(len(sampleData1))
+	tests := []struct {
+		name       string
+		cached     []region
+		offset     int64
+		size       int64
+		wantFetch  []Region
+		wantCached []Region
+	}{
 		{
-			name: "same_regions",
-			regions: [3]regionsBoundaries{
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-			},
-			roundtripCount: 1,
-			chunkSize:      4,
-			content:        "test",
+			name:      "empty_cache",
+			offset:    0,
+			size:      size,
+			wantFetch: []Region{{0, size}},
 		},
 		{
-			name: "same_regions_multiple_values",
-			regions: [3]regionsBoundaries{
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-						{
-							b: 4,
-							e: 7,
-						},
-					},
-					start: 0,
-					end:   7,
-				},
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-						{
-							b: 4,
-							e: 7,
-						},
-					},
-					start: 0,
-					end:   7,
-				},
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-						{
-							b: 4,
-							e: 7,
-						},
-					},
-					start: 0,
-					end:   7,
-				},
-			},
-			roundtripCount: 1,
-			chunkSize:      4,
-			content:        "test1234",
+			name:       "middle_cached",
+			cached:     []region{{3, 5}},
+			offset:     0,
+			size:       size,
+			wantFetch:  []Region{{0, 3}, {6, 4}},
+			wantCached: []Region{{3, 3}},
 		},
 		{
-			name: "different_regions",
-			regions: [3]regionsBoundaries{
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-				{
-					regions: []region{
-						{
-							b: 4,
-							e: 7,
-						},
-					},
-					start: 4,
-					end:   7,
-				},
-				{
-					regions: []region{
-						{
-							b: 8,
-							e: 11,
-						},
-					},
-					start: 8,
-					end:   11,
-				},
-			},
-			roundtripCount: 3,
-			chunkSize:      4,
-			content:        "test12345678",
+			name:       "sparse",
+			cached:     []region{{0, 2}, {6, 8}},
+			offset:     1,
+			size:       size - 1,
+			wantFetch:  []Region{{3, 3}, {9, 1}},
+			wantCached: []Region{{0, 3}, {6, 3}},
 		},
 		{
-			name: "some_overlap",
-			regions: [3]regionsBoundaries{
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-				{
-					regions: []region{
-						{
-							b: 0,
-							e: 3,
-						},
-					},
-					start: 0,
-					end:   3,
-				},
-				{
-					regions: []region{
-						{
-							b: 4,
-							e: 7,
-						},
-					},
-					start: 4,
-					end:   7,
-				},
-			},
-			roundtripCount: 2,
-			chunkSize:      4,
-			content:        "test1234",
+			name:       "all_cached",
+			cached:     []region{{0, 2}, {3, 5}},
+			offset:     2,
+			size:       3,
+			wantCached: []Region{{0, 6}},
 		},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeTestBlob(t, size, sampleChunkSize, defaultPrefetchChunkSize,
+				multiRoundTripper(t, []byte(sampleData1)))
+			for _, reg := range tt.cached {
+				if _, err := b.ReadAt(make([]byte, reg.size()), reg.b); err != nil {
+					t.Fatalf("failed to cache %v: %v", reg, err)
+				}
+			}
+			fetchedRegions := b.FetchedRegions()
 
-	var wg sync.WaitGroup
-	// we always run 3 routines
-	routines := 3
-
-	for _, tst := range tests {
-		var (
-			tr = &callsCountRoundTripper{
-				content: tst.content,
+			toFetch, cached, err := b.CachePlan(tt.offset, tt.size)
+			if err != nil {
+				t.Fatalf("failed to plan: %v", err)
 			}
-			b = &blob{
-				fetcher: &httpFetcher{
-					url: "test",
-					tr:  tr,
-				},
-				chunkSize: tst.chunkSize,
-				size:      int64(len(tst.content)),
-				cache:     cache.NewMemoryCache(),
+			if !reflect.DeepEqual(toFetch, tt.wantFetch) || !reflect.DeepEqual(cached, tt.wantCached) {
+				t.Errorf("plan = %v, %v; want %v, %v", toFetch, cached, tt.wantFetch, tt.wantCached)
 			}
-		)
-
-		start := make(chan struct{})
-		wg.Add(routines)
-		var contentBytes [3][]byte
-
-		for i := 0; i < routines; i++ {
-			p := make([]byte, len(tst.content))
-			contentBytes[i] = p
-			allData := make(map[region]io.Writer)
-			if i < len(tst.regions) {
-				offset := int64(0)
-				for j := range tst.regions[i].regions {
-					r := tst.regions[i].regions[j]
-					var (
-						base         = positive(r.b - offset)
-						lowerUnread  = positive(offset - r.b)
-						upperUnread  = positive(r.e + 1 - (offset + int64(len(p))))
-						expectedSize = r.size() - upperUnread - lowerUnread
-					)
-					allData[tst.regions[i].regions[j]] = newBytesWriter(p[base:base+expectedSize], lowerUnread)
-				}
+			if got := b.FetchedRegions(); !reflect.DeepEqual(got, fetchedRegions) {
+				t.Errorf("fetched regions changed by the plan: %v; want %v", got, fetchedRegions)
 			}
 
-			go func() {
-				<-start // by blocking on channel start we can ensure that the goroutines will run at approximately the same time
-				defer wg.Done()
-				b.fetchRange(allData, &options{})
-			}()
-		}
-		close(start) // starting
-		wg.Wait()
-
-		// We expect the number of round trip calls to be 1, since we are making 5 calls to fetchRange with
-		// overlapping intervals.
-		if tr.count != tst.roundtripCount {
-			t.Errorf("%v test failed: the round trip count should be %v, but was %v", tst.name, tst.roundtripCount, tr.count)
-		}
-		// Check for contents
-		for j := range contentBytes {
-			start := tst.regions[j].start
-			end := tst.regions[j].end
-			for i := start; i < end; i++ {
-				if contentBytes[j][i] != []byte(tst.content)[i] {
-					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, []byte(tst.content)[start:end], contentBytes[j][start:end])
-					break
-				}
+			// The plan must match the bytes actually fetched by Cache.
+			var planned int64
+			for _, reg := range toFetch {
+				planned += reg.Size
 			}
-		}
+			before := b.BlobStats().FetchedBytes
+			if err := b.Cache(tt.offset, tt.size); err != nil {
+				t.Fatalf("failed to cache: %v", err)
+			}
+			if fetched := b.BlobStats().FetchedBytes - before; fetched != planned {
+				t.Errorf("Cache fetched %d bytes; want %d planned", fetched, planned)
+			}
+			if toFetch, _, err := b.CachePlan(tt.offset, tt.size); err != nil || toFetch != nil {
+				t.Errorf("plan after Cache = %v, %v; want nothing to fetch", toFetch, err)
+			}
+		})
 	}
 }
 
@@ -631,6 +5541,61 @@ func TestCheckInterval(t *testing.T) {
 	}
 }
 
+func TestAdaptiveCheckInterval(t *testing.T) {
+	var (
+		tr  = &calledRoundTripper{}
+		min = time.Minute
+		max = 8 * time.Minute
+		b   = &blob{
+			fetcher: &httpFetcher{
+				url: "test",
+				tr:  tr,
+			},
+			checkInterval: min,
+		}
+	)
+	WithAdaptiveCheckInterval(min, max)(b)
+
+	check := func(failed bool, want time.Duration) {
+		t.Helper()
+		tr.failed = failed
+		b.lastCheck = time.Time{} // expired
+		if err := b.Check(); (err != nil) != failed {
+			t.Fatalf("check failed = %v; want %v", err, failed)
+		}
+		if b.checkInterval != want {
+			t.Errorf("interval = %v; want %v", b.checkInterval, want)
+		}
+	}
+
+	// successes back off up to max
+	check(false, 2*time.Minute)
+	check(false, 4*time.Minute)
+	check(false, 8*time.Minute)
+	check(false, 8*time.Minute)
+
+	// failures probe more often down to min
+	check(true, 4*time.Minute)
+	check(true, 2*time.Minute)
+	check(true, time.Minute)
+	check(true, time.Minute)
+
+	// recovered
+	check(false, 2*time.Minute)
+
+	// the failed check is retried regardless of the interval
+	tr.failed = true
+	b.lastCheck = time.Time{}
+	if err := b.Check(); err == nil {
+		t.Fatalf("check must fail")
+	}
+	tr.called = false
+	tr.failed = false
+	if err := b.Check(); err != nil || !tr.called {
+		t.Errorf("must be checked after failure: called = %v, err = %v", tr.called, err)
+	}
+}
+
 type callsCountRoundTripper struct {
 	count   int64
 	content string
@@ -651,12 +5616,17 @@ func (c *callsCountRoundTripper) RoundTrip(req *http.Request) (res *http.Respons
 
 type calledRoundTripper struct {
 	called bool
+	failed bool
 }
 
 func (c *calledRoundTripper) RoundTrip(req *http.Request) (res *http.Response, err error) {
 	c.called = true
+	statusCode := http.StatusOK
+	if c.failed {
+		statusCode = http.StatusInternalServerError
+	}
 	res = &http.Response{
-		StatusCode: http.StatusOK,
+		StatusCode: statusCode,
 		Header:     make(http.Header),
 		Body:       io.NopCloser(bytes.NewReader([]byte("test"))),
 	}
@@ -23,19 +23,25 @@
 package remote
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/reference"
@@ -48,8 +54,10 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/hashicorp/go-multierror"
 	rhttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/klauspost/compress/zstd"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -60,9 +68,61 @@ const (
 	defaultMaxRetries  = 5
 	defaultMinWaitMSec = 30
 	defaultMaxWaitMSec = 300000
+
+	defaultStallWindowSec = 10
+
+	defaultFetchRetryBaseMSec = 100
 )
 
-func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
+// ResolverOption is an option to configure a Resolver.
+type ResolverOption func(*Resolver)
+
+// WithIDGenerator makes the blobs resolved by the resolver use the IDs generated
+// by g as the keys of the chunks in the cache. By default, the ID depends on the
+// URL of the blob so the same contents served at different URLs don't share the
+// cache.
+func WithIDGenerator(g IDGenerator) ResolverOption {
+	return func(r *Resolver) {
+		r.idGenerator = g
+	}
+}
+
+// WithTracer makes the blobs resolved by the resolver emit OpenTelemetry spans
+// of reads, prefetches, cache lookups and fetches with t. The spans are children
+// of the span in the context passed with WithContext. By default, no span is
+// emitted.
+func WithTracer(t trace.Tracer) ResolverOption {
+	return func(r *Resolver) {
+		r.tracer = t
+	}
+}
+
+// WithParallelRangeFetches makes the blobs resolved by the resolver fetch the
+// ranges of a fetch by concurrent single-range requests, at most n at once,
+// instead of one multi-range request. With HTTP/2 registries the requests are
+// multiplexed over one connection. This avoids the multipart responses, which
+// some registries don't support or break. n <= 0 disables it.
+func WithParallelRangeFetches(n int) ResolverOption {
+	return func(r *Resolver) {
+		r.parallelRanges = n
+	}
+}
+
+// IDGenerator generates the cache key of a region of a blob.
+type IDGenerator interface {
+	// GenID returns the cache key of the region [offset, offset+size) of the blob
+	// with the digest served at the URL.
+	GenID(url string, dgst digest.Digest, offset, size int64) string
+}
+
+// IDGeneratorFunc is a function implementing IDGenerator.
+type IDGeneratorFunc func(url string, dgst digest.Digest, offset, size int64) string
+
+func (f IDGeneratorFunc) GenID(url string, dgst digest.Digest, offset, size int64) string {
+	return f(url, dgst, offset, size)
+}
+
+func NewResolver(cfg config.BlobConfig, handlers map[string]Handler, opts ...ResolverOption) *Resolver {
 	if cfg.ChunkSize == 0 { // zero means "use default chunk size"
 		cfg.ChunkSize = defaultChunkSize
 	}
@@ -84,16 +144,65 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	if cfg.MaxWaitMSec == 0 {
 		cfg.MaxWaitMSec = defaultMaxWaitMSec
 	}
+	if cfg.FetchMaxAttempts > 1 && cfg.FetchRetryBaseMSec == 0 {
+		cfg.FetchRetryBaseMSec = defaultFetchRetryBaseMSec
+	}
+	if cfg.MinThroughput > 0 && cfg.StallWindowSec == 0 {
+		cfg.StallWindowSec = defaultStallWindowSec
+	}
 
-	return &Resolver{
+	r := &Resolver{
 		blobConfig: cfg,
 		handlers:   handlers,
 	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
 }
 
+// ErrBlobShrank is returned when the registry reports that the blob is smaller
+// than the size known at resolution.
+var ErrBlobShrank = errors.New("blob shrank")
+
+// ErrStalledFetch is returned when the throughput of fetching the blob stays
+// below the configured minimum for the stall window.
+var ErrStalledFetch = errors.New("fetch stalled")
+
+// ErrOversizedResponse is returned when the registry returns a response body
+// larger than the blob.
+var ErrOversizedResponse = errors.New("oversized response")
+
+// ErrRangeRejected is returned when the registry rejects the requested range
+// (e.g. because the span is too large).
+var ErrRangeRejected = errors.New("range rejected")
+
+// ErrLayerChanged is returned when the contents of the blob in the registry have
+// changed since the resolution. The blob should be refreshed.
+var ErrLayerChanged = errors.New("layer changed")
+
+// ErrPartTooLarge is returned when the headers of a part of a multipart response
+// exceed the limit (see WithMaxPartHeaderSize).
+var ErrPartTooLarge = errors.New("multipart part too large")
+
+// ErrUnsupportedEncoding is returned when the registry returns a response (or a
+// part of it) with a Content-Encoding which can't be decoded.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// defaultMaxPartHeaderSize is the default limit of the size of the headers of a
+// part of a multipart response.
+const defaultMaxPartHeaderSize = 64 * 1024
+
+// multipartPartOverhead is the allowance for the delimiter and the headers of
+// each part of a multipart response body.
+const multipartPartOverhead = 1024
+
 type Resolver struct {
-	blobConfig config.BlobConfig
-	handlers   map[string]Handler
+	blobConfig     config.BlobConfig
+	handlers       map[string]Handler
+	idGenerator    IDGenerator
+	tracer         trace.Tracer
+	parallelRanges int
 }
 
 type fetcher interface {
@@ -102,21 +211,64 @@ type fetcher interface {
 	genID(reg region) string
 }
 
-func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (Blob, error) {
+// tailFetcher is a fetcher which can fetch the tail of the blob without knowing
+// the size of the blob.
+type tailFetcher interface {
+	// fetchTail fetches the last n bytes of the blob. This returns the size of
+	// the blob learned from the response.
+	fetchTail(ctx context.Context, n int64) (multipartReadCloser, int64, error)
+}
+
+// connWarmer is a fetcher which can open connections to the registry in advance.
+type connWarmer interface {
+	// warmConnections opens n connections to the registry and leaves them idle
+	// in the connection pool.
+	warmConnections(ctx context.Context, n int) error
+}
+
+func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache, opts ...BlobOption) (Blob, error) {
+	blobConfig := &r.blobConfig
+	prefetchChunkSize, err := normalizePrefetchChunkSize(blobConfig.PrefetchChunkSize, blobConfig.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
 	f, size, err := r.resolveFetcher(ctx, hosts, refspec, desc)
 	if err != nil {
 		return nil, err
 	}
-	blobConfig := &r.blobConfig
 	return makeBlob(f,
 		size,
 		blobConfig.ChunkSize,
-		blobConfig.PrefetchChunkSize,
+		prefetchChunkSize,
 		blobCache,
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		time.Duration(blobConfig.FetchTimeoutSec)*time.Second,
+		append([]BlobOption{
+			withSource(hosts, refspec, desc),
+			withTracer(r.tracer),
+			withFetchRetries(blobConfig.FetchMaxAttempts, time.Duration(blobConfig.FetchRetryBaseMSec)*time.Millisecond),
+			WithCoalesceGap(blobConfig.CoalesceGap),
+		}, opts...)...), nil
+}
+
+// normalizePrefetchChunkSize validates the prefetch chunk size against the chunk
+// size. A prefetch chunk size larger than the chunk size is rounded down to a
+// multiple of the chunk size. A prefetch chunk size not larger than the chunk
+// size (including zero) is kept as is, meaning that each prefetch is fetched in
+// one request.
+func normalizePrefetchChunkSize(prefetchChunkSize, chunkSize int64) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	if prefetchChunkSize < 0 {
+		return 0, fmt.Errorf("invalid prefetch chunk size %d", prefetchChunkSize)
+	}
+	if prefetchChunkSize <= chunkSize {
+		return prefetchChunkSize, nil
+	}
+	return chunkSize * (prefetchChunkSize / chunkSize), nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
@@ -128,6 +280,22 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 		maxRetries:  blobConfig.MaxRetries,
 		minWaitMSec: time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
 		maxWaitMSec: time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+		network:     blobConfig.PreferredNetwork,
+
+		minThroughput: blobConfig.MinThroughput,
+		stallWindow:   time.Duration(blobConfig.StallWindowSec) * time.Second,
+
+		plainGetThreshold: blobConfig.PlainGetThreshold,
+
+		idGenerator: r.idGenerator,
+
+		hedgeDelay: time.Duration(blobConfig.HedgeDelayMSec) * time.Millisecond,
+
+		lenientContentRange: blobConfig.LenientContentRange,
+
+		parallelRanges: r.parallelRanges,
+
+		mirrorFailover: blobConfig.MirrorFailover,
 	}
 	var handlersErr error
 	for name, p := range r.handlers {
@@ -143,14 +311,19 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 	}
 
 	log.G(ctx).WithError(handlersErr).WithField("ref", refspec.String()).WithField("digest", desc.Digest).Debugf("using default handler")
-	hf, size, err := newHTTPFetcher(ctx, fc)
+	hfs, size, err := newHTTPFetchers(ctx, fc)
 	if err != nil {
 		return nil, 0, err
 	}
 	if blobConfig.ForceSingleRangeMode {
-		hf.singleRangeMode()
+		for _, hf := range hfs {
+			hf.singleRangeMode()
+		}
 	}
-	return hf, size, err
+	if len(hfs) > 1 {
+		return &multiFetcher{fetchers: hfs}, size, nil
+	}
+	return hfs[0], size, nil
 }
 
 type fetcherConfig struct {
@@ -160,32 +333,75 @@ type fetcherConfig struct {
 	maxRetries  int
 	minWaitMSec time.Duration
 	maxWaitMSec time.Duration
+	network     string
+
+	minThroughput int64
+	stallWindow   time.Duration
+
+	plainGetThreshold int64
+
+	idGenerator IDGenerator
+
+	hedgeDelay time.Duration
+
+	lenientContentRange bool
+
+	parallelRanges int
+
+	mirrorFailover bool
 }
 
-func jitter(duration time.Duration) time.Duration {
-	if duration <= 0 {
-		return duration
-	}
-	b, err := rand.Int(rand.Reader, big.NewInt(int64(duration)))
+// randInt63n returns a random number in [0, n) using crypto/rand.
+func randInt63n(n int64) int64 {
+	b, err := rand.Int(rand.Reader, big.NewInt(n))
 	if err != nil {
 		panic(err)
 	}
-	return time.Duration(b.Int64() + int64(duration))
+	return b.Int64()
 }
 
 // backoffStrategy extends retryablehttp's DefaultBackoff to add a random jitter to avoid overwhelming the repository
 // when it comes back online
 // DefaultBackoff either tries to parse the 'Retry-After' header of the response; or, it uses an exponential backoff
 // 2 ^ numAttempts, limited by max
-func backoffStrategy(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
-	delayTime := rhttp.DefaultBackoff(min, max, attemptNum, resp)
-	return jitter(delayTime)
+var backoffStrategy = newBackoffStrategy(randInt63n)
+
+// newBackoffStrategy returns the backoff with "full jitter", which waits for a random duration in [0, d] where d
+// is the exponential backoff of DefaultBackoff capped by max. This spreads retries of many blobs after a shared
+// failure of the registry. The delay requested by the registry with 'Retry-After' is respected as is.
+// rnd returns a random number in [0, n) and can be injected for testing.
+func newBackoffStrategy(rnd func(n int64) int64) rhttp.Backoff {
+	return func(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+		delayTime := rhttp.DefaultBackoff(min, max, attemptNum, resp)
+		if resp != nil && resp.Header.Get("Retry-After") != "" {
+			return delayTime
+		}
+		if delayTime > max {
+			delayTime = max
+		}
+		if delayTime <= 0 {
+			return 0
+		}
+		return time.Duration(rnd(int64(delayTime) + 1))
+	}
+}
+
+type noTransportRetriesKey struct{}
+
+// withoutTransportRetries returns the context whose requests aren't retried by retryStrategy. This is used by the
+// fetches retried by the blob itself (see withFetchRetries).
+func withoutTransportRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTransportRetriesKey{}, true)
 }
 
 // retryStrategy extends retryablehttp's DefaultRetryPolicy to debug log the error when retrying
 // DefaultRetryPolicy retries whenever err is non-nil (except for some url errors) or if returned
 // status code is 429 or 5xx (except 501)
+// Requests with the context from withoutTransportRetries aren't retried.
 func retryStrategy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Value(noTransportRetriesKey{}) != nil {
+		return false, ctx.Err()
+	}
 	retry, err2 := rhttp.DefaultRetryPolicy(ctx, resp, err)
 	if retry {
 		log.G(ctx).WithError(err).Debugf("Retrying request")
@@ -194,6 +410,17 @@ func retryStrategy(ctx context.Context, resp *http.Response, err error) (bool, e
 }
 
 func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64, error) {
+	hfs, size, err := newHTTPFetchers(ctx, fc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hfs[0], size, nil
+}
+
+// newHTTPFetchers returns the fetchers of the blob on the mirrors. Only the first
+// available mirror is returned unless fc.mirrorFailover is true, in which case
+// all of the mirrors serving the blob of the same size are returned in order.
+func newHTTPFetchers(ctx context.Context, fc *fetcherConfig) ([]*httpFetcher, int64, error) {
 	reghosts, err := fc.hosts(fc.refspec)
 	if err != nil {
 		return nil, 0, err
@@ -210,6 +437,8 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 
 	// Try to create fetcher until succeeded
 	rErr := fmt.Errorf("failed to resolve")
+	var primary *httpFetcher
+	var mirrors []*httpFetcher
 	for _, host := range reghosts {
 		if host.Host == "" || strings.Contains(host.Host, "/") {
 			rErr = fmt.Errorf("invalid destination (host %q, ref:%q, digest:%q): %w", host.Host, fc.refspec, digest, rErr)
@@ -219,6 +448,9 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 
 		// Prepare transport with authorization functionality
 		tr := host.Client.Transport
+		if fc.network != "" {
+			tr = withPreferredNetwork(tr, fc.network)
+		}
 
 		timeout := host.Client.Timeout
 		if rt, ok := tr.(*rhttp.RoundTripper); ok {
@@ -253,7 +485,7 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 		// Get size information
 		// TODO: we should try to use the Size field in the descriptor here.
 		start := time.Now() // start time before getting layer header
-		size, err := getSize(ctx, url, tr, timeout, header)
+		size, etag, err := getSize(ctx, url, tr, timeout, header)
 		commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.StargzHeaderGet, digest, start) // time to get layer header
 		if err != nil {
 			rErr = fmt.Errorf("failed to get size (host %q, ref:%q, digest:%q): %v: %w", host.Host, fc.refspec, digest, err, rErr)
@@ -261,20 +493,114 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 		}
 
 		// Hit one destination
-		return &httpFetcher{
+		hf := &httpFetcher{
 			url:       url,
 			tr:        tr,
 			blobURL:   blobURL,
 			digest:    digest,
+			size:      size,
+			etag:      etag,
 			timeout:   timeout,
 			header:    header,
 			orgHeader: host.Header,
-		}, size, nil
+
+			minThroughput: fc.minThroughput,
+			stallWindow:   fc.stallWindow,
+
+			plainGetThreshold: fc.plainGetThreshold,
+
+			lenientContentRange: fc.lenientContentRange,
+
+			parallelRanges: fc.parallelRanges,
+
+			idGenerator: fc.idGenerator,
+		}
+		if fc.mirrorFailover {
+			if len(mirrors) > 0 && hf.size != mirrors[0].size {
+				rErr = fmt.Errorf("size %d differs from %d of the first mirror (host %q, ref:%q, digest:%q): %w", hf.size, mirrors[0].size, host.Host, fc.refspec, digest, rErr)
+				continue // Try another
+			}
+			mirrors = append(mirrors, hf)
+			continue
+		}
+		if fc.hedgeDelay <= 0 {
+			return []*httpFetcher{hf}, size, nil
+		}
+
+		// Find another destination for hedging the requests.
+		if primary == nil {
+			primary = hf
+			continue
+		}
+		if hf.size != primary.size {
+			rErr = fmt.Errorf("size %d differs from %d of the primary (host %q, ref:%q, digest:%q): %w", hf.size, primary.size, host.Host, fc.refspec, digest, rErr)
+			continue // Try another
+		}
+		primary.hedge, primary.hedgeDelay = hf, fc.hedgeDelay
+		return []*httpFetcher{primary}, primary.size, nil
+	}
+	if len(mirrors) > 0 {
+		return mirrors, mirrors[0].size, nil
+	}
+	if primary != nil {
+		return []*httpFetcher{primary}, primary.size, nil // no destination for hedging
 	}
 
 	return nil, 0, fmt.Errorf("cannot resolve layer: %w", rErr)
 }
 
+// withPreferredNetwork makes the transport dial the registry with the specified
+// network ("tcp4" or "tcp6") first. If it fails, the transport falls back to the
+// network requested by the caller of the dialer. Transports other than
+// *http.Transport (possibly wrapped by retryablehttp) are returned as is. The
+// passed transport isn't modified.
+func withPreferredNetwork(tr http.RoundTripper, network string) http.RoundTripper {
+	switch t := tr.(type) {
+	case *http.Transport:
+		t = t.Clone()
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, n, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+			log.G(ctx).WithError(err).Debugf("failed to dial %q with %q; falling back to %q", addr, network, n)
+			return dial(ctx, n, addr)
+		}
+		return t
+	case *rhttp.RoundTripper:
+		if t.Client == nil || t.Client.HTTPClient == nil {
+			return tr
+		}
+		// The client is shared by the registry host (and the following resolutions),
+		// so wrap a copy of it instead of modifying it.
+		inner := t.Client.HTTPClient.Transport
+		if inner == nil {
+			inner = http.DefaultTransport
+		}
+		httpClient := *t.Client.HTTPClient
+		httpClient.Transport = withPreferredNetwork(inner, network)
+		c := t.Client
+		return &rhttp.RoundTripper{Client: &rhttp.Client{
+			HTTPClient:      &httpClient,
+			Logger:          c.Logger,
+			RetryWaitMin:    c.RetryWaitMin,
+			RetryWaitMax:    c.RetryWaitMax,
+			RetryMax:        c.RetryMax,
+			RequestLogHook:  c.RequestLogHook,
+			ResponseLogHook: c.ResponseLogHook,
+			CheckRetry:      c.CheckRetry,
+			Backoff:         c.Backoff,
+			ErrorHandler:    c.ErrorHandler,
+			PrepareRetry:    c.PrepareRetry,
+		}}
+	}
+	return tr
+}
+
 type transport struct {
 	inner http.RoundTripper
 	auth  docker.Authorizer
@@ -359,7 +685,9 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 	return
 }
 
-func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration, header http.Header) (int64, error) {
+// getSize returns the size of the blob. This also returns the strong ETag of the
+// blob if the registry provides it.
+func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration, header http.Header) (int64, string, error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -367,7 +695,7 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	req.Header = http.Header{}
 	for k, v := range header {
@@ -376,11 +704,12 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	req.Close = false
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer res.Body.Close()
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, strongETag(res.Header), err
 	}
 	headStatusCode := res.StatusCode
 
@@ -389,7 +718,7 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	// HEAD request (2020).
 	req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to make request to the registry: %w", err)
+		return 0, "", fmt.Errorf("failed to make request to the registry: %w", err)
 	}
 	req.Header = http.Header{}
 	for k, v := range header {
@@ -399,7 +728,7 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	req.Header.Set("Range", "bytes=0-1")
 	res, err = tr.RoundTrip(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to request: %w", err)
+		return 0, "", fmt.Errorf("failed to request: %w", err)
 	}
 	defer func() {
 		io.Copy(io.Discard, res.Body)
@@ -407,27 +736,57 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}()
 
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, strongETag(res.Header), err
 	} else if res.StatusCode == http.StatusPartialContent {
 		_, size, err := parseRange(res.Header.Get("Content-Range"))
-		return size, err
+		return size, strongETag(res.Header), err
 	}
 
-	return 0, fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
+	return 0, "", fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
 		headStatusCode, res.StatusCode)
 }
 
+// strongETag returns the ETag in the header if it's a strong one. Weak ETags
+// can't be used for If-Range (RFC 9110 Section 13.1.5).
+func strongETag(h http.Header) string {
+	etag := h.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
 type httpFetcher struct {
 	url           string
 	urlMu         sync.Mutex
 	tr            http.RoundTripper
 	blobURL       string
 	digest        digest.Digest
+	size          int64  // size of the blob known at resolution; zero if unknown
+	etag          string // strong ETag of the blob known at resolution; empty if unknown
 	singleRange   bool
 	singleRangeMu sync.Mutex
 	timeout       time.Duration
 	header        http.Header
 	orgHeader     http.Header
+	minThroughput int64 // bytes/sec; zero disables the stall detection
+	stallWindow   time.Duration
+
+	// blobs smaller than this are fetched without Range; zero disables it
+	plainGetThreshold int64
+
+	hedge      *httpFetcher // another destination the requests are hedged to; nil if disabled
+	hedgeDelay time.Duration
+
+	// trusts Content-Range of 200 responses (see config.BlobConfig.LenientContentRange)
+	lenientContentRange bool
+
+	// max single-range requests of a fetch in flight instead of a multi-range
+	// request; zero disables it (see WithParallelRangeFetches)
+	parallelRanges int
+
+	idGenerator IDGenerator // generates the cache keys; nil uses the default scheme
 }
 
 type multipartReadCloser interface {
@@ -436,6 +795,103 @@ type multipartReadCloser interface {
 }
 
 func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	if f.hedge != nil {
+		return f.fetchHedged(ctx, rs, retry)
+	}
+	return f.fetchFrom(ctx, rs, retry)
+}
+
+type hedgeResult struct {
+	idx    int // index of the request; 0 is the primary
+	mr     multipartReadCloser
+	err    error
+	cancel context.CancelFunc
+}
+
+// fetchHedged fetches the regions from this destination and, if it doesn't
+// respond within hedgeDelay, from the hedge destination too. The first
+// successful response is used and the other request is canceled. A failure
+// isn't hedged; it's returned unless the request to the other destination is
+// already in flight.
+func (f *httpFetcher) fetchHedged(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	start := func(fetch func(context.Context, []region, bool) (multipartReadCloser, error)) {
+		fctx, cancel := context.WithCancel(ctx)
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			mr, err := fetch(fctx, rs, retry)
+			results <- hedgeResult{idx, mr, err, cancel}
+		}()
+	}
+	start(f.fetchFrom)
+	cancelAll := func() {
+		for _, c := range cancels {
+			c()
+		}
+	}
+	timer := time.NewTimer(f.hedgeDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			log.G(ctx).WithField("url", f.hedge.url).Debugf("hedging the request after %v", f.hedgeDelay)
+			start(f.hedge.fetch)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				if len(cancels) == 1 {
+					cancelAll() // not hedged yet
+					return nil, r.err
+				}
+				continue
+			}
+			// Cancel the other request and discard its response.
+			for i, c := range cancels {
+				if i != r.idx {
+					c()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if l := <-results; l.mr != nil {
+						l.mr.Close()
+					}
+				}
+			}(pending)
+			return withCancelOnClose(r.mr, r.cancel), nil
+		}
+	}
+	cancelAll()
+	return nil, firstErr
+}
+
+// withCancelOnClose returns mr which calls cancel when it's closed.
+func withCancelOnClose(mr multipartReadCloser, cancel context.CancelFunc) multipartReadCloser {
+	if ns, ok := mr.(*noStoreReader); ok {
+		return &noStoreReader{&cancelOnClose{ns.multipartReadCloser, cancel}}
+	}
+	return &cancelOnClose{mr, cancel}
+}
+
+type cancelOnClose struct {
+	multipartReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.multipartReadCloser.Close()
+}
+
+// fetchFrom fetches the regions from the destination of this fetcher.
+func (f *httpFetcher) fetchFrom(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
 	if len(rs) == 0 {
 		return nil, fmt.Errorf("no request queried")
 	}
@@ -454,6 +910,9 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		s.add(reg)
 	}
 	requests := s.rs
+	if f.parallelRanges > 0 && len(requests) > 1 {
+		return f.fetchParallel(ctx, requests, retry)
+	}
 	if singleRangeMode {
 		// Squash requests if the layer doesn't support multi range.
 		requests = []region{superRegion(requests)}
@@ -461,38 +920,106 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 
 	// Request to the registry
 	f.urlMu.Lock()
-	url := f.url
+	url, header := f.url, f.header
 	f.urlMu.Unlock()
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = http.Header{}
-	for k, v := range f.header {
+	for k, v := range header {
 		req.Header[k] = v
 	}
 	var ranges string
 	for _, reg := range requests {
 		ranges += fmt.Sprintf("%d-%d,", reg.b, reg.e)
 	}
-	req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
+	if f.rangeAllowed() {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
+		if f.etag != "" {
+			// The registry returns the whole new contents if the blob changed.
+			req.Header.Set("If-Range", f.etag)
+		}
+	} // otherwise, we get the whole blob in one part
 	req.Header.Add("Accept-Encoding", "identity")
+	setPriority(ctx, req.Header)
 	req.Close = false
 
 	// Recording the roundtrip latency for remote registry GET operation.
 	start := time.Now()
-	res, err := tr.RoundTrip(req) // NOT DefaultClient; don't want redirects
+	res, err := f.roundTrip(ctx, tr, req) // NOT DefaultClient; don't want redirects
 	commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.RemoteRegistryGet, f.digest, start)
+	record := AuditRecord{
+		Time:  start,
+		URL:   url,
+		Range: req.Header.Get("Range"),
+		Err:   err,
+	}
+	if err == nil {
+		record.StatusCode = res.StatusCode
+		record.Bytes = res.ContentLength
+	}
+	audit(ctx, record)
 	if err != nil {
 		return nil, err
 	}
+	if f.minThroughput > 0 && f.stallWindow > 0 &&
+		(res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent) {
+		res.Body = newStallDetector(res.Body, f.minThroughput, f.stallWindow)
+	}
+	// Some registries and proxies encode (e.g. zstd) the response regardless of
+	// "Accept-Encoding: identity". The body is decoded before the other checks so
+	// that the limit of the size applies to the decoded contents.
+	encoded := !isIdentityEncoding(res.Header.Get("Content-Encoding"))
+	if encoded && (res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent) {
+		body, err := newContentDecoder(res.Header.Get("Content-Encoding"), res.Body)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		res.Body = body
+	}
 	if res.StatusCode == http.StatusOK {
+		if ifRange := req.Header.Get("If-Range"); ifRange != "" {
+			// 200 to If-Range means that the blob changed unless the registry
+			// just ignores the range and returns the same blob.
+			if etag := res.Header.Get("ETag"); etag != "" && etag != ifRange {
+				res.Body.Close()
+				return nil, fmt.Errorf("%w: ETag %s; want %s", ErrLayerChanged, etag, ifRange)
+			}
+		}
+
+		// Some registries respond to the range request with 200 and the
+		// Content-Range of the part of the blob.
+		if reg, size, err := parseRange(res.Header.Get("Content-Range")); err == nil && (reg.b != 0 || reg.e != size-1) {
+			if !f.lenientContentRange {
+				res.Body.Close()
+				return nil, fmt.Errorf("status %v with Content-Range %q of the part of the blob", res.Status, res.Header.Get("Content-Range"))
+			}
+			return f.newRangeReader(res, reg, size)
+		}
+
 		// We are getting the whole blob in one part (= status 200)
-		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
-		if err != nil {
+		var size int64
+		if encoded {
+			// Content-Length is the size of the encoded contents.
+			if f.size <= 0 {
+				res.Body.Close()
+				return nil, fmt.Errorf("size of the encoded blob is unknown")
+			}
+			size = f.size
+		} else if size, err = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Length: %w", err)
 		}
-		return newSinglePartReader(region{0, size - 1}, res.Body), nil
+		if err := f.checkSize(size); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		if f.size > 0 && size > f.size {
+			res.Body.Close()
+			return nil, fmt.Errorf("%w: Content-Length %d; blob size %d", ErrOversizedResponse, size, f.size)
+		}
+		return withCacheControl(newSinglePartReader(region{0, size - 1}, f.limitBody(res.Body, 0)), res.Header), nil
 	} else if res.StatusCode == http.StatusPartialContent {
 		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 		if err != nil {
@@ -500,15 +1027,34 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		}
 		if strings.HasPrefix(mediaType, "multipart/") {
 			// We are getting a set of chunks as a multipart body.
-			return newMultiPartReader(res.Body, params["boundary"]), nil
+			boundary, ok := params["boundary"]
+			if !ok || boundary == "" {
+				res.Body.Close()
+				return nil, fmt.Errorf("multipart body doesn't have boundary: %q", res.Header.Get("Content-Type"))
+			}
+			mr := newMultiPartReader(f.limitBody(res.Body, len(requests)+1), boundary, maxPartHeaderSize(ctx))
+			mr.(*multipartReader).checkSize = f.checkSize
+			return withCacheControl(mr, res.Header), nil
 		}
 
 		// We are getting single range
-		reg, _, err := parseRange(res.Header.Get("Content-Range"))
+		reg, size, err := parseRange(res.Header.Get("Content-Range"))
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse Content-Range: %w", err)
 		}
-		return newSinglePartReader(reg, res.Body), nil
+		return f.newRangeReader(res, reg, size)
+	} else if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The server reports the current size of the blob as "bytes */<size>".
+		if size, err := parseUnsatisfiedRange(res.Header.Get("Content-Range")); err == nil {
+			if err := f.checkSize(size); err != nil {
+				return nil, err
+			}
+		}
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %v", ErrRangeRejected, res.Status)
+	} else if res.StatusCode == http.StatusRequestEntityTooLarge {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %v", ErrRangeRejected, res.Status)
 	} else if retry && res.StatusCode == http.StatusForbidden {
 		log.G(ctx).Infof("Received status code: %v. Refreshing URL and retrying...", res.Status)
 
@@ -516,142 +1062,811 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err := f.refreshURL(ctx); err != nil {
 			return nil, fmt.Errorf("failed to refresh URL on %v: %w", res.Status, err)
 		}
-		return f.fetch(ctx, rs, false)
+		return f.fetchFrom(ctx, rs, false)
 	} else if retry && res.StatusCode == http.StatusBadRequest && !singleRangeMode {
 		log.G(ctx).Infof("Received status code: %v. Setting single range mode and retrying...", res.Status)
 
 		// gcr.io (https://storage.googleapis.com) returns 400 on multi-range request (2020 #81)
-		f.singleRangeMode()            // fallbacks to singe range request mode
-		return f.fetch(ctx, rs, false) // retries with the single range mode
+		f.singleRangeMode()                // fallbacks to singe range request mode
+		return f.fetchFrom(ctx, rs, false) // retries with the single range mode
 	}
 
-	return nil, fmt.Errorf("unexpected status code: %v", res.Status)
+	res.Body.Close()
+	return nil, &FetchError{StatusCode: res.StatusCode, Regions: exportRegions(rs), URL: url}
 }
 
-func (f *httpFetcher) check() error {
-	ctx := context.Background()
-	if f.timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, f.timeout)
-		defer cancel()
-	}
-	f.urlMu.Lock()
-	url := f.url
-	f.urlMu.Unlock()
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("check failed: failed to make request: %w", err)
-	}
-	req.Header = http.Header{}
-	for k, v := range f.header {
-		req.Header[k] = v
-	}
-	req.Close = false
-	req.Header.Set("Range", "bytes=0-1")
-	res, err := f.tr.RoundTrip(req)
-	if err != nil {
-		return fmt.Errorf("check failed: failed to request to registry: %w", err)
-	}
-	defer func() {
-		io.Copy(io.Discard, res.Body)
-		res.Body.Close()
-	}()
-	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
-		return nil
-	} else if res.StatusCode == http.StatusForbidden {
-		// Try to re-redirect this blob
-		rCtx := context.Background()
-		if f.timeout > 0 {
-			var rCancel context.CancelFunc
-			rCtx, rCancel = context.WithTimeout(rCtx, f.timeout)
-			defer rCancel()
+// fetchParallel fetches each of the regions by a single-range request, at most
+// f.parallelRanges in flight at once. The responses are read in the order of
+// the regions.
+func (f *httpFetcher) fetchParallel(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	var (
+		readers = make([]multipartReadCloser, len(rs))
+		errs    = make([]error, len(rs))
+		sem     = make(chan struct{}, f.parallelRanges)
+		wg      sync.WaitGroup
+	)
+	for i, reg := range rs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, reg region) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			readers[i], errs[i] = f.fetchFrom(ctx, []region{reg}, retry)
+		}(i, reg)
+	}
+	wg.Wait()
+
+	var noStore bool
+	for i, err := range errs {
+		if err != nil {
+			for _, r := range readers {
+				if r != nil {
+					r.Close()
+				}
+			}
+			return nil, fmt.Errorf("failed to fetch region %d-%d: %w", rs[i].b, rs[i].e, err)
 		}
-		if err := f.refreshURL(rCtx); err == nil {
-			return nil
+		if _, ok := readers[i].(*noStoreReader); ok {
+			noStore = true
 		}
-		return fmt.Errorf("failed to refresh URL on status %v", res.Status)
 	}
+	var mr multipartReadCloser = &chainedReader{readers: readers}
+	if noStore {
+		mr = &noStoreReader{mr}
+	}
+	return mr, nil
+}
 
-	return fmt.Errorf("unexpected status code %v", res.StatusCode)
+// chainedReader reads the parts of the readers in order.
+type chainedReader struct {
+	readers []multipartReadCloser
 }
 
-func (f *httpFetcher) refreshURL(ctx context.Context) error {
-	newURL, headers, err := redirect(ctx, f.blobURL, f.tr, f.timeout, f.orgHeader)
-	if err != nil {
-		return err
+func (c *chainedReader) Next() (region, io.Reader, error) {
+	for len(c.readers) > 0 {
+		reg, p, err := c.readers[0].Next()
+		if err != io.EOF {
+			return reg, p, err
+		}
+		c.readers[0].Close()
+		c.readers = c.readers[1:]
 	}
-	f.urlMu.Lock()
-	f.url = newURL
-	f.header = headers
-	f.urlMu.Unlock()
-	return nil
+	return region{}, nil, io.EOF
 }
 
-func (f *httpFetcher) genID(reg region) string {
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.blobURL, reg.b, reg.e)))
-	return fmt.Sprintf("%x", sum)
+func (c *chainedReader) Close() (err error) {
+	for _, r := range c.readers {
+		if cErr := r.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	c.readers = nil
+	return err
 }
 
-func (f *httpFetcher) singleRangeMode() {
-	f.singleRangeMu.Lock()
-	f.singleRange = true
-	f.singleRangeMu.Unlock()
+// newRangeReader returns the reader of the response whose body is the contents
+// of reg of the blob of the size.
+func (f *httpFetcher) newRangeReader(res *http.Response, reg region, size int64) (multipartReadCloser, error) {
+	if err := f.checkSize(size); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if f.size > 0 && reg.e >= f.size {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: range %d-%d; blob size %d", ErrOversizedResponse, reg.b, reg.e, f.size)
+	}
+	return withCacheControl(newSinglePartReader(reg, f.limitBody(res.Body, 0)), res.Header), nil
 }
 
-func (f *httpFetcher) isSingleRangeMode() bool {
-	f.singleRangeMu.Lock()
-	r := f.singleRange
-	f.singleRangeMu.Unlock()
-	return r
+// FetchError is returned when fetching the regions of the blob from the registry
+// fails. Callers can distinguish the failures with errors.As, e.g. 404 (the layer
+// is gone; refresh it) from 503 (retry).
+type FetchError struct {
+	// StatusCode is the unexpected status code of the response. This is zero if
+	// the fetch failed for other reasons (e.g. network errors), which Err holds.
+	StatusCode int
+
+	// Regions is the regions failed to be fetched.
+	Regions []Region
+
+	// URL is the URL of the blob. This is empty if unknown.
+	URL string
+
+	// Err is the cause of the failure, if any.
+	Err error
 }
 
-func newSinglePartReader(reg region, rc io.ReadCloser) multipartReadCloser {
-	return &singlepartReader{
-		r:      rc,
-		Closer: rc,
-		reg:    reg,
+func (e *FetchError) Error() string {
+	var ranges []string
+	for _, r := range e.Regions {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Size-1))
+	}
+	msg := fmt.Sprintf("failed to fetch region %s", strings.Join(ranges, ","))
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": unexpected status code: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
 	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
 }
 
-type singlepartReader struct {
-	io.Closer
-	r      io.Reader
-	reg    region
-	called bool
-}
+func (e *FetchError) Unwrap() error { return e.Err }
 
-func (sr *singlepartReader) Next() (region, io.Reader, error) {
-	if !sr.called {
-		sr.called = true
-		return sr.reg, sr.r, nil
+// limitBody returns the response body which is aborted with ErrOversizedResponse
+// when it exceeds the size of the blob plus the overhead of the specified number
+// of multipart parts. This guards the memory and the cache against malicious or
+// misconfigured servers. body is returned as is if the size of the blob is
+// unknown.
+func (f *httpFetcher) limitBody(body io.ReadCloser, parts int) io.ReadCloser {
+	if f.size <= 0 {
+		return body
+	}
+	return &limitedBody{
+		ReadCloser: body,
+		remaining:  f.size + int64(parts)*multipartPartOverhead,
 	}
-	return region{}, nil, io.EOF
 }
 
-func newMultiPartReader(rc io.ReadCloser, boundary string) multipartReadCloser {
-	return &multipartReader{
-		m:      multipart.NewReader(rc, boundary),
-		Closer: rc,
-	}
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrOversizedResponse
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1] // read one extra byte to detect the excess
+	}
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = -1
+		return n, ErrOversizedResponse
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// roundTrip sends the request to the registry. If the registry returns 401 and
+// an AuthRefresher is attached to ctx, this refreshes the credentials of the
+// request and retries it once.
+func (f *httpFetcher) roundTrip(ctx context.Context, tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	countRequest(ctx)
+	res, err := tr.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	refresh := authRefresherFromContext(ctx)
+	if refresh == nil {
+		return res, nil
+	}
+	log.G(ctx).Infof("Received status code: %v. Refreshing token and retrying...", res.Status)
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	req = req.Clone(ctx)
+	if err := refresh(ctx, req); err != nil {
+		return nil, fmt.Errorf("failed to refresh authentication: %w", err)
+	}
+	countRequest(ctx)
+	return tr.RoundTrip(req)
+}
+
+// fetchTail fetches the last n bytes of the blob using a suffix-range request
+// ("bytes=-n"). The region of the returned reader is an absolute offset in the
+// blob, based on Content-Range of the response.
+func (f *httpFetcher) fetchTail(ctx context.Context, n int64) (multipartReadCloser, int64, error) {
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("invalid suffix length %d", n)
+	}
+	f.urlMu.Lock()
+	url, header := f.url, f.header
+	f.urlMu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header = http.Header{}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if f.rangeAllowed() {
+		req.Header.Add("Range", fmt.Sprintf("bytes=-%d", n))
+	}
+	req.Header.Add("Accept-Encoding", "identity")
+	setPriority(ctx, req.Header)
+	req.Close = false
+
+	start := time.Now()
+	res, err := f.roundTrip(ctx, f.tr, req) // NOT DefaultClient; don't want redirects
+	commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.RemoteRegistryGet, f.digest, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode == http.StatusOK {
+		// The suffix is larger than the blob or the server ignored Range.
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			res.Body.Close()
+			return nil, 0, fmt.Errorf("failed to parse Content-Length: %w", err)
+		}
+		if err := f.checkSize(size); err != nil {
+			res.Body.Close()
+			return nil, 0, err
+		}
+		return newSinglePartReader(region{0, size - 1}, res.Body), size, nil
+	} else if res.StatusCode == http.StatusPartialContent {
+		reg, size, err := parseRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			res.Body.Close()
+			return nil, 0, fmt.Errorf("failed to parse Content-Range: %w", err)
+		}
+		if err := f.checkSize(size); err != nil {
+			res.Body.Close()
+			return nil, 0, err
+		}
+		return newSinglePartReader(reg, res.Body), size, nil
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestedRangeNotSatisfiable, http.StatusNotImplemented:
+		// The server doesn't support suffix ranges.
+		return nil, 0, fmt.Errorf("%w: %v", ErrRangeRejected, res.Status)
+	}
+	return nil, 0, fmt.Errorf("unexpected status code: %v", res.Status)
+}
+
+// warmConnections opens n connections to the registry concurrently and parks
+// them in the connection pool of the transport for reuse by the following reads.
+// Each connection is opened by a single-byte range request and all responses are
+// kept open until every request gets the response so that no connection is reused
+// among them. The number of the connections kept idle is limited by the transport
+// (e.g. MaxIdleConnsPerHost of http.Transport).
+func (f *httpFetcher) warmConnections(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	f.urlMu.Lock()
+	url, header := f.url, f.header
+	f.urlMu.Unlock()
+
+	var (
+		resCh = make(chan *http.Response, n)
+		errCh = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			req.Header = http.Header{}
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			req.Header.Add("Range", "bytes=0-0")
+			req.Header.Add("Accept-Encoding", "identity")
+			req.Close = false
+			res, err := f.roundTrip(ctx, f.tr, req) // NOT DefaultClient; don't want redirects
+			if err != nil {
+				errCh <- err
+				return
+			}
+			resCh <- res
+		}()
+	}
+	var (
+		ress []*http.Response
+		errs []error
+	)
+	for i := 0; i < n; i++ {
+		select {
+		case res := <-resCh:
+			ress = append(ress, res)
+		case err := <-errCh:
+			errs = append(errs, err)
+		}
+	}
+	for _, res := range ress {
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+			errs = append(errs, fmt.Errorf("unexpected status code: %v", res.Status))
+		} else if res.StatusCode == http.StatusPartialContent {
+			// Consume the body so that the connection can be reused.
+			io.Copy(io.Discard, res.Body)
+		}
+		res.Body.Close()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to warm %d of %d connections: %w", len(errs), n, errs[0])
+	}
+	return nil
+}
+
+func (f *httpFetcher) check() error {
+	ctx := context.Background()
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	f.urlMu.Lock()
+	url, header := f.url, f.header
+	f.urlMu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("check failed: failed to make request: %w", err)
+	}
+	req.Header = http.Header{}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Close = false
+	if f.rangeAllowed() {
+		req.Header.Set("Range", "bytes=0-1")
+	}
+	res, err := f.tr.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("check failed: failed to request to registry: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+		return nil
+	} else if res.StatusCode == http.StatusForbidden {
+		// Try to re-redirect this blob
+		rCtx := context.Background()
+		if f.timeout > 0 {
+			var rCancel context.CancelFunc
+			rCtx, rCancel = context.WithTimeout(rCtx, f.timeout)
+			defer rCancel()
+		}
+		if err := f.refreshURL(rCtx); err == nil {
+			return nil
+		}
+		return fmt.Errorf("failed to refresh URL on status %v", res.Status)
+	}
+
+	return fmt.Errorf("unexpected status code %v", res.StatusCode)
+}
+
+func (f *httpFetcher) refreshURL(ctx context.Context) error {
+	newURL, headers, err := redirect(ctx, f.blobURL, f.tr, f.timeout, f.orgHeader)
+	if err != nil {
+		return err
+	}
+	f.urlMu.Lock()
+	f.url = newURL
+	f.header = headers
+	f.urlMu.Unlock()
+	return nil
+}
+
+func (f *httpFetcher) genID(reg region) string {
+	if f.idGenerator != nil {
+		return f.idGenerator.GenID(f.blobURL, f.digest, reg.b, reg.size())
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.blobURL, reg.b, reg.e)))
+	return fmt.Sprintf("%x", sum)
+}
+
+// checkSize returns ErrBlobShrank if the blob size reported by the registry is
+// smaller than the size known at resolution.
+func (f *httpFetcher) checkSize(size int64) error {
+	if f.size > 0 && size < f.size {
+		return fmt.Errorf("%w: size %d; want %d", ErrBlobShrank, size, f.size)
+	}
+	return nil
+}
+
+// rangeAllowed returns false if the blob is smaller than the threshold of
+// plain GET requests, which means requests to the blob mustn't have Range.
+func (f *httpFetcher) rangeAllowed() bool {
+	return f.plainGetThreshold <= 0 || f.size <= 0 || f.size >= f.plainGetThreshold
+}
+
+func (f *httpFetcher) singleRangeMode() {
+	f.singleRangeMu.Lock()
+	f.singleRange = true
+	f.singleRangeMu.Unlock()
+}
+
+func (f *httpFetcher) isSingleRangeMode() bool {
+	f.singleRangeMu.Lock()
+	r := f.singleRange
+	f.singleRangeMu.Unlock()
+	return r
+}
+
+// multiFetcher is a fetcher which fails over among the mirrors of the blob.
+// Requests go to the mirror which last succeeded, and the following mirrors are
+// tried in order on failure. IDs are always generated by the first mirror so
+// that the cache doesn't depend on the mirror which served the contents.
+type multiFetcher struct {
+	fetchers []*httpFetcher
+	cur      int32 // index of the last-good fetcher
+}
+
+// failover calls fn with the fetchers starting from the last-good one until it
+// succeeds. The fetcher which succeeded becomes the last-good one.
+func (f *multiFetcher) failover(ctx context.Context, fn func(hf *httpFetcher) error) error {
+	start := int(atomic.LoadInt32(&f.cur))
+	var allErr error
+	for i := range f.fetchers {
+		idx := (start + i) % len(f.fetchers)
+		err := fn(f.fetchers[idx])
+		if err == nil {
+			atomic.StoreInt32(&f.cur, int32(idx))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.G(ctx).WithError(err).Debugf("failed to use mirror %q; trying the next one", f.fetchers[idx].blobURL)
+		allErr = multierror.Append(allErr, err)
+	}
+	return allErr
+}
+
+// current returns the last-good fetcher.
+func (f *multiFetcher) current() *httpFetcher {
+	return f.fetchers[atomic.LoadInt32(&f.cur)]
+}
+
+func (f *multiFetcher) fetch(ctx context.Context, rs []region, retry bool) (mr multipartReadCloser, err error) {
+	err = f.failover(ctx, func(hf *httpFetcher) (err error) {
+		mr, err = hf.fetch(ctx, rs, retry)
+		return err
+	})
+	return mr, err
+}
+
+func (f *multiFetcher) fetchTail(ctx context.Context, n int64) (mr multipartReadCloser, size int64, err error) {
+	err = f.failover(ctx, func(hf *httpFetcher) (err error) {
+		mr, size, err = hf.fetchTail(ctx, n)
+		return err
+	})
+	return mr, size, err
+}
+
+func (f *multiFetcher) warmConnections(ctx context.Context, n int) error {
+	return f.current().warmConnections(ctx, n)
+}
+
+func (f *multiFetcher) check() error {
+	return f.failover(context.Background(), func(hf *httpFetcher) error {
+		return hf.check()
+	})
+}
+
+func (f *multiFetcher) genID(reg region) string {
+	return f.fetchers[0].genID(reg)
+}
+
+// noStoreReader is a reader of the response which mustn't be stored in the cache
+// (Cache-Control: no-store).
+type noStoreReader struct {
+	multipartReadCloser
+}
+
+// withCacheControl returns mr as noStoreReader if the response header h has
+// Cache-Control: no-store.
+func withCacheControl(mr multipartReadCloser, h http.Header) multipartReadCloser {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-store") {
+				return &noStoreReader{mr}
+			}
+		}
+	}
+	return mr
+}
+
+func newSinglePartReader(reg region, rc io.ReadCloser) multipartReadCloser {
+	return &singlepartReader{
+		r:      rc,
+		Closer: rc,
+		reg:    reg,
+	}
+}
+
+type singlepartReader struct {
+	io.Closer
+	r      io.Reader
+	reg    region
+	called bool
+}
+
+func (sr *singlepartReader) Next() (region, io.Reader, error) {
+	if !sr.called {
+		sr.called = true
+		return sr.reg, sr.r, nil
+	}
+	return region{}, nil, io.EOF
+}
+
+// newStallDetector returns a reader of rc which is aborted with ErrStalledFetch
+// when less than minThroughput*window bytes are read during a window. Only the
+// time spent in reading rc is counted as the window so that a consumer reading
+// slowly (e.g. waiting for the rate limit or writing to the cache) isn't taken
+// as a stall of the registry.
+func newStallDetector(rc io.ReadCloser, minThroughput int64, window time.Duration) io.ReadCloser {
+	d := &stallDetector{
+		ReadCloser: rc,
+		minBytes:   int64(float64(minThroughput) * window.Seconds()),
+		window:     window,
+		done:       make(chan struct{}),
+	}
+	go d.watch()
+	return d
+}
+
+type stallDetector struct {
+	io.ReadCloser
+	minBytes  int64
+	window    time.Duration
+	stalled   int32 // accessed atomically
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	read      int64         // bytes read in the current window
+	busy      time.Duration // time spent in reading rc in the current window
+	readStart time.Time     // start of the pending read; zero if none
+}
+
+func (d *stallDetector) watch() {
+	t := time.NewTicker(d.window / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-t.C:
+			d.mu.Lock()
+			if !d.readStart.IsZero() {
+				d.busy += now.Sub(d.readStart)
+				d.readStart = now
+			}
+			var stalled bool
+			if d.busy >= d.window {
+				stalled = d.read < d.minBytes
+				d.read, d.busy = 0, 0
+			}
+			d.mu.Unlock()
+			if stalled {
+				atomic.StoreInt32(&d.stalled, 1)
+				d.ReadCloser.Close() // unblocks the pending read
+				return
+			}
+		}
+	}
+}
+
+func (d *stallDetector) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&d.stalled) == 1 {
+		return 0, ErrStalledFetch
+	}
+	d.mu.Lock()
+	d.readStart = time.Now()
+	d.mu.Unlock()
+	n, err := d.ReadCloser.Read(p)
+	d.mu.Lock()
+	if !d.readStart.IsZero() {
+		d.busy += time.Since(d.readStart)
+	}
+	d.readStart = time.Time{}
+	d.read += int64(n)
+	d.mu.Unlock()
+	if err != nil && err != io.EOF && atomic.LoadInt32(&d.stalled) == 1 {
+		err = ErrStalledFetch
+	}
+	return n, err
+}
+
+func (d *stallDetector) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return d.ReadCloser.Close()
+}
+
+// newMultiPartReader returns a reader of the multipart body. Delimiters are parsed
+// by mime/multipart so the contents of the parts can contain the boundary string
+// as long as it isn't a delimiter line (RFC 2046 Section 5.1.1). Bytes after the
+// close delimiter are ignored because some registries append stray bytes there.
+// Reading fails with ErrPartTooLarge if the headers of a part exceed
+// maxHeaderSize bytes. Zero means no limit.
+func newMultiPartReader(rc io.ReadCloser, boundary string, maxHeaderSize int64) multipartReadCloser {
+	return &multipartReader{
+		m: multipart.NewReader(&closeDelimiterReader{
+			r:             bufio.NewReader(rc),
+			delim:         []byte("--" + boundary),
+			closeDelim:    []byte("--" + boundary + "--"),
+			lineStart:     true,
+			maxHeaderSize: maxHeaderSize,
+		}, boundary),
+		Closer: rc,
+	}
+}
+
+// closeDelimiterReader reads the multipart body until the close delimiter line
+// and returns io.EOF after that, discarding the trailing bytes (e.g. the rest of
+// the close delimiter line). mime/multipart treats any line starting with the
+// close delimiter as a delimiter so this doesn't truncate the contents of the
+// parts. This also limits the size of the headers of each part, which are the
+// lines between a delimiter line and the following empty line.
+type closeDelimiterReader struct {
+	r          *bufio.Reader
+	delim      []byte
+	closeDelim []byte
+	lineStart  bool
+	pending    []byte
+	err        error
+
+	maxHeaderSize int64
+	inHeader      bool
+	headerSize    int64
+}
+
+func (cr *closeDelimiterReader) Read(p []byte) (int, error) {
+	for len(cr.pending) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		line, err := cr.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			cr.err = err
+		}
+		if cr.lineStart && bytes.HasPrefix(line, cr.closeDelim) {
+			cr.pending = append(append([]byte{}, cr.closeDelim...), "\r\n"...)
+			cr.err = io.EOF
+			break
+		}
+		if cr.lineStart && cr.isDelimiter(line) {
+			cr.inHeader, cr.headerSize = true, 0
+		} else if cr.inHeader && cr.lineStart && (string(line) == "\r\n" || string(line) == "\n") {
+			cr.inHeader = false
+		} else if cr.inHeader {
+			cr.headerSize += int64(len(line))
+			if cr.maxHeaderSize > 0 && cr.headerSize > cr.maxHeaderSize {
+				cr.err = fmt.Errorf("%w: headers exceed %d bytes", ErrPartTooLarge, cr.maxHeaderSize)
+				continue
+			}
+		}
+		cr.pending = line
+		cr.lineStart = len(line) > 0 && line[len(line)-1] == '\n'
+	}
+	n := copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// isDelimiter returns true if line is a delimiter line. As matchAfterPrefix of
+// mime/multipart, the boundary must be followed by a whitespace, a newline or
+// "--"; otherwise the line (e.g. "--boundaryX") is a part of the contents.
+func (cr *closeDelimiterReader) isDelimiter(line []byte) bool {
+	if !bytes.HasPrefix(line, cr.delim) {
+		return false
+	}
+	rest := line[len(cr.delim):]
+	if len(rest) == 0 {
+		return true // the rest of the line isn't read yet
+	}
+	switch rest[0] {
+	case ' ', '\t', '\r', '\n':
+		return true
+	case '-':
+		return len(rest) == 1 || rest[1] == '-'
+	}
+	return false
 }
 
 type multipartReader struct {
 	io.Closer
-	m *multipart.Reader
+	m         *multipart.Reader
+	checkSize func(size int64) error
+	decoder   io.Closer // decoder of the current part; nil if it isn't encoded
 }
 
 func (sr *multipartReader) Next() (region, io.Reader, error) {
+	sr.closeDecoder()
 	p, err := sr.m.NextPart()
 	if err != nil {
 		return region{}, nil, err
 	}
-	reg, _, err := parseRange(p.Header.Get("Content-Range"))
+	reg, size, err := parseRange(p.Header.Get("Content-Range"))
 	if err != nil {
 		return region{}, nil, fmt.Errorf("failed to parse Content-Range: %w", err)
 	}
+	if sr.checkSize != nil {
+		if err := sr.checkSize(size); err != nil {
+			return region{}, nil, err
+		}
+	}
+	if encoding := p.Header.Get("Content-Encoding"); !isIdentityEncoding(encoding) {
+		d, err := newContentDecoder(encoding, p)
+		if err != nil {
+			return region{}, nil, fmt.Errorf("failed to decode part %d-%d: %w", reg.b, reg.e, err)
+		}
+		sr.decoder = d
+		return reg, d, nil
+	}
 	return reg, p, nil
 }
 
+func (sr *multipartReader) Close() error {
+	sr.closeDecoder()
+	return sr.Closer.Close()
+}
+
+func (sr *multipartReader) closeDecoder() {
+	if sr.decoder != nil {
+		sr.decoder.Close()
+		sr.decoder = nil
+	}
+}
+
+// isIdentityEncoding reports whether the Content-Encoding means that the
+// contents aren't encoded.
+func isIdentityEncoding(encoding string) bool {
+	encoding = strings.TrimSpace(encoding)
+	return encoding == "" || strings.EqualFold(encoding, "identity")
+}
+
+// newContentDecoder returns the reader of r decoded according to the
+// Content-Encoding, which lists the encodings in the order they were applied.
+// gzip, zstd and identity are supported. Closing the returned reader closes r
+// too.
+func newContentDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	d := &contentDecoder{Reader: r, closers: []io.Closer{r}}
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch e := strings.ToLower(strings.TrimSpace(encodings[i])); e {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(d.Reader)
+			if err != nil {
+				d.Close()
+				return nil, fmt.Errorf("failed to decode gzip: %w", err)
+			}
+			d.Reader = zr
+			d.closers = append(d.closers, zr)
+		case "zstd":
+			zr, err := zstd.NewReader(d.Reader, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				d.Close()
+				return nil, fmt.Errorf("failed to decode zstd: %w", err)
+			}
+			d.Reader = zr
+			d.closers = append(d.closers, zr.IOReadCloser())
+		default:
+			d.Close()
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, e)
+		}
+	}
+	return d, nil
+}
+
+type contentDecoder struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *contentDecoder) Close() (err error) {
+	// Close the decoders before the underlying reader.
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if cErr := d.closers[i].Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
 func parseRange(header string) (region, int64, error) {
 	submatches := contentRangeRegexp.FindStringSubmatch(header)
 	if len(submatches) < 4 {
@@ -673,11 +1888,78 @@ func parseRange(header string) (region, int64, error) {
 	return region{begin, end}, blobSize, nil
 }
 
+// parseUnsatisfiedRange parses Content-Range of the form "bytes */<size>"
+// returned with 416 status and returns the size of the blob.
+func parseUnsatisfiedRange(header string) (int64, error) {
+	sizeStr, ok := strings.CutPrefix(header, "bytes */")
+	if !ok {
+		return 0, fmt.Errorf("Content-Range %q isn't an unsatisfied range", header)
+	}
+	return strconv.ParseInt(sizeStr, 10, 64)
+}
+
 type Option func(*options)
 
 type options struct {
-	ctx       context.Context
-	cacheOpts []cache.Option
+	ctx          context.Context
+	cacheOpts    []cache.Option
+	yieldToReads bool
+
+	verifyConcurrency int
+
+	readWindowChunks int
+
+	readAheadChunks int
+
+	byteRangeHint int64
+
+	authRefresher AuthRefresher
+
+	onRequestCount func(n int)
+	requestCount   *int64
+
+	noSharedFetchRetry bool
+
+	writeVerify bool
+
+	bufPool *sync.Pool
+
+	auditSink AuditSink
+
+	cacheTimeout   time.Duration
+	onCacheLatency func(d time.Duration)
+
+	fetchTimeout time.Duration
+
+	onReadTiming func(t ReadTiming)
+	readTimer    *readTimer
+
+	forceRefresh bool
+
+	priority Priority
+
+	readLimiter RateLimiter
+
+	shuffle     bool
+	shuffleSeed int64
+
+	maxStagger time.Duration
+
+	fetchMaxAttempts    int
+	fetchRetryBaseDelay time.Duration
+
+	maxPartHeaderSize int64
+
+	spanCtx context.Context // carries the span of the operation; nil if untraced
+
+	fetcher fetcher // snapshot used by the whole operation; see snapshotFetcher
+
+	fetchPin *fetchPin // set for the leader of the fetch; see WithFetchPinning
+
+	prefetch        bool             // set by Cache
+	prefetchTracker *prefetchTracker // chunks added by the Cache call; set by Cache
+
+	background bool // set by Cache and Prefetch
 }
 
 func WithContext(ctx context.Context) Option {
@@ -692,6 +1974,339 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// withOptions inherits all of the specified options.
+func withOptions(o *options) Option {
+	return func(opts *options) {
+		*opts = *o
+	}
+}
+
+// WithYieldToReads makes Cache pause fetching while foreground reads (ReadAt)
+// are in progress and resume when they are idle.
+func WithYieldToReads() Option {
+	return func(opts *options) {
+		opts.yieldToReads = true
+	}
+}
+
+// WithVerifyConcurrency specifies the number of chunks read in parallel by Verify.
+func WithVerifyConcurrency(n int) Option {
+	return func(opts *options) {
+		opts.verifyConcurrency = n
+	}
+}
+
+// WithReadWindow makes ReadAt fetch and fill the buffer sequentially by windows
+// of the specified number of chunks, instead of all at once. This bounds the peak
+// memory used by large reads.
+func WithReadWindow(chunks int) Option {
+	return func(opts *options) {
+		opts.readWindowChunks = chunks
+	}
+}
+
+// WithReadAhead makes the reader returned by Reader read the blob by windows of
+// the specified number of chunks. This doesn't make ReadAt read ahead; see
+// WithByteRangeHint for that.
+func WithReadAhead(chunks int) Option {
+	return func(opts *options) {
+		opts.readAheadChunks = chunks
+	}
+}
+
+// WithByteRangeHint hints ReadAt that the n bytes following the read are likely
+// read next (e.g. by sequential reads of tar entries). On a cache miss, ReadAt
+// fetches the uncached chunks covering them too, into the cache but not into
+// the buffer, to save round trips of the following reads. The extended range
+// is aligned to the chunks and clipped to the blob size. Unlike WithReadAhead,
+// which specifies the window of Reader in chunks, n is in bytes so that callers
+// can pass the size of the following entries as is.
+func WithByteRangeHint(n int64) Option {
+	return func(opts *options) {
+		opts.byteRangeHint = n
+	}
+}
+
+// AuthRefresher refreshes the credentials of the request after the registry
+// returned 401 to it. This is expected to update the header of req (e.g.
+// Authorization) with the new credentials.
+type AuthRefresher func(ctx context.Context, req *http.Request) error
+
+// WithAuthRefresher makes requests to the registry retried once with the
+// credentials refreshed by the specified function when the registry returns 401.
+// Unlike Refresh of the blob, this doesn't re-resolve the blob.
+func WithAuthRefresher(f AuthRefresher) Option {
+	return func(opts *options) {
+		opts.authRefresher = f
+	}
+}
+
+type authRefresherKey struct{}
+
+func withAuthRefresher(ctx context.Context, f AuthRefresher) context.Context {
+	return context.WithValue(ctx, authRefresherKey{}, f)
+}
+
+func authRefresherFromContext(ctx context.Context) AuthRefresher {
+	f, _ := ctx.Value(authRefresherKey{}).(AuthRefresher)
+	return f
+}
+
+// WithRequestCountFunc specifies the callback which receives the number of
+// requests sent to the registry by a ReadAt call. This is 0 if all contents are
+// served from the cache.
+func WithRequestCountFunc(f func(n int)) Option {
+	return func(opts *options) {
+		opts.onRequestCount = f
+	}
+}
+
+// WithoutSharedFetchRetry makes the read fail immediately when it shares the
+// result of a concurrent fetch of the same regions but fails to read it from
+// the cache, instead of fetching the regions again.
+func WithoutSharedFetchRetry() Option {
+	return func(opts *options) {
+		opts.noSharedFetchRetry = true
+	}
+}
+
+// WithWriteVerify makes the fetched chunks read back from the cache after being
+// added and compared to the fetched bytes. The read fails if they don't match,
+// which catches corruption of the cache backend at write time.
+func WithWriteVerify() Option {
+	return func(opts *options) {
+		opts.writeVerify = true
+	}
+}
+
+// WithBufferPool makes the read use scratch buffers taken from the pool for copying
+// the fetched chunks instead of allocating them per call. The pool must return
+// non-empty buffers as *[]byte. Buffers are returned to the pool after use.
+func WithBufferPool(pool *sync.Pool) Option {
+	return func(opts *options) {
+		opts.bufPool = pool
+	}
+}
+
+// WithReadTimingFunc specifies the callback which receives the breakdown of the
+// time taken by each ReadAt once it returns.
+func WithReadTimingFunc(f func(t ReadTiming)) Option {
+	return func(opts *options) {
+		opts.onReadTiming = f
+	}
+}
+
+// WithCacheLatencyFunc specifies the callback which receives the latency of
+// each read of a chunk from the cache.
+func WithCacheLatencyFunc(f func(d time.Duration)) Option {
+	return func(opts *options) {
+		opts.onCacheLatency = f
+	}
+}
+
+// WithCacheTimeout makes the read give up reading a chunk from the cache after
+// the specified duration and fetch it from the registry instead. This is useful
+// when the cache backend can be slow (e.g. networked).
+func WithCacheTimeout(d time.Duration) Option {
+	return func(opts *options) {
+		opts.cacheTimeout = d
+	}
+}
+
+// WithFetchTimeout makes the fetches of this call time out after the specified
+// duration instead of the default timeout of the blob. This is useful for
+// prefetching a large range, which takes longer than a foreground read. If
+// WithContext is also specified, the timeout applies on top of that context.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(opts *options) {
+		opts.fetchTimeout = d
+	}
+}
+
+// WithForceRefresh makes ReadAt re-resolve the blob (see Refresh of Blob) before
+// reading it, unless the blob was refreshed within the cooldown specified by
+// WithRefreshCooldown. This is useful for reads after a suspected change of the
+// upstream.
+func WithForceRefresh() Option {
+	return func(opts *options) {
+		opts.forceRefresh = true
+	}
+}
+
+// WithShuffledOrder makes Cache fetch and cache the chunks one by one in the
+// order shuffled with the specified seed. This spreads the load when the cache
+// is sharded by key, at the cost of a request per chunk.
+func WithShuffledOrder(seed int64) Option {
+	return func(opts *options) {
+		opts.shuffle = true
+		opts.shuffleSeed = seed
+	}
+}
+
+// WithStagger makes Cache wait for a random duration up to max before launching
+// each of the ranges fetched in parallel (see config.BlobConfig.PrefetchChunkSize)
+// so that the requests spread over a short window instead of hitting the
+// registry at once. The wait is canceled with the context of WithContext.
+func WithStagger(max time.Duration) Option {
+	return func(opts *options) {
+		opts.maxStagger = max
+	}
+}
+
+// WithFetchRetries overrides the retries of fetches configured for the blob.
+// A fetch failed with a server error (5xx) or a network error is attempted up
+// to maxAttempts in total, with the exponential backoff from baseDelay with
+// full jitter. Fetches aren't retried if maxAttempts is 1.
+func WithFetchRetries(maxAttempts int, baseDelay time.Duration) Option {
+	return func(opts *options) {
+		opts.fetchMaxAttempts = maxAttempts
+		opts.fetchRetryBaseDelay = baseDelay
+	}
+}
+
+// WithMaxPartHeaderSize limits the size of the headers of each part of multipart
+// responses from the registry. A response exceeding it fails with ErrPartTooLarge.
+// The default is 64KiB.
+func WithMaxPartHeaderSize(n int64) Option {
+	return func(opts *options) {
+		opts.maxPartHeaderSize = n
+	}
+}
+
+// Priority is the priority of the requests to the registry.
+type Priority int
+
+const (
+	// PriorityDefault doesn't attach any priority to the request.
+	PriorityDefault Priority = iota
+
+	// PriorityHigh is for foreground reads which someone is waiting for.
+	PriorityHigh
+
+	// PriorityLow is for background reads like prefetch.
+	PriorityLow
+)
+
+// header returns the value of the Priority header (RFC 9218) of p. HTTP/2
+// proxies and servers can use this for scheduling the streams.
+func (p Priority) header() string {
+	switch p {
+	case PriorityHigh:
+		return "u=0"
+	case PriorityLow:
+		return "u=7"
+	}
+	return ""
+}
+
+// WithPriority attaches the specified priority to the requests to the registry.
+func WithPriority(p Priority) Option {
+	return func(opts *options) {
+		opts.priority = p
+	}
+}
+
+// WithReadLimit limits the bandwidth of the fetches of the operation by l instead
+// of the limiters specified by WithRateLimiters.
+func WithReadLimit(l RateLimiter) Option {
+	return func(opts *options) {
+		opts.readLimiter = l
+	}
+}
+
+type priorityKey struct{}
+
+func withPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// setPriority sets the priority attached to ctx, if any, to the request header.
+func setPriority(ctx context.Context, h http.Header) {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p.header() != "" {
+		h.Set("Priority", p.header())
+	}
+}
+
+type maxPartHeaderSizeKey struct{}
+
+func withMaxPartHeaderSize(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxPartHeaderSizeKey{}, n)
+}
+
+// maxPartHeaderSize returns the limit of the size of the headers of a multipart
+// part attached to ctx, or the default one.
+func maxPartHeaderSize(ctx context.Context) int64 {
+	if n, ok := ctx.Value(maxPartHeaderSizeKey{}).(int64); ok {
+		return n
+	}
+	return defaultMaxPartHeaderSize
+}
+
+type requestCounterKey struct{}
+
+func withRequestCounter(ctx context.Context, count *int64) context.Context {
+	return context.WithValue(ctx, requestCounterKey{}, count)
+}
+
+// countRequest increments the request counter attached to ctx, if any.
+func countRequest(ctx context.Context) {
+	if count, ok := ctx.Value(requestCounterKey{}).(*int64); ok {
+		atomic.AddInt64(count, 1)
+	}
+}
+
+// AuditRecord is a record of an access to the contents of the blob.
+type AuditRecord struct {
+	// Time is the time when the access started.
+	Time time.Time
+
+	// URL is the URL of the request. This is empty for cache hits.
+	URL string
+
+	// Range is the requested range (e.g. "bytes=0-99").
+	Range string
+
+	// StatusCode is the status code of the response. This is zero for cache
+	// hits and failed requests.
+	StatusCode int
+
+	// Bytes is the size of the response body (-1 if unknown) or the size read
+	// from the cache.
+	Bytes int64
+
+	// FromCache is true if the contents are served from the cache.
+	FromCache bool
+
+	// Err is the error of the request, if any.
+	Err error
+}
+
+// AuditSink receives records of accesses to the contents of the blob.
+// Record can be called concurrently.
+type AuditSink interface {
+	Record(r AuditRecord)
+}
+
+// WithAuditSink makes the read record every request to the registry and every
+// cache hit to the specified sink.
+func WithAuditSink(sink AuditSink) Option {
+	return func(opts *options) {
+		opts.auditSink = sink
+	}
+}
+
+type auditSinkKey struct{}
+
+func withAuditSink(ctx context.Context, sink AuditSink) context.Context {
+	return context.WithValue(ctx, auditSinkKey{}, sink)
+}
+
+func audit(ctx context.Context, r AuditRecord) {
+	if sink, ok := ctx.Value(auditSinkKey{}).(AuditSink); ok {
+		sink.Record(r)
+	}
+}
+
 type remoteFetcher struct {
 	r Fetcher
 }
@@ -702,6 +2317,7 @@ func (r *remoteFetcher) fetch(ctx context.Context, rs []region, retry bool) (mul
 		s.add(reg)
 	}
 	reg := superRegion(s.rs)
+	countRequest(ctx)
 	rc, err := r.r.Fetch(ctx, reg.b, reg.size())
 	if err != nil {
 		return nil, err
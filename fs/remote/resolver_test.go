@@ -25,16 +25,26 @@ package remote
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 	digest "github.com/opencontainers/go-digest"
@@ -398,6 +408,758 @@ func (tr *sampleRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	}, nil
 }
 
+func TestPreferredNetwork(t *testing.T) {
+	ref := "dummyexample.com/library/test"
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte{0})
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+
+	for _, network := range []string{"tcp4", "tcp6"} {
+		t.Run(network, func(t *testing.T) {
+			var (
+				networks   []string
+				networksMu sync.Mutex
+			)
+			tr := &http.Transport{
+				DialContext: func(ctx context.Context, n, addr string) (net.Conn, error) {
+					networksMu.Lock()
+					networks = append(networks, n)
+					networksMu.Unlock()
+					return (&net.Dialer{}).DialContext(ctx, n, addr)
+				},
+			}
+			defer tr.CloseIdleConnections()
+			hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client: &http.Client{Transport: tr},
+					Host:   srvURL.Host,
+					Scheme: "http",
+					Path:   "/v2",
+				}}, nil
+			}
+			if _, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+				hosts:   hosts,
+				refspec: refspec,
+				desc:    ocispec.Descriptor{Digest: digest.FromString("dummy")},
+				network: network,
+			}); err != nil {
+				t.Fatalf("failed to resolve reference: %v", err)
+			}
+			networksMu.Lock()
+			defer networksMu.Unlock()
+			if len(networks) == 0 || networks[0] != network {
+				t.Errorf("dialer must be invoked with %q first; got %v", network, networks)
+			}
+		})
+	}
+}
+
+func TestPreferredNetworkRetryableTransport(t *testing.T) {
+	ref := "dummyexample.com/library/test"
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte{0})
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+
+	var (
+		networks   []string
+		networksMu sync.Mutex
+	)
+	inner := &http.Transport{
+		DialContext: func(ctx context.Context, n, addr string) (net.Conn, error) {
+			networksMu.Lock()
+			networks = append(networks, n)
+			networksMu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, n, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	rclient := rhttp.NewClient()
+	rclient.HTTPClient.Transport = inner
+	tr := &rhttp.RoundTripper{Client: rclient}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		// The client is shared by the resolutions, as configured hosts are.
+		return []docker.RegistryHost{{
+			Client: &http.Client{Transport: tr},
+			Host:   srvURL.Host,
+			Scheme: "http",
+			Path:   "/v2",
+		}}, nil
+	}
+	for i := 0; i < 3; i++ {
+		networksMu.Lock()
+		networks = nil
+		networksMu.Unlock()
+		// The server listens on IPv4 so dialing with tcp6 fails and falls back.
+		if _, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+			hosts:   hosts,
+			refspec: refspec,
+			desc:    ocispec.Descriptor{Digest: digest.FromString("dummy")},
+			network: "tcp6",
+		}); err != nil {
+			t.Fatalf("failed to resolve reference: %v", err)
+		}
+		if rclient.HTTPClient.Transport != inner {
+			t.Fatalf("the transport of the host must not be modified")
+		}
+		networksMu.Lock()
+		var preferred, fallback int
+		for _, n := range networks {
+			if n == "tcp6" {
+				preferred++
+			} else {
+				fallback++
+			}
+		}
+		networksMu.Unlock()
+		// Each connection dials once with tcp6 and once with the fallback.
+		if preferred == 0 || preferred != fallback {
+			t.Errorf("resolution %d: dials = %v; want a tcp6 dial and a fallback per connection", i, networks)
+		}
+	}
+}
+
+func TestWarmConnections(t *testing.T) {
+	const conns = 4
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-0/1")
+		w.Header().Set("Content-Length", "1")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte{0})
+	}))
+	defer srv.Close()
+
+	var (
+		dials   int
+		dialsMu sync.Mutex
+	)
+	tr := &http.Transport{
+		MaxIdleConnsPerHost: conns,
+		DialContext: func(ctx context.Context, n, addr string) (net.Conn, error) {
+			dialsMu.Lock()
+			dials++
+			dialsMu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, n, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	f := &httpFetcher{
+		url: srv.URL,
+		tr:  tr,
+	}
+	if err := f.warmConnections(context.Background(), conns); err != nil {
+		t.Fatalf("failed to warm connections: %v", err)
+	}
+	dialsMu.Lock()
+	if dials != conns {
+		t.Errorf("%d connections must be dialed; dialed %d", conns, dials)
+	}
+	dialsMu.Unlock()
+
+	// The following reads must reuse the warmed connections.
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mr, err := f.fetch(context.Background(), []region{{0, 0}}, true)
+			if err != nil {
+				t.Errorf("failed to fetch: %v", err)
+				return
+			}
+			defer mr.Close()
+			if _, r, err := mr.Next(); err == nil {
+				io.Copy(io.Discard, r)
+			}
+		}()
+	}
+	wg.Wait()
+	dialsMu.Lock()
+	if dials > conns {
+		t.Errorf("warmed connections must be reused; dialed %d (want %d)", dials, conns)
+	}
+	dialsMu.Unlock()
+}
+
+func TestMultipartBoundaryInBody(t *testing.T) {
+	const (
+		boundary = "sampleboundary"
+		size     = 100
+	)
+	parts := []struct {
+		reg     region
+		content string
+	}{
+		{region{0, 0}, "--" + boundary + "0"},
+		{region{10, 10}, "a--" + boundary + "--b"},
+		{region{20, 20}, "\r\n--" + boundary + "X\r\n"},
+		{region{30, 30}, boundary + "\r\n\r\n--"},
+		// Not a delimiter line, so the following bytes aren't headers.
+		{region{40, 40}, "--" + boundary + "X\r\n" + strings.Repeat("x", defaultMaxPartHeaderSize+1)},
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatalf("failed to set boundary: %v", err)
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": []string{fmt.Sprintf("bytes %d-%d/%d", p.reg.b, p.reg.e, size)},
+		})
+		if err != nil {
+			t.Fatalf("failed to create part: %v", err)
+		}
+		w.Write([]byte(p.content))
+	}
+	mw.Close()
+
+	mr := newMultiPartReader(io.NopCloser(&buf), boundary, defaultMaxPartHeaderSize)
+	defer mr.Close()
+	for i, want := range parts {
+		reg, r, err := mr.Next()
+		if err != nil {
+			t.Fatalf("failed to get part %d: %v", i, err)
+		}
+		if reg != want.reg {
+			t.Errorf("part %d: region = %+v; want %+v", i, reg, want.reg)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read part %d: %v", i, err)
+		}
+		if string(data) != want.content {
+			t.Errorf("part %d: content = %q; want %q", i, string(data), want.content)
+		}
+	}
+	if _, _, err := mr.Next(); err != io.EOF {
+		t.Errorf("parts must end with EOF; got %v", err)
+	}
+}
+
+func TestMultipartTrailingGarbage(t *testing.T) {
+	const (
+		boundary = "sampleboundary"
+		size     = 100
+	)
+	parts := []struct {
+		reg     region
+		content string
+	}{
+		{region{0, 2}, "abc"},
+		{region{10, 12}, "def"},
+	}
+	for _, trailer := range []string{
+		"",
+		"garbage",
+		"\r\ngarbage",
+		"--\r\n\x00\x01\r\n--" + boundary + "\r\n",
+	} {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.SetBoundary(boundary); err != nil {
+			t.Fatalf("failed to set boundary: %v", err)
+		}
+		for _, p := range parts {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Range": []string{fmt.Sprintf("bytes %d-%d/%d", p.reg.b, p.reg.e, size)},
+			})
+			if err != nil {
+				t.Fatalf("failed to create part: %v", err)
+			}
+			w.Write([]byte(p.content))
+		}
+		mw.Close()
+		body := bytes.TrimSuffix(buf.Bytes(), []byte("\r\n"))
+		body = append(body, trailer...)
+
+		mr := newMultiPartReader(io.NopCloser(bytes.NewReader(body)), boundary, defaultMaxPartHeaderSize)
+		for i, want := range parts {
+			reg, r, err := mr.Next()
+			if err != nil {
+				t.Fatalf("trailer %q: failed to get part %d: %v", trailer, i, err)
+			}
+			if reg != want.reg {
+				t.Errorf("trailer %q: part %d: region = %+v; want %+v", trailer, i, reg, want.reg)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("trailer %q: failed to read part %d: %v", trailer, i, err)
+			}
+			if string(data) != want.content {
+				t.Errorf("trailer %q: part %d: content = %q; want %q", trailer, i, string(data), want.content)
+			}
+		}
+		if _, _, err := mr.Next(); err != io.EOF {
+			t.Errorf("trailer %q: parts must end with EOF; got %v", trailer, err)
+		}
+		mr.Close()
+	}
+}
+
+func TestMultipartPartTooLarge(t *testing.T) {
+	const (
+		boundary = "sampleboundary"
+		size     = 100
+		limit    = 512
+	)
+	for _, tt := range []struct {
+		padding int
+		wantErr bool
+	}{
+		{padding: 10},
+		{padding: 10 * limit, wantErr: true},
+	} {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.SetBoundary(boundary); err != nil {
+			t.Fatalf("failed to set boundary: %v", err)
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": []string{fmt.Sprintf("bytes 0-2/%d", size)},
+			"X-Padding":     []string{strings.Repeat("x", tt.padding)},
+		})
+		if err != nil {
+			t.Fatalf("failed to create part: %v", err)
+		}
+		w.Write([]byte("abc"))
+		mw.Close()
+
+		mr := newMultiPartReader(io.NopCloser(&buf), boundary, limit)
+		_, r, err := mr.Next()
+		if tt.wantErr {
+			if !errors.Is(err, ErrPartTooLarge) {
+				t.Errorf("padding %d: part must be rejected with ErrPartTooLarge; got %v", tt.padding, err)
+			}
+		} else if err != nil {
+			t.Errorf("padding %d: failed to get part: %v", tt.padding, err)
+		} else if data, err := io.ReadAll(r); err != nil || string(data) != "abc" {
+			t.Errorf("padding %d: content = %q, %v; want %q", tt.padding, string(data), err, "abc")
+		}
+		mr.Close()
+	}
+}
+
+func TestOversizedResponse(t *testing.T) {
+	const size = 10
+	huge := bytes.Repeat([]byte("x"), 100*size)
+	multipartBody := func(content []byte) (string, []byte) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": []string{fmt.Sprintf("bytes 0-1/%d", size)},
+		})
+		if err != nil {
+			t.Fatalf("failed to create part: %v", err)
+		}
+		w.Write(content)
+		mw.Close()
+		return "multipart/byteranges; boundary=" + mw.Boundary(), buf.Bytes()
+	}
+	tests := []struct {
+		name       string
+		res        func() *http.Response
+		fetchError bool
+	}{
+		{
+			name: "whole blob with large body",
+			res: func() *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Length": []string{fmt.Sprintf("%d", size)}},
+					Body:       io.NopCloser(bytes.NewReader(huge)),
+				}
+			},
+		},
+		{
+			name: "whole blob with large Content-Length",
+			res: func() *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Length": []string{fmt.Sprintf("%d", len(huge))}},
+					Body:       io.NopCloser(bytes.NewReader(huge)),
+				}
+			},
+			fetchError: true,
+		},
+		{
+			name: "single range beyond the blob",
+			res: func() *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusPartialContent,
+					Header: http.Header{
+						"Content-Type":  []string{"application/octet-stream"},
+						"Content-Range": []string{fmt.Sprintf("bytes 0-%d/%d", len(huge)-1, len(huge))},
+					},
+					Body: io.NopCloser(bytes.NewReader(huge)),
+				}
+			},
+			fetchError: true,
+		},
+		{
+			name: "multipart with large part",
+			res: func() *http.Response {
+				ct, body := multipartBody(bytes.Repeat(huge, 10))
+				return &http.Response{
+					StatusCode: http.StatusPartialContent,
+					Header:     http.Header{"Content-Type": []string{ct}},
+					Body:       io.NopCloser(bytes.NewReader(body)),
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &httpFetcher{
+				url:  "test",
+				tr:   RoundTripFunc(func(req *http.Request) *http.Response { return tt.res() }),
+				size: size,
+			}
+			mr, err := f.fetch(context.Background(), []region{{0, 1}}, true)
+			if tt.fetchError {
+				if !errors.Is(err, ErrOversizedResponse) {
+					t.Fatalf("fetch must fail with ErrOversizedResponse; got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			defer mr.Close()
+			_, p, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to get part: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, p); !errors.Is(err, ErrOversizedResponse) {
+				t.Errorf("reading body must fail with ErrOversizedResponse; got %v", err)
+			}
+		})
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	const size = 10
+	content := []byte(sampleData1)
+	etag := `"v1"`
+	var mu sync.Mutex
+	tr := RoundTripFunc(func(req *http.Request) *http.Response {
+		mu.Lock()
+		cur := etag
+		mu.Unlock()
+		header := http.Header{}
+		header.Set("ETag", cur)
+		if req.Method == "HEAD" {
+			header.Set("Content-Length", fmt.Sprintf("%d", size))
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(nil))}
+		}
+		if req.Header.Get("If-Range") != cur {
+			header.Set("Content-Length", fmt.Sprintf("%d", size))
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(content))}
+		}
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Range", fmt.Sprintf("bytes 0-1/%d", size))
+		return &http.Response{StatusCode: http.StatusPartialContent, Header: header, Body: io.NopCloser(bytes.NewReader(content[:2]))}
+	})
+	gotSize, gotETag, err := getSize(context.Background(), "test", tr, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to get size: %v", err)
+	}
+	if gotSize != size || gotETag != etag {
+		t.Fatalf("size = %d, ETag = %q; want %d, %q", gotSize, gotETag, size, etag)
+	}
+	f := &httpFetcher{
+		url:  "test",
+		tr:   tr,
+		size: gotSize,
+		etag: gotETag,
+	}
+	mr, err := f.fetch(context.Background(), []region{{0, 1}}, true)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	mr.Close()
+
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	if _, err := f.fetch(context.Background(), []region{{0, 1}}, true); !errors.Is(err, ErrLayerChanged) {
+		t.Fatalf("fetch must fail with ErrLayerChanged; got %v", err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	blobDigest := digest.FromString("dummy")
+	desc := ocispec.Descriptor{Digest: blobDigest}
+	contentAddressed := IDGeneratorFunc(func(url string, dgst digest.Digest, offset, size int64) string {
+		return fmt.Sprintf("%s-%d-%d", dgst, offset, size)
+	})
+	genIDs := func(t *testing.T, r *Resolver) (ids []string) {
+		for _, ref := range []string{"registry1.example.com/library/test", "registry2.example.com/library/test"} {
+			refspec, err := reference.Parse(ref)
+			if err != nil {
+				t.Fatalf("failed to prepare dummy reference: %v", err)
+			}
+			hosts := hostsConfig(&sampleRoundTripper{okURLs: []string{`.*`}})(t)
+			f, _, err := r.resolveFetcher(context.Background(), hosts, refspec, desc)
+			if err != nil {
+				t.Fatalf("failed to resolve %q: %v", ref, err)
+			}
+			ids = append(ids, f.genID(region{10, 19}))
+		}
+		return ids
+	}
+
+	ids := genIDs(t, NewResolver(config.BlobConfig{}, nil, WithIDGenerator(contentAddressed)))
+	if want := fmt.Sprintf("%s-10-10", blobDigest); ids[0] != want || ids[1] != want {
+		t.Errorf("IDs = %q; want %q for both", ids, want)
+	}
+	ids = genIDs(t, NewResolver(config.BlobConfig{}, nil))
+	if ids[0] == ids[1] {
+		t.Errorf("default IDs of different URLs must differ; got %q", ids)
+	}
+}
+
+func TestNormalizePrefetchChunkSize(t *testing.T) {
+	tests := []struct {
+		prefetchChunkSize int64
+		chunkSize         int64
+		want              int64
+		wantErr           bool
+	}{
+		{prefetchChunkSize: 0, chunkSize: 10, want: 0},
+		{prefetchChunkSize: 5, chunkSize: 10, want: 5},
+		{prefetchChunkSize: 10, chunkSize: 10, want: 10},
+		{prefetchChunkSize: 25, chunkSize: 10, want: 20},
+		{prefetchChunkSize: 30, chunkSize: 10, want: 30},
+		{prefetchChunkSize: -1, chunkSize: 10, wantErr: true},
+		{prefetchChunkSize: 10, chunkSize: 0, wantErr: true},
+		{prefetchChunkSize: 10, chunkSize: -10, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizePrefetchChunkSize(tt.prefetchChunkSize, tt.chunkSize)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("(%d, %d): must be rejected", tt.prefetchChunkSize, tt.chunkSize)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("(%d, %d) = %d, %v; want %d", tt.prefetchChunkSize, tt.chunkSize, got, err, tt.want)
+		}
+	}
+
+	r := NewResolver(config.BlobConfig{PrefetchChunkSize: -1}, nil)
+	if _, err := r.Resolve(context.Background(), nil, reference.Spec{}, ocispec.Descriptor{}, cache.NewMemoryCache()); err == nil {
+		t.Errorf("Resolve must fail with the invalid prefetch chunk size")
+	}
+}
+
+func TestHedgedFetch(t *testing.T) {
+	const size = 10
+	content := []byte(sampleData1)
+	respond := func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header: http.Header{
+				"Content-Type":  []string{"application/octet-stream"},
+				"Content-Range": []string{fmt.Sprintf("bytes 0-2/%d", size)},
+			},
+			Body: io.NopCloser(bytes.NewReader(content[:3])),
+		}
+	}
+	primaryCanceled := make(chan struct{})
+	f := &httpFetcher{
+		url:  "primary",
+		size: size,
+		tr: RoundTripFunc(func(req *http.Request) *http.Response {
+			select {
+			case <-req.Context().Done():
+				close(primaryCanceled)
+			case <-time.After(10 * time.Second):
+				t.Errorf("the primary request must be canceled")
+			}
+			return failRoundTripper()(req)
+		}),
+		hedgeDelay: 10 * time.Millisecond,
+		hedge: &httpFetcher{
+			url:  "secondary",
+			size: size,
+			tr:   RoundTripFunc(respond),
+		},
+	}
+	mr, err := f.fetch(context.Background(), []region{{0, 2}}, true)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer mr.Close()
+	reg, p, err := mr.Next()
+	if err != nil {
+		t.Fatalf("failed to get part: %v", err)
+	}
+	data, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("failed to read part: %v", err)
+	}
+	if reg != (region{0, 2}) || string(data) != sampleData1[:3] {
+		t.Errorf("fetched %+v %q; want %+v %q", reg, string(data), region{0, 2}, sampleData1[:3])
+	}
+	select {
+	case <-primaryCanceled:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the primary request must be canceled")
+	}
+
+	// A failure of the primary before the hedge delay isn't hedged.
+	var hedged int64
+	f = &httpFetcher{
+		url:        "primary",
+		size:       size,
+		tr:         failRoundTripper(),
+		hedgeDelay: time.Hour,
+		hedge: &httpFetcher{
+			url:  "secondary",
+			size: size,
+			tr: RoundTripFunc(func(req *http.Request) *http.Response {
+				atomic.AddInt64(&hedged, 1)
+				return respond(req)
+			}),
+		},
+	}
+	if _, err := f.fetch(context.Background(), []region{{0, 2}}, true); err == nil {
+		t.Errorf("fetch must fail with the failure of the primary")
+	}
+	if n := atomic.LoadInt64(&hedged); n != 0 {
+		t.Errorf("hedged %d requests; want 0", n)
+	}
+}
+
+func TestResolveHedge(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	hosts := hostsConfig(&sampleRoundTripper{okURLs: []string{`.*`}}, hostSimple("mirrorexample.com"))(t)
+	f, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+		hosts:      hosts,
+		refspec:    refspec,
+		desc:       ocispec.Descriptor{Digest: digest.FromString("dummy")},
+		hedgeDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if f.hedge == nil {
+		t.Fatalf("the requests must be hedged to the second destination")
+	}
+	checkFetcherURL(t, f, "mirrorexample.com")
+	checkFetcherURL(t, f.hedge, "dummyexample.com")
+}
+
+func TestMultiFetcher(t *testing.T) {
+	const size = 10
+	var primaryCalls, secondaryCalls int64
+	respond := func(req *http.Request) *http.Response {
+		atomic.AddInt64(&secondaryCalls, 1)
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Header: http.Header{
+				"Content-Type":  []string{"application/octet-stream"},
+				"Content-Range": []string{fmt.Sprintf("bytes 0-2/%d", size)},
+			},
+			Body: io.NopCloser(bytes.NewReader([]byte(sampleData1[:3]))),
+		}
+	}
+	primary := &httpFetcher{
+		url:     "primary",
+		blobURL: "primary",
+		size:    size,
+		tr: RoundTripFunc(func(req *http.Request) *http.Response {
+			atomic.AddInt64(&primaryCalls, 1)
+			return failRoundTripper()(req)
+		}),
+	}
+	secondary := &httpFetcher{
+		url:     "secondary",
+		blobURL: "secondary",
+		size:    size,
+		tr:      RoundTripFunc(respond),
+	}
+	f := &multiFetcher{fetchers: []*httpFetcher{primary, secondary}}
+
+	for i := 0; i < 2; i++ {
+		mr, err := f.fetch(context.Background(), []region{{0, 2}}, true)
+		if err != nil {
+			t.Fatalf("#%d: failed to fetch: %v", i, err)
+		}
+		reg, p, err := mr.Next()
+		if err != nil {
+			t.Fatalf("#%d: failed to get part: %v", i, err)
+		}
+		data, err := io.ReadAll(p)
+		mr.Close()
+		if err != nil {
+			t.Fatalf("#%d: failed to read part: %v", i, err)
+		}
+		if reg != (region{0, 2}) || string(data) != sampleData1[:3] {
+			t.Errorf("#%d: fetched %+v %q; want %+v %q", i, reg, string(data), region{0, 2}, sampleData1[:3])
+		}
+	}
+	if n := atomic.LoadInt64(&primaryCalls); n != 1 {
+		t.Errorf("primary is called %d times; want 1 (the secondary must be remembered)", n)
+	}
+	if n := atomic.LoadInt64(&secondaryCalls); n != 2 {
+		t.Errorf("secondary is called %d times; want 2", n)
+	}
+	if err := f.check(); err != nil {
+		t.Errorf("check must succeed on the secondary: %v", err)
+	}
+	if got, want := f.genID(region{0, 2}), primary.genID(region{0, 2}); got != want {
+		t.Errorf("ID = %q; want %q of the first mirror", got, want)
+	}
+
+	secondary.tr = failRoundTripper()
+	if _, err := f.fetch(context.Background(), []region{{0, 2}}, true); err == nil {
+		t.Errorf("fetch must fail when all of the mirrors fail")
+	}
+}
+
+func TestResolveMirrors(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	hosts := hostsConfig(&sampleRoundTripper{okURLs: []string{`.*`}}, hostSimple("mirrorexample.com"))(t)
+	r := NewResolver(config.BlobConfig{MirrorFailover: true}, nil)
+	f, _, err := r.resolveFetcher(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: digest.FromString("dummy")})
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	mf, ok := f.(*multiFetcher)
+	if !ok || len(mf.fetchers) != 2 {
+		t.Fatalf("fetcher = %#v; want multiFetcher of 2 mirrors", f)
+	}
+	checkFetcherURL(t, mf.fetchers[0], "mirrorexample.com")
+	checkFetcherURL(t, mf.fetchers[1], "dummyexample.com")
+}
+
 func TestCheck(t *testing.T) {
 	tr := &breakRoundTripper{}
 	f := &httpFetcher{
@@ -459,6 +1221,68 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestBackoffStrategy(t *testing.T) {
+	const (
+		min = 10 * time.Millisecond
+		max = 100 * time.Millisecond
+	)
+	for _, tt := range []struct {
+		name string
+		rnd  func(n int64) int64
+		want func(ceil time.Duration) time.Duration
+	}{
+		{
+			name: "lowest",
+			rnd:  func(n int64) int64 { return 0 },
+			want: func(ceil time.Duration) time.Duration { return 0 },
+		},
+		{
+			name: "highest",
+			rnd:  func(n int64) int64 { return n - 1 },
+			want: func(ceil time.Duration) time.Duration { return ceil },
+		},
+		{
+			name: "middle",
+			rnd:  func(n int64) int64 { return n / 2 },
+			want: func(ceil time.Duration) time.Duration { return (ceil + 1) / 2 },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := newBackoffStrategy(tt.rnd)
+			for attempt := 0; attempt < 10; attempt++ {
+				ceil := min << attempt
+				if ceil > max {
+					ceil = max
+				}
+				if got, want := backoff(min, max, attempt, nil), tt.want(ceil); got != want {
+					t.Errorf("attempt %d: delay = %v; want %v", attempt, got, want)
+				}
+			}
+		})
+	}
+
+	// Delays must be spread within [0, cap] by the default random source.
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := backoffStrategy(min, max, 10, nil)
+		if d < 0 || d > max {
+			t.Fatalf("delay %v must be within [0, %v]", d, max)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("delays must be jittered; got %v", seen)
+	}
+
+	// Retry-After is respected
+	header := make(http.Header)
+	header.Set("Retry-After", "3")
+	res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}
+	if d := newBackoffStrategy(func(n int64) int64 { return 0 })(min, max, 0, res); d != 3*time.Second {
+		t.Errorf("delay = %v; must respect Retry-After", d)
+	}
+}
+
 type retryRoundTripper struct {
 	retryCount int
 }
@@ -22,6 +22,8 @@
 
 package remote
 
+import "sort"
+
 // region is HTTP-range-request-compliant range.
 // "b" is beginning byte of the range and "e" is the end.
 // "e" is must be inclusive along with HTTP's range expression.
@@ -50,7 +52,8 @@ type regionSet struct {
 }
 
 // add attempts to merge r to rs.rs with squashing the regions as
-// small as possible. This operation takes O(n).
+// small as possible. Adding a region already contained in the set is a no-op
+// so the total size isn't inflated by re-adding regions. This operation takes O(n).
 // TODO: more efficient way to do it.
 func (rs *regionSet) add(r region) {
 	// Iterate over the sorted region slice from the tail.
@@ -107,3 +110,83 @@ func (rs *regionSet) totalSize() int64 {
 	}
 	return sz
 }
+
+// Region is a region of the blob.
+type Region struct {
+	// Offset is the offset of the region.
+	Offset int64
+
+	// Size is the size of the region.
+	Size int64
+}
+
+// exportRegions converts the regions to Regions.
+func exportRegions(rs []region) []Region {
+	res := make([]Region, len(rs))
+	for i, r := range rs {
+		res[i] = Region{Offset: r.b, Size: r.size()}
+	}
+	return res
+}
+
+// AccessRecord is a record of an access to the blob.
+type AccessRecord struct {
+	// Offset is the offset of the accessed range.
+	Offset int64
+
+	// Size is the size of the accessed range.
+	Size int64
+}
+
+// ComputePrefetchRegions computes a compact set of regions which covers the
+// specified fraction (0-1) of the recorded accesses. Overlapping and adjacent
+// accesses are merged into a region and the regions are chosen in descending
+// order of the number of accesses they cover. The result is sorted by offset.
+func ComputePrefetchRegions(accesses []AccessRecord, coverage float64) []Region {
+	var set regionSet
+	var total int
+	for _, a := range accesses {
+		if a.Size <= 0 {
+			continue
+		}
+		set.add(region{a.Offset, a.Offset + a.Size - 1})
+		total++
+	}
+	if total == 0 || coverage <= 0 {
+		return nil
+	}
+
+	// Count the accesses covered by each merged region.
+	counts := make([]int, len(set.rs))
+	for _, a := range accesses {
+		if a.Size <= 0 {
+			continue
+		}
+		i := sort.Search(len(set.rs), func(i int) bool { return set.rs[i].e >= a.Offset })
+		counts[i]++
+	}
+	idx := make([]int, len(set.rs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		if counts[idx[i]] != counts[idx[j]] {
+			return counts[idx[i]] > counts[idx[j]]
+		}
+		return set.rs[idx[i]].size() < set.rs[idx[j]].size()
+	})
+
+	var (
+		regs    []region
+		covered int
+	)
+	for _, i := range idx {
+		if float64(covered) >= coverage*float64(total) {
+			break
+		}
+		regs = append(regs, set.rs[i])
+		covered += counts[i]
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].b < regs[j].b })
+	return exportRegions(regs)
+}
@@ -95,3 +95,50 @@ func TestRegionSet(t *testing.T) {
 		}
 	}
 }
+
+func TestComputePrefetchRegions(t *testing.T) {
+	var accesses []AccessRecord
+	// hot: 0-99 accessed 6 times, 1000-1099 accessed 3 times
+	for i := 0; i < 6; i++ {
+		accesses = append(accesses, AccessRecord{Offset: int64(i) * 10, Size: 20})
+	}
+	for i := 0; i < 3; i++ {
+		accesses = append(accesses, AccessRecord{Offset: 1000 + int64(i)*50, Size: 10})
+	}
+	// cold: accessed once each
+	accesses = append(accesses, AccessRecord{Offset: 5000, Size: 10}, AccessRecord{Offset: 100, Size: 0})
+
+	tests := []struct {
+		coverage float64
+		expected []Region
+	}{
+		{coverage: 0, expected: nil},
+		{coverage: 0.5, expected: []Region{{0, 70}}},
+		{coverage: 0.9, expected: []Region{{0, 70}, {1000, 10}, {1050, 10}, {1100, 10}}},
+		{coverage: 1, expected: []Region{{0, 70}, {1000, 10}, {1050, 10}, {1100, 10}, {5000, 10}}},
+	}
+	for _, tt := range tests {
+		regs := ComputePrefetchRegions(accesses, tt.coverage)
+		if !reflect.DeepEqual(regs, tt.expected) {
+			t.Errorf("coverage %v: regions = %v; want %v", tt.coverage, regs, tt.expected)
+		}
+
+		// Check the regions actually cover the requested fraction.
+		var covered, total int
+		for _, a := range accesses {
+			if a.Size <= 0 {
+				continue
+			}
+			total++
+			for _, r := range regs {
+				if r.Offset <= a.Offset && a.Offset+a.Size <= r.Offset+r.Size {
+					covered++
+					break
+				}
+			}
+		}
+		if float64(covered) < tt.coverage*float64(total) {
+			t.Errorf("coverage %v: regions cover %d/%d accesses", tt.coverage, covered, total)
+		}
+	}
+}